@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,21 +20,72 @@ const (
 	defaultDbType      = "basic"
 	mongoDbScheme      = "mongodb://"
 	defaultMongoDbAddr = "localhost:27017"
+	defaultBoltPath    = db.DefaultBoltPath
+	defaultSQLitePath  = db.DefaultSQLitePath
+	defaultPostgresDSN = db.DefaultPostgresDSN
+	defaultRedisAddr   = "localhost:6379"
 	defaultLogLevel    = "debug"
 	logFile            = "palermo.log"
+	// requestTimeout bounds the handling of every request, except the ones of the routes that stream their responses
+	requestTimeout = 15 * time.Second
 )
 
 var (
 	repo *handlers.Repository
 )
 
+// dbConfig holds the settings needed to initialize any of the supported database types
+type dbConfig struct {
+	dbType      string
+	opTimeout   time.Duration // max time of a single database operation
+	walDir      string        // only used by "basic", makes it durable when set
+	snapshotInt time.Duration // only used by "basic" when walDir is set
+	mongoDbAddr string        // only needed for "mongodb"
+	boltPath    string        // only needed for "bolt"
+	sqlitePath  string        // only needed for "sqlite"
+	postgresDSN string        // only needed for "postgres"
+	redisAddr   string        // only needed for "redis"
+	cacheSize   int           // max msgs cached in front of the db, 0 disables the cache
+	cacheTTL    time.Duration // only used when cacheSize > 0
+}
+
 func main() {
 	// flags
-	var dbType, logLevel, mongoDbAddr, tlsCertFile, tlsKeyFile string
+	var logLevel, tlsCertFile, tlsKeyFile, palindromeProfile, analyzers string
 	var port int
+	var trashRetention, trashPurgeInt, expiryReapInt time.Duration
+	var dbCfg dbConfig
 	flag.IntVar(&port, "port", defaultPort, "-port=<port>: port on which to listen and serve")
-	flag.StringVar(&dbType, "dbtype", defaultDbType, "-dbtype=<type>: types are 'basic' (local memory) and 'mongodb")
-	flag.StringVar(&mongoDbAddr, "mongodb-addr", defaultMongoDbAddr, "-mongodb-addr=<host>:<port>: port where mongo db is listening")
+	flag.StringVar(&dbCfg.dbType, "dbtype", defaultDbType, "-dbtype=<type>: types are 'basic' (local memory), 'bolt' (local file), "+
+		"'sqlite' (local file), 'postgres', 'redis' and 'mongodb'")
+	flag.DurationVar(&dbCfg.opTimeout, "db-timeout", db.DefaultOpTimeout, "-db-timeout=<duration>: max time a single database "+
+		"operation can take before being canceled, 0 leaves them unbounded, e.g: 500ms, 5s")
+	flag.IntVar(&dbCfg.cacheSize, "cache-size", 0, "-cache-size=<msgs>: max number of messages kept in an in-memory LRU cache "+
+		"in front of the database, 0 disables the cache")
+	flag.DurationVar(&dbCfg.cacheTTL, "cache-ttl", db.DefaultCacheTTL, "-cache-ttl=<duration>: max time a message is cached, "+
+		"0 keeps it until evicted; changes made by other instances may be missed for that long, e.g: 30s, 5m")
+	flag.StringVar(&dbCfg.walDir, "basic-wal-dir", "", "-basic-wal-dir=<dir>: directory where the 'basic' db keeps its write ahead "+
+		"log and snapshots, if not set the messages only live in memory")
+	flag.DurationVar(&dbCfg.snapshotInt, "basic-snapshot-interval", db.DefaultSnapshotInterval, "-basic-snapshot-interval=<duration>: "+
+		"how often the write ahead log of the 'basic' db is compacted into a snapshot, 0 only does it on shutdown, e.g: 30s, 5m")
+	flag.StringVar(&dbCfg.mongoDbAddr, "mongodb-addr", defaultMongoDbAddr, "-mongodb-addr=<host>:<port>: port where mongo db is listening")
+	flag.StringVar(&dbCfg.boltPath, "bolt-path", defaultBoltPath, "-bolt-path=<path>: path of the file where bolt db stores the messages")
+	flag.StringVar(&dbCfg.postgresDSN, "postgres-dsn", defaultPostgresDSN, "-postgres-dsn=<dsn>: url of the postgres database, "+
+		"e.g: postgres://<user>:<password>@<host>:<port>/<db>")
+	flag.StringVar(&dbCfg.redisAddr, "redis-addr", defaultRedisAddr, "-redis-addr=<host>:<port>: port where redis is listening")
+	flag.StringVar(&dbCfg.sqlitePath, "sqlite-path", defaultSQLitePath, "-sqlite-path=<path>: path of the file where sqlite stores the messages")
+	flag.DurationVar(&trashRetention, "trash-retention", db.DefaultTrashRetention, "-trash-retention=<duration>: how long "+
+		"deleted messages are kept in the trash before being purged, 0 keeps them forever, e.g: 24h, 720h")
+	flag.DurationVar(&trashPurgeInt, "trash-purge-interval", db.DefaultTrashPurgeInterval, "-trash-purge-interval=<duration>: "+
+		"how often the trash is checked for messages past their retention, 0 disables the purge, e.g: 10m, 1h")
+	flag.DurationVar(&expiryReapInt, "expiry-reap-interval", db.DefaultExpiryReapInterval, "-expiry-reap-interval=<duration>: "+
+		"how often the expired messages are purged to free their space (they are hidden as soon as they expire), e.g: 30s, 5m")
+	flag.StringVar(&palindromeProfile, "palindrome-profile", string(db.DefaultPalindromeProfile), "-palindrome-profile=<profile>: "+
+		"how messages are checked for being palindromes when their requests don't choose, profiles are 'strict', "+
+		"'case-insensitive', 'letters-only' (ignores everything but letters), 'alphanumeric' and 'diacritic-insensitive'")
+	flag.StringVar(&analyzers, "analyzers", strings.Join(db.AnalyzerNames(), ","), "-analyzers=<names>: comma separated "+
+		"analyzers run on the messages, whose results are stored in their properties, analyzers are 'isPalindrome', "+
+		"'isWordPalindrome' and 'longestPalindrome'; those not enabled leave their fields false or empty")
 	flag.StringVar(&logLevel, "loglevel", defaultLogLevel, "-loglevel=<level>: levels are info, debug, trace")
 	flag.StringVar(&tlsCertFile, "tlscert", "", "-tlscert=<path_to_cert.pem>: path to PEM encoded certificate file (if tls is required). "+
 		"tlskey must also be set for tls to be used")
@@ -46,20 +98,34 @@ func main() {
 	}
 	defer closer.Close()
 
-	msgDb, err := initDb(dbType, mongoDbAddr)
+	msgDb, err := initDb(dbCfg)
 	if err != nil {
 		log.Fatal("Failed to initialize database: ", err.Error())
 	}
 	defer msgDb.Close()
 
+	purger := db.NewTrashPurger(msgDb, trashRetention, trashPurgeInt)
+	defer purger.Stop()
+	reaper := db.NewExpiryReaper(msgDb, expiryReapInt)
+	defer reaper.Stop()
+
+	err = db.EnableAnalyzers(parseAnalyzers(analyzers))
+	if err != nil {
+		log.Fatal("Invalid analyzers: ", err.Error())
+	}
+	profile, err := db.ParsePalindromeProfile(palindromeProfile)
+	if err != nil {
+		log.Fatal("Invalid palindrome profile: ", err.Error())
+	}
 	repo = handlers.NewRepository(msgDb)
+	repo.SetDefaultProfile(profile)
 
 	addr := "localhost:" + strconv.Itoa(port)
 	server := &http.Server{
-		Handler:      router(),
-		Addr:         addr,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:     router(requestTimeout),
+		Addr:        addr,
+		ReadTimeout: 15 * time.Second,
+		// no WriteTimeout, it would cut the streams short: router bounds the other requests by requestTimeout
 	}
 
 	if tlsCertFile != "" && tlsKeyFile != "" {
@@ -78,30 +144,78 @@ func main() {
 	}
 }
 
-// initDb creates the required database instance
-// dbType can be "basic" or "mongodb"
-// mongoDbAddr only needs to be specified if dbType is "mongodb"
-func initDb(dbType, mongoDbAddr string) (db.MsgDB, error) {
+// initDb creates the required database instance, wrapped by a cache if cfg.cacheSize > 0
+// cfg.dbType can be "basic", "bolt", "sqlite", "postgres", "redis" or "mongodb", only the settings of the selected type are used
+func initDb(cfg dbConfig) (db.MsgDB, error) {
 	var err error
 	var msgDb db.MsgDB
-	if dbType == "basic" {
+	if cfg.dbType == "basic" && cfg.walDir == "" {
 		msgDb = db.NewBasicMsgDB()
-	} else if dbType == "mongodb" {
-		fullAddr := mongoDbScheme + mongoDbAddr
+	} else if cfg.dbType == "basic" {
+		log.Info("Basic DB write ahead log dir set to ", cfg.walDir)
+		msgDb, err = db.NewDurableBasicMsgDB(cfg.walDir, cfg.snapshotInt)
+		if err != nil {
+			log.Errorf("Failed to recover basic DB from dir %s, err: %s", cfg.walDir, err.Error())
+			return nil, err
+		}
+	} else if cfg.dbType == "bolt" {
+		log.Info("Bolt DB path set to ", cfg.boltPath)
+		msgDb, err = db.NewBoltMsgDB(cfg.boltPath, cfg.opTimeout)
+		if err != nil {
+			log.Errorf("Failed to open bolt DB at path %s, err: %s", cfg.boltPath, err.Error())
+			return nil, err
+		}
+	} else if cfg.dbType == "sqlite" {
+		log.Info("SQLite DB path set to ", cfg.sqlitePath)
+		msgDb, err = db.NewSQLiteMsgDB(cfg.sqlitePath, cfg.opTimeout)
+		if err != nil {
+			log.Errorf("Failed to open sqlite DB at path %s, err: %s", cfg.sqlitePath, err.Error())
+			return nil, err
+		}
+	} else if cfg.dbType == "postgres" {
+		msgDb, err = db.NewPostgresMsgDB(cfg.postgresDSN, cfg.opTimeout)
+		if err != nil {
+			log.Error("Failed to connect to postgres DB, err: ", err.Error())
+			return nil, err
+		}
+	} else if cfg.dbType == "redis" {
+		log.Info("Redis addr set to ", cfg.redisAddr)
+		msgDb, err = db.NewRedisMsgDB(cfg.redisAddr, db.DefaultRedisKeyPrefix, cfg.opTimeout)
+		if err != nil {
+			log.Errorf("Failed to connect to redis at addr %s, err: %s", cfg.redisAddr, err.Error())
+			return nil, err
+		}
+	} else if cfg.dbType == "mongodb" {
+		fullAddr := mongoDbScheme + cfg.mongoDbAddr
 		log.Info("Mongo DB port set to ", fullAddr)
-		msgDb, err = db.NewMongoMsgDB(fullAddr, db.DefaultMsgDbName, db.DefaultMsgCollectionName)
+		msgDb, err = db.NewMongoMsgDB(fullAddr, db.DefaultMsgDbName, db.DefaultMsgCollectionName, cfg.opTimeout)
 		if err != nil {
-			log.Errorf("Failed to connect to mongo DB at addr %s, err: %s", mongoDbAddr, err.Error())
+			log.Errorf("Failed to connect to mongo DB at addr %s, err: %s", cfg.mongoDbAddr, err.Error())
 			return nil, err
 		}
 	} else {
-		return nil, errors.New("unsupported db type: " + dbType)
+		return nil, errors.New("unsupported db type: " + cfg.dbType)
 	}
 
-	log.Info("Database type set to ", dbType)
+	log.Info("Database type set to ", cfg.dbType)
+	if cfg.cacheSize > 0 {
+		log.Infof("Caching up to %d messages for %s", cfg.cacheSize, cfg.cacheTTL)
+		msgDb = db.NewCachedMsgDB(msgDb, cfg.cacheSize, cfg.cacheTTL)
+	}
 	return msgDb, err
 }
 
+// parseAnalyzers returns the names in the comma separated list provided, an empty list enables none
+func parseAnalyzers(list string) []string {
+	names := []string{}
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // initLogger sets the log level and attempts to open a log file
 // return an error and a closer that should be used to close the log file at the end of its lifetime
 func initLogger(logLevel string) (io.Closer, error) {
@@ -125,16 +239,33 @@ func initLogger(logLevel string) (io.Closer, error) {
 	return f, nil
 }
 
-// router returns the handler of our API paths
-func router() http.Handler {
+// router returns the handler of our API paths, the requests that don't stream their response must be handled within
+// requestTimeout
+func router(requestTimeout time.Duration) http.Handler {
 	router := mux.NewRouter()
 
+	// streaming handlers, they last as long as there's something to stream
+	router.HandleFunc("/v1/retrieveAllMsgs", repo.HandleRetrieveAllMsgs).HeadersRegexp("Accept", "application/x-ndjson")
+	router.HandleFunc("/v1/events", repo.HandleEvents)
+	router.HandleFunc("/v1/subscribe", repo.HandleSubscribe)
+
 	// handlers
-	router.HandleFunc("/v1/createMsg", repo.HandleCreateMsg).Methods("POST")
-	router.HandleFunc("/v1/retrieveMsg/{id}", repo.HandleRetrieveMsg)
-	router.HandleFunc("/v1/retrieveAllMsgs", repo.HandleRetrieveAllMsgs)
-	router.HandleFunc("/v1/updateMsg/{id}", repo.HandleUpdateMsg).Methods("POST")
-	router.HandleFunc("/v1/deleteMsg/{id}", repo.HandleDeleteMsg)
+	api := router.NewRoute().Subrouter()
+	api.Use(handlers.TimeoutMiddleware(requestTimeout))
+	api.HandleFunc("/v1/createMsg", repo.HandleCreateMsg).Methods("POST")
+	api.HandleFunc("/v1/retrieveMsg/{id}", repo.HandleRetrieveMsg)
+	api.HandleFunc("/v1/retrieveAllMsgs", repo.HandleRetrieveAllMsgs)
+	api.HandleFunc("/v1/searchMsgs", repo.HandleSearchMsgs)
+	api.HandleFunc("/v1/updateMsg/{id}", repo.HandleUpdateMsg).Methods("POST")
+	api.HandleFunc("/v1/deleteMsg/{id}", repo.HandleDeleteMsg)
+	api.HandleFunc("/v1/retrieveMsgRevisions/{id}", repo.HandleRetrieveMsgRevisions)
+	api.HandleFunc("/v1/retrieveMsgRevision/{id}/{version}", repo.HandleRetrieveMsgRevision)
+	api.HandleFunc("/v1/diffMsgRevisions/{id}", repo.HandleDiffMsgRevisions)
+	api.HandleFunc("/v1/rollbackMsg/{id}/{version}", repo.HandleRollbackMsg).Methods("POST")
+	api.HandleFunc("/v1/retrieveTrashedMsgs", repo.HandleRetrieveTrashedMsgs)
+	api.HandleFunc("/v1/restoreMsg/{id}", repo.HandleRestoreMsg).Methods("POST")
+	api.HandleFunc("/v1/batch", repo.HandleBatch).Methods("POST")
+	api.HandleFunc("/v1/retrieveCacheStats", repo.HandleRetrieveCacheStats)
 	// middlewares
 	router.Use(handlers.RecoveryMiddleware)
 	router.Use(handlers.LoggingMiddleware)
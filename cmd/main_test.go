@@ -1,26 +1,94 @@
 package main
 
 import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/uritrejo/palermo/internal/db"
+	"github.com/uritrejo/palermo/internal/handlers"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestInitDb_Basic(t *testing.T) {
-	msgDb, err := initDb("basic", "")
+	msgDb, err := initDb(dbConfig{dbType: "basic"})
 	assert.Nil(t, err)
 	assert.IsType(t, &db.BasicMsgDB{}, msgDb)
 }
 
+func TestInitDb_Cached(t *testing.T) {
+	msgDb, err := initDb(dbConfig{dbType: "basic", cacheSize: 10, cacheTTL: time.Minute})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.CachedMsgDB{}, msgDb)
+	assert.IsType(t, &db.BasicMsgDB{}, msgDb.(*db.CachedMsgDB).MsgDB)
+}
+
+func TestInitDb_DurableBasic(t *testing.T) {
+	msgDb, err := initDb(dbConfig{dbType: "basic", walDir: t.TempDir(), snapshotInt: time.Minute})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.BasicMsgDB{}, msgDb)
+}
+
+func TestInitDb_Bolt(t *testing.T) {
+	msgDb, err := initDb(dbConfig{dbType: "bolt", boltPath: filepath.Join(t.TempDir(), "test.db")})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.BoltMsgDB{}, msgDb)
+}
+
+func TestInitDb_SQLite(t *testing.T) {
+	msgDb, err := initDb(dbConfig{dbType: "sqlite", sqlitePath: filepath.Join(t.TempDir(), "test.sqlite")})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.SQLiteMsgDB{}, msgDb)
+}
+
+func TestInitDb_Unsupported(t *testing.T) {
+	msgDb, err := initDb(dbConfig{dbType: "potato"})
+	assert.Nil(t, msgDb)
+	assert.NotNil(t, err)
+}
+
 func TestInitDb_Mongo(t *testing.T) {
 	t.Skip("MongoDB test deactivated for now")
 
-	msgDb, err := initDb("mongodb", defaultMongoDbAddr)
+	msgDb, err := initDb(dbConfig{dbType: "mongodb", mongoDbAddr: defaultMongoDbAddr, opTimeout: db.DefaultOpTimeout})
 	assert.Nil(t, err)
 	assert.IsType(t, &db.MongoMsgDB{}, msgDb)
 }
 
+func TestInitDb_Postgres(t *testing.T) {
+	t.Skip("Postgres test deactivated for now")
+
+	msgDb, err := initDb(dbConfig{dbType: "postgres", postgresDSN: defaultPostgresDSN, opTimeout: db.DefaultOpTimeout})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.PostgresMsgDB{}, msgDb)
+}
+
+func TestInitDb_Redis(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	msgDb, err := initDb(dbConfig{dbType: "redis", redisAddr: server.Addr(), opTimeout: db.DefaultOpTimeout})
+	assert.Nil(t, err)
+	defer msgDb.Close()
+	assert.IsType(t, &db.RedisMsgDB{}, msgDb)
+}
+
+func TestParseAnalyzers(t *testing.T) {
+	assert.Equal(t, []string{"isPalindrome", "longestPalindrome"}, parseAnalyzers("isPalindrome, longestPalindrome"))
+	assert.Equal(t, []string{}, parseAnalyzers(""))
+	assert.Nil(t, db.EnableAnalyzers(parseAnalyzers(strings.Join(db.AnalyzerNames(), ","))))
+}
+
 func TestInitLogger(t *testing.T) {
 	f, err := initLogger("debug")
 	assert.Nil(t, err)
@@ -30,5 +98,57 @@ func TestInitLogger(t *testing.T) {
 }
 
 func TestRouter(t *testing.T) {
-	assert.NotNil(t, router())
+	assert.NotNil(t, router(requestTimeout))
+}
+
+// slowMsgDB takes listDelay to list msgs, and readDelay to read each of them when iterating
+type slowMsgDB struct {
+	db.MsgDB
+	listDelay time.Duration
+	readDelay time.Duration
+}
+
+func (s *slowMsgDB) ListMsgs(ctx context.Context, opts db.ListOptions) (*db.MsgPage, error) {
+	time.Sleep(s.listDelay)
+	return s.MsgDB.ListMsgs(ctx, opts)
+}
+
+func (s *slowMsgDB) ForEachMsg(ctx context.Context, fn func(msg *db.Msg) error) error {
+	return s.MsgDB.ForEachMsg(ctx, func(msg *db.Msg) error {
+		time.Sleep(s.readDelay)
+		return fn(msg)
+	})
+}
+
+func TestRouter_RequestTimeout(t *testing.T) {
+	// an export lasts as long as it takes, while the other requests are bounded by the request timeout
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	for _, id := range []string{"pony", "unicorn", "kayak", "canoe"} {
+		assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg(id, "racecar")))
+	}
+	prevRepo := repo
+	repo = handlers.NewRepository(&slowMsgDB{MsgDB: basicDb, listDelay: 200 * time.Millisecond,
+		readDelay: 50 * time.Millisecond})
+	defer func() { repo = prevRepo }()
+	server := httptest.NewServer(router(100 * time.Millisecond))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/v1/retrieveAllMsgs", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 4, strings.Count(string(body), "\n"))
+	}
+
+	resp, err = http.Get(server.URL + "/v1/retrieveAllMsgs?limit=10")
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
 }
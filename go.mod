@@ -3,8 +3,16 @@ module github.com/uritrejo/palermo
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.22.0
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/jackc/pgx/v4 v4.16.1
+	github.com/rivo/uniseg v0.4.7
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/testify v1.6.1
+	github.com/stretchr/testify v1.7.0
+	go.etcd.io/bbolt v1.3.6
 	go.mongodb.org/mongo-driver v1.8.4
+	golang.org/x/text v0.3.7
+	modernc.org/sqlite v1.17.3
 )
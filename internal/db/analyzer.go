@@ -0,0 +1,209 @@
+package db
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"sync"
+)
+
+// the names of the analyzers registered by default, in the order they run
+const (
+	PalindromeAnalyzer        = "isPalindrome"
+	WordPalindromeAnalyzer    = "isWordPalindrome"
+	LongestPalindromeAnalyzer = "longestPalindrome"
+)
+
+// Analyzer computes a property of the msgs, which NewMsg stores in Msg.Properties under the name of the analyzer
+// the property must be encodable as json, it's kept as its json value (e.g. a struct becomes a map[string]interface{}
+// and the numbers become float64s), the way every db returns it
+type Analyzer interface {
+	Name() string
+	Analyze(msg *Msg) interface{}
+}
+
+// analyzerFunc is an Analyzer made of a function
+type analyzerFunc struct {
+	name    string
+	analyze func(msg *Msg) interface{}
+}
+
+// NewAnalyzer returns the analyzer named name that computes its property with analyze
+func NewAnalyzer(name string, analyze func(msg *Msg) interface{}) Analyzer {
+	return &analyzerFunc{name: name, analyze: analyze}
+}
+
+func (a *analyzerFunc) Name() string {
+	return a.name
+}
+
+func (a *analyzerFunc) Analyze(msg *Msg) interface{} {
+	return a.analyze(msg)
+}
+
+// analyzerRegistry holds the analyzers in the order they were registered, which is the order they run in
+type analyzerRegistry struct {
+	mu        sync.RWMutex
+	analyzers []Analyzer
+	enabled   map[string]bool // nil if every analyzer is
+}
+
+var analyzers = &analyzerRegistry{}
+
+func init() {
+	RegisterAnalyzer(NewAnalyzer(PalindromeAnalyzer, func(msg *Msg) interface{} {
+		return isPalindrome(msg.Content, msg.PalindromeProfile)
+	}))
+	RegisterAnalyzer(NewAnalyzer(WordPalindromeAnalyzer, func(msg *Msg) interface{} {
+		return isWordPalindrome(msg.Content)
+	}))
+	RegisterAnalyzer(NewAnalyzer(LongestPalindromeAnalyzer, func(msg *Msg) interface{} {
+		return longestPalindrome(msg.Content, msg.PalindromeProfile)
+	}))
+}
+
+// RegisterAnalyzer adds a to the analyzers run by NewMsg, after the ones already registered
+// it is enabled unless EnableAnalyzers chose the ones that are; it panics if a has no name or if the name is taken
+func RegisterAnalyzer(a Analyzer) {
+	analyzers.mu.Lock()
+	defer analyzers.mu.Unlock()
+
+	if a.Name() == "" {
+		panic("db: an analyzer must have a name")
+	}
+	for _, registered := range analyzers.analyzers {
+		if registered.Name() == a.Name() {
+			panic("db: RegisterAnalyzer called twice for analyzer " + a.Name())
+		}
+	}
+	analyzers.analyzers = append(analyzers.analyzers, a)
+}
+
+// AnalyzerNames returns the names of the analyzers registered, in the order they run
+func AnalyzerNames() []string {
+	analyzers.mu.RLock()
+	defer analyzers.mu.RUnlock()
+
+	names := make([]string, 0, len(analyzers.analyzers))
+	for _, a := range analyzers.analyzers {
+		names = append(names, a.Name())
+	}
+	return names
+}
+
+// EnableAnalyzers only runs the analyzers named, every analyzer runs until it's called
+// the msgs already created keep their properties. Returns ErrInvalidAnalyzer if a name is not registered, the
+// analyzers enabled are left as they were
+func EnableAnalyzers(names []string) error {
+	analyzers.mu.Lock()
+	defer analyzers.mu.Unlock()
+
+	enabled := make(map[string]bool, len(names))
+	for _, name := range names {
+		registered := false
+		for _, a := range analyzers.analyzers {
+			registered = registered || a.Name() == name
+		}
+		if !registered {
+			return ErrInvalidAnalyzer{Name: name}
+		}
+		enabled[name] = true
+	}
+	analyzers.enabled = enabled
+	return nil
+}
+
+// EnabledAnalyzers returns the names of the analyzers enabled, in the order they run
+func EnabledAnalyzers() []string {
+	analyzers.mu.RLock()
+	defer analyzers.mu.RUnlock()
+
+	names := []string{}
+	for _, a := range analyzers.analyzers {
+		if analyzers.enabled == nil || analyzers.enabled[a.Name()] {
+			names = append(names, a.Name())
+		}
+	}
+	return names
+}
+
+// analyze runs the analyzers enabled on msg and returns their results by name, as they returned them
+func analyze(msg *Msg) map[string]interface{} {
+	analyzers.mu.RLock()
+	defer analyzers.mu.RUnlock()
+
+	results := map[string]interface{}{}
+	for _, a := range analyzers.analyzers {
+		if analyzers.enabled == nil || analyzers.enabled[a.Name()] {
+			results[a.Name()] = a.Analyze(msg)
+		}
+	}
+	return results
+}
+
+// MsgProperties are the results of the analyzers run on a msg, by the name of the analyzer, as json values
+type MsgProperties map[string]interface{}
+
+// newMsgProperties returns results as json values, nil if there are none
+// the results that can't be encoded as json are left out
+func newMsgProperties(results map[string]interface{}) MsgProperties {
+	if len(results) == 0 {
+		return nil
+	}
+
+	props := make(MsgProperties, len(results))
+	for name, result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Errorf("Failed to encode the result of analyzer %s: %s", name, err.Error())
+			continue
+		}
+		var value interface{}
+		_ = json.Unmarshal(data, &value)
+		props[name] = value
+	}
+	return props
+}
+
+// encodeMsgProperties returns props as the json text the sql and redis dbs store, empty if there are none
+func encodeMsgProperties(props MsgProperties) string {
+	if len(props) == 0 {
+		return ""
+	}
+	// the properties are json values already, they always encode
+	data, _ := json.Marshal(props)
+	return string(data)
+}
+
+// decodeMsgProperties returns the properties encoded by encodeMsgProperties, nil if there are none (the msgs stored
+// before the properties were have none)
+func decodeMsgProperties(s string) (MsgProperties, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var props MsgProperties
+	err := json.Unmarshal([]byte(s), &props)
+	if err != nil || len(props) == 0 {
+		return nil, err
+	}
+	return props, nil
+}
+
+// UnmarshalBSON decodes the properties stored by mongo into their json values, as the other dbs return them, rather
+// than into the bson types (e.g. primitive.D for the objects, int32 for the numbers). A null is no properties
+func (p *MsgProperties) UnmarshalBSON(data []byte) error {
+	if len(data) == 0 {
+		*p = nil
+		return nil
+	}
+	ext, err := bson.MarshalExtJSON(bson.Raw(data), false, false)
+	if err != nil {
+		return err
+	}
+	props, err := decodeMsgProperties(string(ext))
+	if err != nil {
+		return err
+	}
+	*p = props
+	return nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"unicode/utf8"
+)
+
+// withAnalyzers runs fn with only the analyzers named enabled, then enables the default ones back
+func withAnalyzers(t *testing.T, names []string, fn func()) {
+	assert.Nil(t, EnableAnalyzers(names))
+	defer func() {
+		assert.Nil(t, EnableAnalyzers([]string{PalindromeAnalyzer, WordPalindromeAnalyzer, LongestPalindromeAnalyzer}))
+	}()
+	fn()
+}
+
+func TestAnalyzers_Default(t *testing.T) {
+	assert.Equal(t, []string{PalindromeAnalyzer, WordPalindromeAnalyzer, LongestPalindromeAnalyzer}, AnalyzerNames()[:3])
+
+	msg := NewMsg("unicorn", "Kayak kayak")
+	assert.Equal(t, MsgProperties{
+		PalindromeAnalyzer:     true,
+		WordPalindromeAnalyzer: true,
+		LongestPalindromeAnalyzer: map[string]interface{}{
+			"text":   "Kayak kayak",
+			"offset": float64(0),
+			"length": float64(11),
+		},
+	}, msg.Properties)
+	assert.True(t, msg.IsPalindrome)
+	assert.True(t, msg.IsWordPalindrome)
+	assert.Equal(t, PalindromeSpan{Text: "Kayak kayak", Offset: 0, Length: 11}, msg.LongestPalindrome)
+}
+
+func TestAnalyzers_Enable(t *testing.T) {
+	withAnalyzers(t, []string{WordPalindromeAnalyzer}, func() {
+		assert.Equal(t, []string{WordPalindromeAnalyzer}, EnabledAnalyzers())
+
+		msg := NewMsg("unicorn", "kayak")
+		assert.Equal(t, MsgProperties{WordPalindromeAnalyzer: true}, msg.Properties)
+		// the fields of the analyzers not enabled are left empty
+		assert.False(t, msg.IsPalindrome)
+		assert.True(t, msg.IsWordPalindrome)
+		assert.Equal(t, PalindromeSpan{}, msg.LongestPalindrome)
+	})
+
+	withAnalyzers(t, []string{}, func() {
+		assert.Equal(t, []string{}, EnabledAnalyzers())
+		assert.Nil(t, NewMsg("unicorn", "kayak").Properties)
+	})
+
+	enabled := EnabledAnalyzers()
+	err := EnableAnalyzers([]string{PalindromeAnalyzer, "potato"})
+	assert.Equal(t, ErrInvalidAnalyzer{Name: "potato"}, err)
+	assert.True(t, IsErrInvalidAnalyzer(err))
+	assert.Equal(t, enabled, EnabledAnalyzers())
+}
+
+func TestRegisterAnalyzer(t *testing.T) {
+	RestoreAnalyzers(t)
+	RegisterAnalyzer(NewAnalyzer("test-length", func(msg *Msg) interface{} {
+		return utf8.RuneCountInString(msg.Content)
+	}))
+	assert.Equal(t, "test-length", AnalyzerNames()[len(AnalyzerNames())-1])
+
+	withAnalyzers(t, []string{PalindromeAnalyzer, "test-length"}, func() {
+		msg := NewMsgWithProfile("unicorn", "ñandú", ProfileStrict)
+		assert.Equal(t, MsgProperties{PalindromeAnalyzer: false, "test-length": float64(5)}, msg.Properties)
+	})
+
+	assert.Panics(t, func() {
+		RegisterAnalyzer(NewAnalyzer(PalindromeAnalyzer, func(msg *Msg) interface{} { return nil }))
+	})
+	assert.Panics(t, func() {
+		RegisterAnalyzer(NewAnalyzer("", func(msg *Msg) interface{} { return nil }))
+	})
+}
+
+func TestRestoreAnalyzers(t *testing.T) {
+	names := AnalyzerNames()
+	t.Run("Register", func(t *testing.T) {
+		RestoreAnalyzers(t)
+		RegisterAnalyzer(NewAnalyzer("test-restore", func(msg *Msg) interface{} { return nil }))
+		assert.Nil(t, EnableAnalyzers([]string{"test-restore"}))
+		assert.Equal(t, MsgProperties{"test-restore": nil}, NewMsg("unicorn", "kayak").Properties)
+	})
+
+	// the analyzer registered by the subtest is gone, and the ones enabled are back
+	assert.Equal(t, names, AnalyzerNames())
+	assert.Equal(t, names, EnabledAnalyzers())
+}
+
+func TestMsgProperties_Encoding(t *testing.T) {
+	props := NewMsg("unicorn", "kayak").Properties
+
+	decoded, err := decodeMsgProperties(encodeMsgProperties(props))
+	assert.Nil(t, err)
+	assert.Equal(t, props, decoded)
+
+	decoded, err = decodeMsgProperties(encodeMsgProperties(nil))
+	assert.Nil(t, err)
+	assert.Nil(t, decoded)
+
+	_, err = decodeMsgProperties("{")
+	assert.NotNil(t, err)
+}
@@ -1,66 +1,535 @@
 package db
 
 import (
+	"context"
+	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
+)
+
+const (
+	DefaultSnapshotInterval = 5 * time.Minute
 )
 
 // BasicMsgDB stores messages in local memory in a thread safe map
+// its operations never block, so the ctx they take is only checked for cancellation before starting
+// it can optionally be made durable by a write ahead log, see NewDurableBasicMsgDB
 type BasicMsgDB struct {
-	msgs sync.Map
+	msgs      sync.Map
+	trash     sync.Map       // id -> *Msg with its DeletedAt set
+	revisions sync.Map       // id -> []*Revision, only appended to under writeMu, so readers can use the slices they load
+	index     invertedIndex  // of the msgs (not the trashed ones), kept up to date under writeMu
+	events    msgBroadcaster // published under writeMu, so they follow the order of the changes
+
+	// writeMu serializes the changes, so versions are checked atomically and the log (if any) follows their order
+	writeMu sync.Mutex
+
+	// only set when durable
+	log  *msgLog
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
 func NewBasicMsgDB() *BasicMsgDB {
 	return &BasicMsgDB{}
 }
 
+// NewDurableBasicMsgDB returns a BasicMsgDB that survives restarts and crashes: every change is appended to a
+// fsync'd write ahead log in walDir, which is compacted into a snapshot every snapshotInterval (only on Close if it's
+// not positive); the messages previously stored in walDir are recovered on startup
+func NewDurableBasicMsgDB(walDir string, snapshotInterval time.Duration) (*BasicMsgDB, error) {
+	msgLog, state, err := openMsgLog(walDir)
+	if err != nil {
+		log.Errorf("Failed to open write ahead log at dir: %s; err: %s", walDir, err.Error())
+		return nil, err
+	}
+
+	b := &BasicMsgDB{
+		log:  msgLog,
+		stop: make(chan struct{}),
+	}
+	for id, msg := range state.msgs {
+		b.msgs.Store(id, msg)
+		b.index.put(msg)
+	}
+	for id, msg := range state.trash {
+		b.trash.Store(id, msg)
+	}
+	for id, revisions := range state.revisions {
+		b.revisions.Store(id, revisions)
+	}
+
+	if snapshotInterval > 0 {
+		b.wg.Add(1)
+		go b.snapshotPeriodically(snapshotInterval)
+	}
+
+	return b, nil
+}
+
 func (b *BasicMsgDB) Close() {
-	//noop
+	b.events.close()
+	if b.log == nil {
+		return
+	}
+
+	close(b.stop)
+	b.wg.Wait()
+
+	// a final snapshot makes the next startup faster
+	b.snapshot()
+	err := b.log.close()
+	if err != nil {
+		log.Error("Failed to close write ahead log: ", err.Error())
+	}
 }
 
-func (b *BasicMsgDB) GetMsg(id string) (*Msg, error) {
-	msg, exists := b.msgs.Load(id)
+func (b *BasicMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	msg, exists := b.loadMsg(&b.msgs, id)
 	if !exists {
 		return nil, ErrMsgNotFound{}
 	}
 
-	return msg.(*Msg), nil
+	return msg, nil
 }
 
-func (b *BasicMsgDB) GetAllMsgs() ([]*Msg, error) {
-	var msgs []*Msg
+func (b *BasicMsgDB) GetAllMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+	if err := ctx.Err(); err != nil {
+		return msgs, err
+	}
+
+	now := time.Now()
 	b.msgs.Range(func(k, v interface{}) bool {
-		msgs = append(msgs, v.(*Msg))
+		if !v.(*Msg).expired(now) {
+			msgs = append(msgs, v.(*Msg))
+		}
 		return true
 	})
 
 	return msgs, nil
 }
 
-func (b *BasicMsgDB) CreateMsg(msg *Msg) error {
-	_, loaded := b.msgs.LoadOrStore(msg.Id, msg)
-	if loaded {
+func (b *BasicMsgDB) ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error {
+	var err error
+	b.msgs.Range(func(k, v interface{}) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		if v.(*Msg).expired(time.Now()) {
+			return true
+		}
+		err = fn(v.(*Msg))
+		return err == nil
+	})
+
+	return err
+}
+
+// ListMsgs filters and sorts all the messages in memory
+func (b *BasicMsgDB) ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error) {
+	msgs, err := b.GetAllMsgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginateMsgs(msgs, opts)
+}
+
+// SearchMsgs finds the msgs having every word of the query through the inverted index, and only checks those
+func (b *BasicMsgDB) SearchMsgs(ctx context.Context, q string, limit int) ([]*SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, ErrInvalidLimit{}
+	}
+	query, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*SearchResult{}
+	for _, id := range b.index.lookup(query.words()) {
+		// the msg may have changed or expired since the lookup
+		msg, exists := b.loadMsg(&b.msgs, id)
+		if !exists {
+			continue
+		}
+		if result := query.match(msg); result != nil {
+			results = append(results, result)
+		}
+	}
+
+	return rankResults(results, limit), nil
+}
+
+func (b *BasicMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return b.create(msg)
+}
+
+// create stores a copy of msg, the caller must hold writeMu
+func (b *BasicMsgDB) create(msg *Msg) error {
+	// writes are serialized, so nothing can be stored with the id in between the load and the store
+	if _, exists := b.loadMsg(&b.msgs, msg.Id); exists {
 		return ErrIdUnavailable{}
 	}
+
+	// a copy is stored so the caller can't modify it afterwards
+	stored := *msg
+	stored.Version = initialVersion
+	err := b.logChange(walRecord{Op: walOpCreate, Id: msg.Id, Msg: &stored})
+	if err != nil {
+		return err
+	}
+
+	// a trashed (or expired) msg with the same id is purged, the new one starts its own revisions
+	b.msgs.Store(msg.Id, &stored)
+	b.index.put(&stored)
+	b.events.publish(MsgCreated, &stored)
+	b.trash.Delete(msg.Id)
+	b.revisions.Store(msg.Id, []*Revision{newRevision(&stored)})
+	msg.Version = stored.Version
 	return nil
 }
 
-func (b *BasicMsgDB) UpdateMsg(newMsg *Msg) error {
-	msg, exists := b.msgs.Load(newMsg.Id)
+func (b *BasicMsgDB) UpdateMsg(ctx context.Context, newMsg *Msg) error {
+	return b.updateMsg(ctx, newMsg, anyVersion)
+}
+
+func (b *BasicMsgDB) UpdateMsgIfVersion(ctx context.Context, newMsg *Msg, version int64) error {
+	return b.updateMsg(ctx, newMsg, version)
+}
+
+func (b *BasicMsgDB) updateMsg(ctx context.Context, newMsg *Msg, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return b.update(newMsg, version)
+}
+
+// update replaces the stored msg by a copy of newMsg rather than modifying it, since GetMsg hands the stored msgs
+// out to readers that don't hold any lock; the caller must hold writeMu
+func (b *BasicMsgDB) update(newMsg *Msg, version int64) error {
+	msg, exists := b.loadMsg(&b.msgs, newMsg.Id)
 	if !exists {
 		return ErrMsgNotFound{}
 	}
+	err := checkVersion(msg.Version, version)
+	if err != nil {
+		return err
+	}
 
-	msg.(*Msg).Content = newMsg.Content
-	msg.(*Msg).IsPalindrome = newMsg.IsPalindrome
-	msg.(*Msg).ModTime = newMsg.ModTime
+	stored := *newMsg
+	stored.Version = msg.Version + 1
+	stored.ExpiresAt = msg.ExpiresAt
+	err = b.logChange(walRecord{Op: walOpPut, Id: newMsg.Id, Msg: &stored})
+	if err != nil {
+		return err
+	}
 
+	b.msgs.Store(newMsg.Id, &stored)
+	b.index.put(&stored)
+	b.events.publish(MsgUpdated, &stored)
+	b.appendRevision(&stored)
+	newMsg.Version = stored.Version
 	return nil
 }
 
-func (b *BasicMsgDB) DeleteMsg(id string) error {
-	_, loaded := b.msgs.LoadAndDelete(id)
-	if !loaded {
+func (b *BasicMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	return b.deleteMsg(ctx, id, anyVersion)
+}
+
+func (b *BasicMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	return b.deleteMsg(ctx, id, version)
+}
+
+func (b *BasicMsgDB) deleteMsg(ctx context.Context, id string, version int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return b.trashMsg(id, version)
+}
+
+// trashMsg moves the msg with the id provided to the trash, the caller must hold writeMu
+func (b *BasicMsgDB) trashMsg(id string, version int64) error {
+	msg, exists := b.loadMsg(&b.msgs, id)
+	if !exists {
+		return ErrMsgNotFound{}
+	}
+	err := checkVersion(msg.Version, version)
+	if err != nil {
+		return err
+	}
+
+	trashed := *msg
+	now := time.Now()
+	trashed.DeletedAt = &now
+	err = b.logChange(walRecord{Op: walOpTrash, Id: id, Msg: &trashed})
+	if err != nil {
+		return err
+	}
+
+	b.msgs.Delete(id)
+	b.index.delete(id)
+	b.trash.Store(id, &trashed)
+	b.events.publish(MsgDeleted, &trashed)
+	return nil
+}
+
+// ApplyBatch applies atomic batches under writeMu, once every op is checked to succeed; if the write ahead log fails
+// midway, the ops logged so far stay applied
+func (b *BasicMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	if !atomic {
+		return applyBatchOps(ctx, b, ops), nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	// writes are serialized, so the checks still hold when the ops are applied
+	_, failure := checkBatch(ops, func(id string) (*Msg, error) {
+		msg, _ := b.loadMsg(&b.msgs, id)
+		return msg, nil
+	})
+	if failure != nil {
+		return failure.results(len(ops)), nil
+	}
+
+	for _, op := range ops {
+		var err error
+		switch op.Type {
+		case BatchCreate:
+			err = b.create(op.Msg)
+		case BatchUpdate:
+			err = b.update(op.Msg, op.version())
+		default:
+			err = b.trashMsg(op.id(), op.version())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return make([]error, len(ops)), nil
+}
+
+func (b *BasicMsgDB) Watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	return b.events.watch(ctx, after)
+}
+
+func (b *BasicMsgDB) GetTrashedMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+	if err := ctx.Err(); err != nil {
+		return msgs, err
+	}
+
+	now := time.Now()
+	b.trash.Range(func(k, v interface{}) bool {
+		if !v.(*Msg).expired(now) {
+			msgs = append(msgs, v.(*Msg))
+		}
+		return true
+	})
+
+	return msgs, nil
+}
+
+func (b *BasicMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	msg, exists := b.loadMsg(&b.trash, id)
+	if !exists {
 		return ErrMsgNotFound{}
 	}
+
+	restored := *msg
+	restored.DeletedAt = nil
+	err := b.logChange(walRecord{Op: walOpRestore, Id: id, Msg: &restored})
+	if err != nil {
+		return err
+	}
+
+	b.trash.Delete(id)
+	b.msgs.Store(id, &restored)
+	b.index.put(&restored)
+	b.events.publish(MsgCreated, &restored)
 	return nil
 }
+
+func (b *BasicMsgDB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	var ids []string
+	b.trash.Range(func(k, v interface{}) bool {
+		if v.(*Msg).DeletedAt.Before(before) {
+			ids = append(ids, k.(string))
+		}
+		return true
+	})
+
+	for i, id := range ids {
+		err := b.logChange(walRecord{Op: walOpDelete, Id: id})
+		if err != nil {
+			return i, err
+		}
+		b.trash.Delete(id)
+		b.revisions.Delete(id)
+	}
+
+	return len(ids), nil
+}
+
+func (b *BasicMsgDB) GetRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, exists := b.loadMsg(&b.msgs, id); !exists {
+		return nil, ErrMsgNotFound{}
+	}
+	revisions, _ := b.revisions.Load(id)
+	result, _ := revisions.([]*Revision)
+
+	// a copy keeps the caller from appending to the stored slice
+	return append([]*Revision{}, result...), nil
+}
+
+func (b *BasicMsgDB) PurgeExpired(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	var ids []string
+	now := time.Now()
+	for _, msgs := range []*sync.Map{&b.msgs, &b.trash} {
+		msgs.Range(func(k, v interface{}) bool {
+			if v.(*Msg).expired(now) {
+				ids = append(ids, k.(string))
+			}
+			return true
+		})
+	}
+
+	for i, id := range ids {
+		err := b.logChange(walRecord{Op: walOpDelete, Id: id})
+		if err != nil {
+			return i, err
+		}
+		b.msgs.Delete(id)
+		b.index.delete(id)
+		b.trash.Delete(id)
+		b.revisions.Delete(id)
+	}
+
+	return len(ids), nil
+}
+
+func (b *BasicMsgDB) GetRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, err := b.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// loadMsg returns the msg stored in msgs (either b.msgs or b.trash) with the id provided, unless it expired
+func (b *BasicMsgDB) loadMsg(msgs *sync.Map, id string) (*Msg, bool) {
+	msg, exists := msgs.Load(id)
+	if !exists || msg.(*Msg).expired(time.Now()) {
+		return nil, false
+	}
+	return msg.(*Msg), true
+}
+
+// appendRevision records the revision of msg, the caller must hold writeMu
+func (b *BasicMsgDB) appendRevision(msg *Msg) {
+	revisions, _ := b.revisions.Load(msg.Id)
+	result, _ := revisions.([]*Revision)
+	b.revisions.Store(msg.Id, append(result, newRevision(msg)))
+}
+
+// logChange appends rec to the write ahead log, if any
+func (b *BasicMsgDB) logChange(rec walRecord) error {
+	if b.log == nil {
+		return nil
+	}
+
+	err := b.log.append(rec)
+	if err != nil {
+		log.Error("Failed to append to write ahead log: ", err.Error())
+	}
+	return err
+}
+
+func (b *BasicMsgDB) snapshotPeriodically(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.snapshot()
+		}
+	}
+}
+
+// snapshot compacts the write ahead log into a snapshot of the current messages
+func (b *BasicMsgDB) snapshot() {
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+
+	state := newMsgState()
+	b.msgs.Range(func(k, v interface{}) bool {
+		state.msgs[k.(string)] = v.(*Msg)
+		return true
+	})
+	b.trash.Range(func(k, v interface{}) bool {
+		state.trash[k.(string)] = v.(*Msg)
+		return true
+	})
+	b.revisions.Range(func(k, v interface{}) bool {
+		state.revisions[k.(string)] = v.([]*Revision)
+		return true
+	})
+	err := b.log.snapshot(state)
+	if err != nil {
+		log.Error("Failed to take snapshot: ", err.Error())
+		return
+	}
+	log.Debugf("Took a snapshot of %d messages", len(state.msgs))
+}
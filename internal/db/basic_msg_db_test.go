@@ -1,142 +1,175 @@
 package db
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-// todo: update the ids so that they are different in each test
-
 func TestNewBasicMsgDB(t *testing.T) {
 	db := NewBasicMsgDB()
 	assert.NotNil(t, db)
 }
 
-func TestBasicMsgDB_CreateGetMsg(t *testing.T) {
-	db := NewBasicMsgDB()
-
-	msg1 := NewMsg("unicorn", "kayak")
-	err := db.CreateMsg(msg1)
+func TestNewDurableBasicMsgDB_Recovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := NewDurableBasicMsgDB(dir, DefaultSnapshotInterval)
 	assert.Nil(t, err)
 
-	msg2 := NewMsg("1234", "message")
-	err = db.CreateMsg(msg2)
+	msg := NewMsg("unicorn", "kayak")
+	assert.Nil(t, db.CreateMsg(ctx, msg))
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("potato", "papa")))
+	assert.Nil(t, db.UpdateMsg(ctx, NewMsg("potato", "racecar")))
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("elephant", "they don't live in the forest")))
+	assert.Nil(t, db.DeleteMsg(ctx, "elephant"))
+
+	// simulate a crash: the process goes away without closing the db nor taking a snapshot
+	close(db.stop)
+	db.wg.Wait()
+	assert.Nil(t, db.log.close())
+
+	db, err = NewDurableBasicMsgDB(dir, DefaultSnapshotInterval)
 	assert.Nil(t, err)
+	defer db.Close()
 
-	retMsg1, err := db.GetMsg("unicorn")
+	msgs, err := db.GetAllMsgs(ctx)
 	assert.Nil(t, err)
-	assert.Equal(t, msg1.Id, retMsg1.Id)
-	assert.Equal(t, msg1.Content, retMsg1.Content)
-	assert.Equal(t, msg1.IsPalindrome, retMsg1.IsPalindrome)
-	assert.True(t, msg1.ModTime.Equal(retMsg1.ModTime))
+	assert.Equal(t, 2, len(msgs))
 
-	retMsg2, err := db.GetMsg("1234")
+	retMsg, err := db.GetMsg(ctx, "unicorn")
 	assert.Nil(t, err)
-	assert.Equal(t, msg2.Id, retMsg2.Id)
-	assert.Equal(t, msg2.Content, retMsg2.Content)
-	assert.Equal(t, msg2.IsPalindrome, retMsg2.IsPalindrome)
-	assert.True(t, msg2.ModTime.Equal(retMsg2.ModTime))
-}
+	assert.Equal(t, msg.Content, retMsg.Content)
+	assert.True(t, msg.ModTime.Equal(retMsg.ModTime))
 
-func TestBasicMsgDB_CreateMsg_ErrIdUnavailable(t *testing.T) {
-	db := NewBasicMsgDB()
+	retMsg, err = db.GetMsg(ctx, "potato")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", retMsg.Content)
+	assert.True(t, retMsg.IsPalindrome)
+	assert.Equal(t, int64(2), retMsg.Version)
 
-	msg1 := NewMsg("fly", "this is the message")
-	err := db.CreateMsg(msg1)
+	revisions, err := db.GetRevisions(ctx, "potato")
 	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	assert.Equal(t, "papa", revisions[0].Content)
 
-	msg2 := NewMsg("fly", "other message")
-	err = db.CreateMsg(msg2)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrIdUnavailable{}, err)
+	_, err = db.GetMsg(ctx, "elephant")
+	assert.IsType(t, ErrMsgNotFound{}, err)
 }
 
-func TestBasicMsgDB_GetMsg_ErrMsgNotFound(t *testing.T) {
-	db := NewBasicMsgDB()
-
-	msg, err := db.GetMsg("potato")
-	assert.Nil(t, msg)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
+func TestNewDurableBasicMsgDB_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := NewDurableBasicMsgDB(dir, time.Millisecond)
+	assert.Nil(t, err)
 
-	msg, err = db.GetMsg("1234")
-	assert.Nil(t, msg)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
-}
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
 
-func TestBasicMsgDB_GetAllMsgs(t *testing.T) {
-	db := NewBasicMsgDB()
+	// the periodic snapshot must end up compacting the log
+	assert.Eventually(t, func() bool {
+		info, err := os.Stat(filepath.Join(dir, snapshotFileName))
+		return err == nil && info.Size() > 0
+	}, time.Second, time.Millisecond)
+	db.Close()
 
-	msgs, err := db.GetAllMsgs()
-	assert.Equal(t, 0, len(msgs))
+	db, err = NewDurableBasicMsgDB(dir, DefaultSnapshotInterval)
+	assert.Nil(t, err)
+	defer db.Close()
 
-	msg1 := NewMsg("unicorn", "kayak")
-	err = db.CreateMsg(msg1)
+	retMsg, err := db.GetMsg(ctx, "unicorn")
 	assert.Nil(t, err)
+	assert.Equal(t, "kayak", retMsg.Content)
 
-	msgs, err = db.GetAllMsgs()
-	assert.Equal(t, 1, len(msgs))
+	revisions, err := db.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(revisions))
+}
 
-	msg2 := NewMsg("1234", "message")
-	err = db.CreateMsg(msg2)
+func TestNewDurableBasicMsgDB_NoPeriodicSnapshot(t *testing.T) {
+	// an interval that is not positive disables the periodic snapshots, the log is only compacted on Close
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := NewDurableBasicMsgDB(dir, 0)
 	assert.Nil(t, err)
 
-	msgs, err = db.GetAllMsgs()
-	assert.Equal(t, 2, len(msgs))
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	time.Sleep(10 * time.Millisecond)
+	info, err := os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.True(t, err != nil || info.Size() == 0)
+	db.Close()
 
-	for _, id := range []string{"unicorn", "1234"} {
-		idFound := false
-		for _, m := range msgs {
-			if id == m.Id {
-				idFound = true
-				break
-			}
-		}
-		assert.True(t, idFound)
+	info, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	if assert.Nil(t, err) {
+		assert.True(t, info.Size() > 0)
 	}
-}
 
-func TestBasicMsgDB_UpdateMsg(t *testing.T) {
-	db := NewBasicMsgDB()
+	db, err = NewDurableBasicMsgDB(dir, -time.Second)
+	assert.Nil(t, err)
+	defer db.Close()
+	retMsg, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "kayak", retMsg.Content)
+}
 
-	msg := NewMsg("unicorn", "kayak")
-	err := db.CreateMsg(msg)
+func TestNewDurableBasicMsgDB_Trash(t *testing.T) {
+	// the trash must be recovered from both the log and the snapshot
+	ctx := context.Background()
+	dir := t.TempDir()
+	db, err := NewDurableBasicMsgDB(dir, DefaultSnapshotInterval)
 	assert.Nil(t, err)
 
-	newMsg := NewMsg(msg.Id, "iAmGroot")
-	err = db.UpdateMsg(newMsg)
+	for _, id := range []string{"unicorn", "potato", "banana"} {
+		assert.Nil(t, db.CreateMsg(ctx, NewMsg(id, "kayak")))
+		assert.Nil(t, db.DeleteMsg(ctx, id))
+	}
+	db.snapshot()
+	assert.Nil(t, db.RestoreMsg(ctx, "unicorn"))
+	_, err = db.PurgeTrash(ctx, time.Now().Add(time.Second))
 	assert.Nil(t, err)
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("elephant", "racecar")))
+	assert.Nil(t, db.DeleteMsg(ctx, "elephant"))
 
-	retMsg, err := db.GetMsg(msg.Id)
+	// crash, so the changes after the snapshot are replayed from the log
+	close(db.stop)
+	db.wg.Wait()
+	assert.Nil(t, db.log.close())
+
+	db, err = NewDurableBasicMsgDB(dir, DefaultSnapshotInterval)
 	assert.Nil(t, err)
+	defer db.Close()
 
-	assert.Equal(t, newMsg.Content, retMsg.Content)
-	assert.Equal(t, newMsg.IsPalindrome, retMsg.IsPalindrome)
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	trashed, err := db.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trashed))
+	assert.Equal(t, "elephant", trashed[0].Id)
+	assert.NotNil(t, trashed[0].DeletedAt)
+	assert.IsType(t, ErrMsgNotFound{}, db.RestoreMsg(ctx, "potato"))
+	assert.Nil(t, db.RestoreMsg(ctx, "elephant"))
 }
 
-func TestBasicMsgDB_UpdateMsg_ErrMsgNotFound(t *testing.T) {
-	db := NewBasicMsgDB()
+func TestNewDurableBasicMsgDB_BadDir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(file, []byte("not a dir"), 0600))
 
-	newMsg := NewMsg("nonexistent", "iAmGroot")
-	err := db.UpdateMsg(newMsg)
+	db, err := NewDurableBasicMsgDB(file, DefaultSnapshotInterval)
+	assert.Nil(t, db)
 	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
 }
 
-func TestBasicMsgDB_DeleteMsg(t *testing.T) {
-	// delete, then delete again and make sure it returns ErrMsgNotFound
+func TestBasicMsgDB_CanceledContext(t *testing.T) {
 	db := NewBasicMsgDB()
 
-	msg := NewMsg("unicorn", "kayak")
-	err := db.CreateMsg(msg)
-	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
 
-	err = db.DeleteMsg(msg.Id)
-	assert.Nil(t, err)
+	err := db.CreateMsg(ctx, NewMsg("unicorn", "kayak"))
+	assert.Equal(t, context.Canceled, err)
 
-	// try to delete again now that it's deleted
-	err = db.DeleteMsg(msg.Id)
-	assert.NotNil(t, err)
+	_, err = db.GetMsg(context.Background(), "unicorn")
 	assert.IsType(t, ErrMsgNotFound{}, err)
 }
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"strconv"
+)
+
+type BatchOpType string
+
+const (
+	BatchCreate BatchOpType = "create"
+	BatchUpdate BatchOpType = "update"
+	BatchDelete BatchOpType = "delete"
+)
+
+// BatchOp is one of the operations of a batch: Msg is created or updated, or the msg with Id is deleted
+// IfVersion, if not 0, makes an update or deletion conditional, like UpdateMsgIfVersion and DeleteMsgIfVersion do
+type BatchOp struct {
+	Type      BatchOpType
+	Msg       *Msg   // only used by create and update
+	Id        string // only used by delete
+	IfVersion int64
+}
+
+// id returns the id of the msg op is about
+func (op *BatchOp) id() string {
+	if op.Type == BatchDelete {
+		return op.Id
+	}
+	return op.Msg.Id
+}
+
+// version returns the version op expects, anyVersion if unconditional
+func (op *BatchOp) version() int64 {
+	if op.IfVersion == 0 {
+		return anyVersion
+	}
+	return op.IfVersion
+}
+
+// validate returns ErrInvalidBatchOp if op has an unknown type or lacks what its type needs
+func (op *BatchOp) validate() error {
+	switch op.Type {
+	case BatchCreate, BatchUpdate:
+		if op.Msg == nil {
+			return ErrInvalidBatchOp{}
+		}
+	case BatchDelete:
+		if op.Id == "" {
+			return ErrInvalidBatchOp{}
+		}
+	default:
+		return ErrInvalidBatchOp{}
+	}
+	return nil
+}
+
+// applyBatchOp applies op through the single operation methods of msgDb
+func applyBatchOp(ctx context.Context, msgDb MsgDB, op *BatchOp) error {
+	err := op.validate()
+	if err != nil {
+		return err
+	}
+
+	switch op.Type {
+	case BatchCreate:
+		return msgDb.CreateMsg(ctx, op.Msg)
+	case BatchUpdate:
+		return msgDb.UpdateMsgIfVersion(ctx, op.Msg, op.version())
+	default:
+		return msgDb.DeleteMsgIfVersion(ctx, op.id(), op.version())
+	}
+}
+
+// applyBatchOps applies ops one at a time through the single operation methods of msgDb, which is how the dbs apply
+// the batches that are not atomic
+func applyBatchOps(ctx context.Context, msgDb MsgDB, ops []*BatchOp) []error {
+	results := make([]error, len(ops))
+	for i, op := range ops {
+		results[i] = applyBatchOp(ctx, msgDb, op)
+	}
+	return results
+}
+
+// batchFailure is the failure of the op at index of an atomic batch, the dbs return it from their transactions to roll
+// them back
+type batchFailure struct {
+	index int
+	err   error
+}
+
+func (f *batchFailure) Error() string {
+	return "batch operation " + strconv.Itoa(f.index) + " failed: " + f.err.Error()
+}
+
+// results returns the results of the n ops of the batch that was rolled back: every op was aborted but the failed one
+func (f *batchFailure) results(n int) []error {
+	results := make([]error, n)
+	for i := range results {
+		results[i] = ErrBatchAborted{}
+	}
+	results[f.index] = f.err
+	return results
+}
+
+// runBatch calls apply on every op in order, until one fails, returning the msg each op left stored (in the trash for
+// the deletions)
+func runBatch(ops []*BatchOp, apply func(op *BatchOp) (*Msg, error)) ([]*Msg, *batchFailure) {
+	stored := make([]*Msg, len(ops))
+	for i, op := range ops {
+		err := op.validate()
+		if err == nil {
+			stored[i], err = apply(op)
+		}
+		if err != nil {
+			return nil, &batchFailure{index: i, err: err}
+		}
+	}
+	return stored, nil
+}
+
+// checkBatch checks that every op would succeed if applied in order, without applying any; load must return the msg
+// stored with an id, nil if there's none. Returns the msg each op would leave stored, the deleted ones as they were
+// before the deletion (the db sets when they were deleted)
+func checkBatch(ops []*BatchOp, load func(id string) (*Msg, error)) ([]*Msg, *batchFailure) {
+	// the msgs as left by the ops checked so far, nil if deleted
+	staged := map[string]*Msg{}
+
+	return runBatch(ops, func(op *BatchOp) (*Msg, error) {
+		id := op.id()
+		current, ok := staged[id]
+		if !ok {
+			var err error
+			current, err = load(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if op.Type == BatchCreate {
+			if current != nil {
+				return nil, ErrIdUnavailable{}
+			}
+			stored := *op.Msg
+			stored.Version = initialVersion
+			staged[id] = &stored
+			return &stored, nil
+		}
+		if current == nil {
+			return nil, ErrMsgNotFound{}
+		}
+		err := checkVersion(current.Version, op.version())
+		if err != nil {
+			return nil, err
+		}
+		if op.Type == BatchUpdate {
+			stored := *op.Msg
+			stored.Version = current.Version + 1
+			stored.ExpiresAt = current.ExpiresAt
+			staged[id] = &stored
+			return &stored, nil
+		}
+		staged[id] = nil
+		trashed := *current
+		return &trashed, nil
+	})
+}
+
+// setBatchVersions sets the versions an applied batch left the msgs of its ops at, like CreateMsg and UpdateMsg do
+func setBatchVersions(ops []*BatchOp, stored []*Msg) {
+	for i, op := range ops {
+		if op.Type != BatchDelete {
+			op.Msg.Version = stored[i].Version
+		}
+	}
+}
@@ -0,0 +1,684 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	DefaultBoltPath     = "palermo.db"
+	defaultBoltOpenTime = 5 * time.Second
+)
+
+var (
+	boltMsgBucket = []byte("msgs")
+	// boltRevisionBucket holds a nested bucket per msg id, where its revisions are keyed by their big endian version
+	boltRevisionBucket = []byte("revisions")
+	boltTrashBucket    = []byte("trash")
+)
+
+// BoltMsgDB stores the messages in an embedded bbolt file, so they persist across restarts
+// messages are stored json encoded in a single bucket and keyed by their id, their revisions and the trash in others
+// transactions can't be interrupted, so the ctx its operations take is checked before starting and while scanning
+// the buckets, the ones that don't finish in time are rolled back
+type BoltMsgDB struct {
+	db        *bolt.DB
+	events    msgBroadcaster // published once the changes are committed
+	opTimeout time.Duration  // bounds every operation on top of the ctx it takes, 0 means no bound
+}
+
+// NewBoltMsgDB opens (or creates) the bolt file at the path provided
+// the file is locked while open, so only one process can use it at a time
+// opTimeout is the max time a single operation can take, default value to use is DefaultOpTimeout
+func NewBoltMsgDB(path string, opTimeout time.Duration) (*BoltMsgDB, error) {
+	boltDb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: defaultBoltOpenTime})
+	if err != nil {
+		log.Errorf("Failed to open bolt db at path: %s; err: %s", path, err.Error())
+		return nil, err
+	}
+
+	err = boltDb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMsgBucket, boltRevisionBucket, boltTrashBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to create msg buckets: ", err.Error())
+		_ = boltDb.Close()
+		return nil, err
+	}
+	log.Debug("Successfully opened bolt db at: ", path)
+
+	return &BoltMsgDB{db: boltDb, opTimeout: opTimeout}, nil
+}
+
+func (b *BoltMsgDB) Close() {
+	b.events.close()
+	err := b.db.Close()
+	if err != nil {
+		log.Error("Failed to close bolt db: ", err.Error())
+	}
+}
+
+func (b *BoltMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var msg *Msg
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		msg, err = getBoltMsg(tx.Bucket(boltMsgBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (b *BoltMsgDB) GetAllMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return msgs, err
+	}
+
+	now := time.Now()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMsgBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			msg := &Msg{}
+			err := json.Unmarshal(v, msg)
+			if err != nil {
+				return err
+			}
+			if !msg.expired(now) {
+				msgs = append(msgs, msg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("Failed to read all messages: ", err.Error())
+		return msgs, err
+	}
+
+	return msgs, nil
+}
+
+// ForEachMsg reads the messages in batches, each in its own transaction, so that fn doesn't keep a read transaction
+// open (which would keep the file from growing) while it runs
+func (b *BoltMsgDB) ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error {
+	var after []byte
+	for {
+		var batch []*Msg
+		more := false
+		// each batch is bounded on its own, like a single operation
+		batchCtx, cancel := opContext(ctx, b.opTimeout)
+		err := batchCtx.Err()
+		if err != nil {
+			cancel()
+			return err
+		}
+		err = b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltMsgBucket).Cursor()
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if k != nil && string(k) == string(after) {
+					k, v = c.Next()
+				}
+			}
+			// expired msgs are skipped, so a batch may hold less msgs than the keys it read
+			read := 0
+			for ; k != nil && read < iterBatchSize; k, v = c.Next() {
+				if err := batchCtx.Err(); err != nil {
+					return err
+				}
+				read++
+				msg := &Msg{}
+				err := json.Unmarshal(v, msg)
+				if err != nil {
+					return err
+				}
+				if !msg.expired(time.Now()) {
+					batch = append(batch, msg)
+				}
+				after = append(after[:0], k...)
+			}
+			more = k != nil
+			return nil
+		})
+		cancel()
+		if err != nil {
+			log.Error("Failed to read messages: ", err.Error())
+			return err
+		}
+
+		for _, msg := range batch {
+			err = fn(msg)
+			if err != nil {
+				return err
+			}
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// ListMsgs filters and sorts all the messages in memory, since bolt keeps them sorted by id only
+func (b *BoltMsgDB) ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error) {
+	msgs, err := b.GetAllMsgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return paginateMsgs(msgs, opts)
+}
+
+// SearchMsgs checks every msg, there is no index to search with
+func (b *BoltMsgDB) SearchMsgs(ctx context.Context, query string, limit int) ([]*SearchResult, error) {
+	return searchAllMsgs(ctx, b, query, limit)
+}
+
+func (b *BoltMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var stored *Msg
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = createBoltMsg(tx, msg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	b.events.publish(MsgCreated, stored)
+	return nil
+}
+
+func (b *BoltMsgDB) UpdateMsg(ctx context.Context, msg *Msg) error {
+	return b.updateMsg(ctx, msg, anyVersion)
+}
+
+func (b *BoltMsgDB) UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error {
+	return b.updateMsg(ctx, msg, version)
+}
+
+func (b *BoltMsgDB) updateMsg(ctx context.Context, msg *Msg, version int64) error {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var stored *Msg
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = updateBoltMsg(tx, msg, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	b.events.publish(MsgUpdated, stored)
+	return nil
+}
+
+func (b *BoltMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	return b.deleteMsg(ctx, id, anyVersion)
+}
+
+func (b *BoltMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	return b.deleteMsg(ctx, id, version)
+}
+
+func (b *BoltMsgDB) deleteMsg(ctx context.Context, id string, version int64) error {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var trashed *Msg
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		trashed, err = trashBoltMsg(tx, id, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b.events.publish(MsgDeleted, trashed)
+	return nil
+}
+
+// ApplyBatch applies atomic batches in a single transaction
+func (b *BoltMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	if !atomic {
+		return applyBatchOps(ctx, b, ops), nil
+	}
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var stored []*Msg
+	var failure *batchFailure
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		stored, failure = runBatch(ops, func(op *BatchOp) (*Msg, error) {
+			switch op.Type {
+			case BatchCreate:
+				return createBoltMsg(tx, op.Msg)
+			case BatchUpdate:
+				return updateBoltMsg(tx, op.Msg, op.version())
+			default:
+				return trashBoltMsg(tx, op.id(), op.version())
+			}
+		})
+		if failure != nil {
+			return failure
+		}
+		return nil
+	})
+	if failure != nil {
+		return failure.results(len(ops)), nil
+	}
+	if err != nil {
+		log.Error("Failed to apply batch: ", err.Error())
+		return nil, err
+	}
+
+	setBatchVersions(ops, stored)
+	b.events.publishBatch(ops, stored)
+	return make([]error, len(ops)), nil
+}
+
+func (b *BoltMsgDB) Watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	return b.events.watch(ctx, after)
+}
+
+func (b *BoltMsgDB) GetTrashedMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return msgs, err
+	}
+
+	now := time.Now()
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTrashBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			msg := &Msg{}
+			err := json.Unmarshal(v, msg)
+			if err != nil {
+				return err
+			}
+			if !msg.expired(now) {
+				msgs = append(msgs, msg)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("Failed to read trashed messages: ", err.Error())
+		return msgs, err
+	}
+
+	return msgs, nil
+}
+
+func (b *BoltMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var restored *Msg
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		trash := tx.Bucket(boltTrashBucket)
+		msg, err := getBoltMsg(trash, id)
+		if err != nil {
+			return err
+		}
+		err = trash.Delete([]byte(id))
+		if err != nil {
+			return err
+		}
+
+		msg.DeletedAt = nil
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		restored = msg
+		return tx.Bucket(boltMsgBucket).Put([]byte(id), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.events.publish(MsgCreated, restored)
+	return nil
+}
+
+func (b *BoltMsgDB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		// keys can't be deleted while iterating, so the ones to purge are collected first
+		var ids []string
+		err := tx.Bucket(boltTrashBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			msg := &Msg{}
+			err := json.Unmarshal(v, msg)
+			if err != nil {
+				return err
+			}
+			if msg.DeletedAt != nil && msg.DeletedAt.Before(before) {
+				ids = append(ids, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			err = purgeBoltMsg(tx, id)
+			if err != nil {
+				return err
+			}
+		}
+		purged = len(ids)
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to purge trash: ", err.Error())
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+func (b *BoltMsgDB) GetRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	revisions := []*Revision{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		_, err := getBoltMsg(tx.Bucket(boltMsgBucket), id)
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket(boltRevisionBucket).Bucket([]byte(id))
+		if bucket == nil {
+			return nil
+		}
+		// keys are big endian versions, so they are iterated oldest first
+		return bucket.ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rev := &Revision{}
+			err := json.Unmarshal(v, rev)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, rev)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (b *BoltMsgDB) PurgeExpired(ctx context.Context) (int, error) {
+	ctx, cancel := opContext(ctx, b.opTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	now := time.Now()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMsgBucket, boltTrashBucket} {
+			// keys can't be deleted while iterating, so the ones to purge are collected first
+			var ids []string
+			bucket := tx.Bucket(name)
+			err := bucket.ForEach(func(k, v []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				msg := &Msg{}
+				err := json.Unmarshal(v, msg)
+				if err != nil {
+					return err
+				}
+				if msg.expired(now) {
+					ids = append(ids, string(k))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				err = bucket.Delete([]byte(id))
+				if err != nil {
+					return err
+				}
+				err = tx.Bucket(boltRevisionBucket).DeleteBucket([]byte(id))
+				if err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			purged += len(ids)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to purge expired msgs: ", err.Error())
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+func (b *BoltMsgDB) GetRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, err := b.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// createBoltMsg stores a copy of msg in tx, returns the msg as it was stored
+func createBoltMsg(tx *bolt.Tx, msg *Msg) (*Msg, error) {
+	bucket := tx.Bucket(boltMsgBucket)
+	_, err := getBoltMsg(bucket, msg.Id)
+	if err == nil {
+		return nil, ErrIdUnavailable{}
+	}
+	if !IsErrMsgNotFound(err) {
+		return nil, err
+	}
+
+	stored := *msg
+	stored.Version = initialVersion
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+	err = bucket.Put([]byte(msg.Id), data)
+	if err != nil {
+		return nil, err
+	}
+
+	// a trashed (or expired) msg with the same id is purged, the new one starts its own revisions
+	err = purgeBoltMsg(tx, msg.Id)
+	if err != nil {
+		return nil, err
+	}
+	err = putBoltRevision(tx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// updateBoltMsg replaces the msg stored in tx with the id of msg, if it has the version provided (unless anyVersion)
+// returns the msg as it was stored
+func updateBoltMsg(tx *bolt.Tx, msg *Msg, version int64) (*Msg, error) {
+	bucket := tx.Bucket(boltMsgBucket)
+	current, err := getBoltMsg(bucket, msg.Id)
+	if err != nil {
+		return nil, err
+	}
+	err = checkVersion(current.Version, version)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *msg
+	stored.Version = current.Version + 1
+	stored.ExpiresAt = current.ExpiresAt
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+	err = bucket.Put([]byte(msg.Id), data)
+	if err != nil {
+		return nil, err
+	}
+	err = putBoltRevision(tx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// trashBoltMsg moves the msg stored in tx with the id provided to the trash, if it has the version provided (unless
+// anyVersion), returns the msg as it was trashed
+func trashBoltMsg(tx *bolt.Tx, id string, version int64) (*Msg, error) {
+	bucket := tx.Bucket(boltMsgBucket)
+	current, err := getBoltMsg(bucket, id)
+	if err != nil {
+		return nil, err
+	}
+	err = checkVersion(current.Version, version)
+	if err != nil {
+		return nil, err
+	}
+	err = bucket.Delete([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	current.DeletedAt = &now
+	data, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Bucket(boltTrashBucket).Put([]byte(id), data)
+	if err != nil {
+		return nil, err
+	}
+	return current, nil
+}
+
+// purgeBoltMsg permanently deletes the trashed msg with the id provided (if any) and the revisions of the id
+func purgeBoltMsg(tx *bolt.Tx, id string) error {
+	err := tx.Bucket(boltTrashBucket).Delete([]byte(id))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(boltRevisionBucket).DeleteBucket([]byte(id))
+	if err == bolt.ErrBucketNotFound {
+		// stored before revisions were introduced
+		return nil
+	}
+	return err
+}
+
+// putBoltRevision records the revision of msg in tx
+func putBoltRevision(tx *bolt.Tx, msg *Msg) error {
+	bucket, err := tx.Bucket(boltRevisionBucket).CreateBucketIfNotExists([]byte(msg.Id))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(newRevision(msg))
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(msg.Version))
+	return bucket.Put(key, data)
+}
+
+// getBoltMsg decodes the msg stored in bucket with the id provided
+// returns ErrMsgNotFound if there's none, or if it expired
+func getBoltMsg(bucket *bolt.Bucket, id string) (*Msg, error) {
+	data := bucket.Get([]byte(id))
+	if data == nil {
+		return nil, ErrMsgNotFound{}
+	}
+
+	msg := &Msg{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.expired(time.Now()) {
+		return nil, ErrMsgNotFound{}
+	}
+	return msg, nil
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBoltMsgDB(t *testing.T) *BoltMsgDB {
+	db, err := NewBoltMsgDB(filepath.Join(t.TempDir(), "test.db"), DefaultOpTimeout)
+	assert.Nil(t, err)
+	return db
+}
+
+func TestNewBoltMsgDB(t *testing.T) {
+	db := newTestBoltMsgDB(t)
+	defer db.Close()
+
+	assert.NotNil(t, db.db)
+}
+
+func TestNewBoltMsgDB_BadPath(t *testing.T) {
+	db, err := NewBoltMsgDB(filepath.Join(t.TempDir(), "nonexistent", "test.db"), DefaultOpTimeout)
+	assert.Nil(t, db)
+	assert.NotNil(t, err)
+}
+
+func TestBoltMsgDB_Persistence(t *testing.T) {
+	// messages must still be there after closing and reopening the file
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewBoltMsgDB(path, DefaultOpTimeout)
+	assert.Nil(t, err)
+
+	msg := NewMsg("elephant", "never forgets")
+	err = db.CreateMsg(ctx, msg)
+	assert.Nil(t, err)
+	db.Close()
+
+	db, err = NewBoltMsgDB(path, DefaultOpTimeout)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	retMsg, err := db.GetMsg(ctx, "elephant")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Content, retMsg.Content)
+	assert.True(t, msg.ModTime.Equal(retMsg.ModTime))
+}
+
+func TestBoltMsgDB_OpTimeout(t *testing.T) {
+	// the operations that can't finish within the op timeout are canceled
+	db, err := NewBoltMsgDB(filepath.Join(t.TempDir(), "test.db"), time.Nanosecond)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	err = db.CreateMsg(context.Background(), NewMsg("elephant", "never forgets"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = db.GetAllMsgs(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	err = db.ForEachMsg(context.Background(), func(msg *Msg) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCacheTTL = time.Minute
+)
+
+// CachedMsgDB wraps a MsgDB with a bounded LRU cache of the msgs read by GetMsg, so hot msgs don't hit the wrapped
+// db on every read. The changes made through it invalidate the msgs they touch, every method other than GetMsg is
+// delegated as is. The cache is local: changes made to the wrapped db by other processes are only seen once the
+// cached msgs reach their ttl
+type CachedMsgDB struct {
+	// first, so they're 64-bit aligned for the atomic operations
+	hits   uint64
+	misses uint64
+
+	MsgDB
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // id -> element of lru holding its *cacheEntry
+	lru     *list.List               // most recently used first
+	// gen is increased by every invalidation, a msg read from the wrapped db is only cached if gen didn't change
+	// meanwhile, otherwise it could be older than the change that invalidated it
+	gen uint64
+}
+
+type cacheEntry struct {
+	msg      *Msg
+	cachedAt time.Time
+}
+
+// CacheStats are the counters of the reads served by a CachedMsgDB
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// NewCachedMsgDB returns msgDb cached by an LRU of at most size msgs, which are kept for at most ttl
+// a ttl <= 0 keeps them until they're evicted or invalidated
+func NewCachedMsgDB(msgDb MsgDB, size int, ttl time.Duration) *CachedMsgDB {
+	return &CachedMsgDB{
+		MsgDB:   msgDb,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns how many GetMsg calls were served by the cache (hits) and by the wrapped db (misses)
+func (c *CachedMsgDB) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// GetMsg returns a copy of the cached msg if any, otherwise it reads it from the wrapped db and caches it
+// ErrMsgNotFound isn't cached, so a msg created elsewhere is seen right away
+func (c *CachedMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
+	if msg, ok := c.get(id); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return msg, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+
+	msg, err := c.MsgDB.GetMsg(ctx, id)
+	if err != nil {
+		return msg, err
+	}
+	c.put(msg, gen)
+
+	cp := *msg
+	return &cp, nil
+}
+
+func (c *CachedMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	// the id may still be cached from a msg that expired or was deleted elsewhere
+	defer c.invalidate(msg.Id)
+	return c.MsgDB.CreateMsg(ctx, msg)
+}
+
+func (c *CachedMsgDB) UpdateMsg(ctx context.Context, msg *Msg) error {
+	defer c.invalidate(msg.Id)
+	return c.MsgDB.UpdateMsg(ctx, msg)
+}
+
+func (c *CachedMsgDB) UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error {
+	defer c.invalidate(msg.Id)
+	return c.MsgDB.UpdateMsgIfVersion(ctx, msg, version)
+}
+
+func (c *CachedMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	defer c.invalidate(id)
+	return c.MsgDB.DeleteMsg(ctx, id)
+}
+
+func (c *CachedMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	defer c.invalidate(id)
+	return c.MsgDB.DeleteMsgIfVersion(ctx, id, version)
+}
+
+func (c *CachedMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	defer c.invalidate(id)
+	return c.MsgDB.RestoreMsg(ctx, id)
+}
+
+func (c *CachedMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	defer func() {
+		for _, op := range ops {
+			if op.validate() == nil {
+				c.invalidate(op.id())
+			}
+		}
+	}()
+	return c.MsgDB.ApplyBatch(ctx, ops, atomic)
+}
+
+// Close logs the stats of the cache and closes the wrapped db
+func (c *CachedMsgDB) Close() {
+	stats := c.Stats()
+	log.Infof("Closing msg cache, hits: %d, misses: %d", stats.Hits, stats.Misses)
+	c.MsgDB.Close()
+}
+
+// get returns a copy of the msg cached with the id provided, unless it's missing or stale
+func (c *CachedMsgDB) get(id string) (*Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if entry.msg.expired(now) || (c.ttl > 0 && now.Sub(entry.cachedAt) >= c.ttl) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+
+	msg := *entry.msg
+	return &msg, true
+}
+
+// put caches msg as the most recently used, evicting the least recently used msg if full
+// nothing is cached if an invalidation happened after gen was read
+func (c *CachedMsgDB) put(msg *Msg, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+	cp := *msg
+	entry := &cacheEntry{msg: &cp, cachedAt: time.Now()}
+	if elem, ok := c.entries[msg.Id]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[msg.Id] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes the msg with the id provided from the cache, and keeps the ongoing reads from caching it
+func (c *CachedMsgDB) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if elem, ok := c.entries[id]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove must be called with mu held
+func (c *CachedMsgDB) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).msg.Id)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCachedMsgDB_HitsMisses(t *testing.T) {
+	ctx := context.Background()
+	db := NewCachedMsgDB(NewBasicMsgDB(), 10, DefaultCacheTTL)
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+
+	for i := 0; i < 3; i++ {
+		msg, err := db.GetMsg(ctx, "unicorn")
+		assert.Nil(t, err)
+		assert.Equal(t, "kayak", msg.Content)
+	}
+	_, err := db.GetMsg(ctx, "potato")
+	assert.IsType(t, ErrMsgNotFound{}, err)
+
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2}, db.Stats())
+
+	// the msgs returned are copies, changing them must not change the cache
+	msg, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	msg.Content = "changed"
+	msg, err = db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "kayak", msg.Content)
+}
+
+func TestCachedMsgDB_Invalidation(t *testing.T) {
+	ctx := context.Background()
+	db := NewCachedMsgDB(NewBasicMsgDB(), 10, DefaultCacheTTL)
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	_, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.UpdateMsg(ctx, NewMsg("unicorn", "racecar")))
+	msg, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", msg.Content)
+	assert.Equal(t, int64(2), msg.Version)
+
+	assert.Nil(t, db.UpdateMsgIfVersion(ctx, NewMsg("unicorn", "canoe"), 2))
+	msg, err = db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "canoe", msg.Content)
+
+	assert.Nil(t, db.DeleteMsg(ctx, "unicorn"))
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.IsType(t, ErrMsgNotFound{}, err)
+
+	assert.Nil(t, db.RestoreMsg(ctx, "unicorn"))
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Nil(t, db.DeleteMsgIfVersion(ctx, "unicorn", 3))
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.IsType(t, ErrMsgNotFound{}, err)
+}
+
+func TestCachedMsgDB_Eviction(t *testing.T) {
+	// the least recently used msg is evicted when the cache is full
+	ctx := context.Background()
+	db := NewCachedMsgDB(NewBasicMsgDB(), 2, DefaultCacheTTL)
+	for _, id := range []string{"unicorn", "potato", "banana"} {
+		assert.Nil(t, db.CreateMsg(ctx, NewMsg(id, "kayak")))
+	}
+
+	for _, id := range []string{"unicorn", "potato", "unicorn", "banana"} {
+		_, err := db.GetMsg(ctx, id)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, db.lru.Len())
+	_, cached := db.entries["potato"]
+	assert.False(t, cached)
+
+	_, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 3}, db.Stats())
+}
+
+func TestCachedMsgDB_TTL(t *testing.T) {
+	// changes made to the wrapped db directly are seen once the cached msg reaches its ttl
+	ctx := context.Background()
+	basic := NewBasicMsgDB()
+	db := NewCachedMsgDB(basic, 10, 20*time.Millisecond)
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	_, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+
+	assert.Nil(t, basic.UpdateMsg(ctx, NewMsg("unicorn", "racecar")))
+	msg, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "kayak", msg.Content)
+
+	time.Sleep(30 * time.Millisecond)
+	msg, err = db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", msg.Content)
+}
+
+func TestCachedMsgDB_Expired(t *testing.T) {
+	// a cached msg is gone as soon as it expires
+	ctx := context.Background()
+	db := NewCachedMsgDB(NewBasicMsgDB(), 10, DefaultCacheTTL)
+	assert.Nil(t, db.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", time.Now().Add(20*time.Millisecond))))
+	_, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+
+	time.Sleep(30 * time.Millisecond)
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.IsType(t, ErrMsgNotFound{}, err)
+}
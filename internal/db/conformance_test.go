@@ -0,0 +1,72 @@
+package db_test
+
+import (
+	"github.com/uritrejo/palermo/internal/db"
+	"github.com/uritrejo/palermo/internal/db/dbtest"
+	"testing"
+)
+
+func TestBasicMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		return db.NewBasicMsgDB()
+	})
+}
+
+func TestDurableBasicMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		msgDb, err := db.NewDurableBasicMsgDB(t.TempDir(), db.DefaultSnapshotInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(msgDb.Close)
+		return msgDb
+	})
+}
+
+func TestBoltMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		msgDb := db.NewTestBoltMsgDB(t)
+		t.Cleanup(msgDb.Close)
+		return msgDb
+	})
+}
+
+func TestSQLiteMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		msgDb := db.NewTestSQLiteMsgDB(t)
+		t.Cleanup(msgDb.Close)
+		return msgDb
+	})
+}
+
+func TestRedisMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		msgDb := db.NewTestRedisMsgDB(t)
+		t.Cleanup(msgDb.Close)
+		return msgDb
+	})
+}
+
+func TestPostgresMsgDB(t *testing.T) {
+	if !db.RunPostgresTests() {
+		t.Skip("Postgres tests are disabled")
+	}
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		return db.NewTestPostgresMsgDB(t)
+	})
+}
+
+func TestMongoMsgDB(t *testing.T) {
+	if !db.RunMongoDBTests() {
+		t.Skip("MongoDB tests are disabled")
+	}
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		return db.NewTestMongoMsgDB(t)
+	})
+}
+
+func TestCachedMsgDB(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.MsgDB {
+		return db.NewCachedMsgDB(db.NewBasicMsgDB(), 100, db.DefaultCacheTTL)
+	})
+}
@@ -0,0 +1,130 @@
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"testing"
+)
+
+// testBatch checks that every op of a batch that isn't atomic is applied in order, whether the others fail or not
+func testBatch(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+
+	unicorn := db.NewMsg("unicorn", "kayak")
+	update := db.NewMsg("unicorn", "racecar")
+	ops := []*db.BatchOp{
+		{Type: db.BatchCreate, Msg: unicorn},
+		{Type: db.BatchCreate, Msg: db.NewMsg("potato", "papa")},
+		{Type: db.BatchCreate, Msg: db.NewMsg("unicorn", "canoe")},
+		{Type: db.BatchUpdate, Msg: update},
+		{Type: db.BatchUpdate, Msg: db.NewMsg("elephant", "trunk")},
+		{Type: db.BatchDelete, Id: "banana", IfVersion: 5},
+		{Type: db.BatchDelete, Id: "banana", IfVersion: 1},
+		{Type: "potato", Id: "banana"},
+		{Type: db.BatchCreate},
+	}
+	results, err := msgDb.ApplyBatch(ctx, ops, false)
+	assert.Nil(t, err)
+	if !assert.Equal(t, len(ops), len(results)) {
+		return
+	}
+	assert.Nil(t, results[0])
+	assert.Nil(t, results[1])
+	assert.IsType(t, db.ErrIdUnavailable{}, results[2])
+	assert.Nil(t, results[3])
+	assert.IsType(t, db.ErrMsgNotFound{}, results[4])
+	assert.IsType(t, db.ErrVersionConflict{}, results[5])
+	assert.Nil(t, results[6])
+	assert.IsType(t, db.ErrInvalidBatchOp{}, results[7])
+	assert.IsType(t, db.ErrInvalidBatchOp{}, results[8])
+
+	assert.Equal(t, int64(1), unicorn.Version)
+	assert.Equal(t, int64(2), update.Version)
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", retMsg.Content)
+	revisions, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	_, err = msgDb.GetMsg(ctx, "potato")
+	assert.Nil(t, err)
+	_, err = msgDb.GetMsg(ctx, "banana")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	results, err = msgDb.ApplyBatch(ctx, nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+// testAtomicBatch checks that either every op of an atomic batch is applied or none is
+func testAtomicBatch(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+
+	// the update fails on the version left by the previous op, so nothing is applied
+	ops := []*db.BatchOp{
+		{Type: db.BatchCreate, Msg: db.NewMsg("unicorn", "kayak")},
+		{Type: db.BatchUpdate, Msg: db.NewMsg("banana", "racecar"), IfVersion: 1},
+		{Type: db.BatchUpdate, Msg: db.NewMsg("banana", "canoe"), IfVersion: 1},
+		{Type: db.BatchDelete, Id: "banana"},
+	}
+	results, err := msgDb.ApplyBatch(ctx, ops, true)
+	assert.Nil(t, err)
+	if assert.Equal(t, len(ops), len(results)) {
+		assert.IsType(t, db.ErrBatchAborted{}, results[0])
+		assert.IsType(t, db.ErrBatchAborted{}, results[1])
+		assert.IsType(t, db.ErrVersionConflict{}, results[2])
+		assert.IsType(t, db.ErrBatchAborted{}, results[3])
+	}
+	_, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	retMsg, err := msgDb.GetMsg(ctx, "banana")
+	assert.Nil(t, err)
+	assert.Equal(t, "anana", retMsg.Content)
+	assert.Equal(t, int64(1), retMsg.Version)
+
+	// an invalid op aborts the batch too
+	results, err = msgDb.ApplyBatch(ctx, []*db.BatchOp{
+		{Type: db.BatchCreate, Msg: db.NewMsg("unicorn", "kayak")},
+		{Type: db.BatchDelete},
+	}, true)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(results)) {
+		assert.IsType(t, db.ErrBatchAborted{}, results[0])
+		assert.IsType(t, db.ErrInvalidBatchOp{}, results[1])
+	}
+	_, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	// the ops see the changes of the previous ones
+	unicorn := db.NewMsg("unicorn", "kayak")
+	update := db.NewMsg("unicorn", "racecar")
+	ops = []*db.BatchOp{
+		{Type: db.BatchCreate, Msg: unicorn},
+		{Type: db.BatchUpdate, Msg: update, IfVersion: 1},
+		{Type: db.BatchDelete, Id: "banana", IfVersion: 1},
+		{Type: db.BatchCreate, Msg: db.NewMsg("banana", "level")},
+	}
+	results, err = msgDb.ApplyBatch(ctx, ops, true)
+	assert.Nil(t, err)
+	assert.Equal(t, make([]error, len(ops)), results)
+	assert.Equal(t, int64(1), unicorn.Version)
+	assert.Equal(t, int64(2), update.Version)
+
+	retMsg, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", retMsg.Content)
+	assert.Equal(t, int64(2), retMsg.Version)
+	revisions, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	retMsg, err = msgDb.GetMsg(ctx, "banana")
+	assert.Nil(t, err)
+	assert.Equal(t, "level", retMsg.Content)
+	assert.Equal(t, int64(1), retMsg.Version)
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(trashed))
+}
@@ -0,0 +1,299 @@
+// Package dbtest provides the conformance suite every db.MsgDB implementation must pass
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"sync"
+	"testing"
+	"time"
+)
+
+// modTimePrecision is the coarsest precision a db stores the mod times with (mongo stores milliseconds)
+const modTimePrecision = time.Millisecond
+
+// NewMsgDBFunc returns an empty MsgDB for the test provided, which it must release (e.g. with t.Cleanup)
+type NewMsgDBFunc func(t *testing.T) db.MsgDB
+
+// Run runs the whole suite against the MsgDB implementation returned by newDB, each test on a fresh db
+func Run(t *testing.T, newDB NewMsgDBFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, msgDb db.MsgDB)
+	}{
+		{"CreateGetMsg", testCreateGetMsg},
+		{"CreateMsg_ErrIdUnavailable", testCreateMsgErrIdUnavailable},
+		{"GetMsg_ErrMsgNotFound", testGetMsgErrMsgNotFound},
+		{"GetAllMsgs", testGetAllMsgs},
+		{"UpdateMsg", testUpdateMsg},
+		{"UpdateMsg_ErrMsgNotFound", testUpdateMsgErrMsgNotFound},
+		{"DeleteMsg", testDeleteMsg},
+		{"CreateMsg_Concurrent", testCreateMsgConcurrent},
+		{"Empty", testEmpty},
+		{"ListMsgs", testListMsgs},
+		{"ListFilter", testListFilter},
+		{"ListSort", testListSort},
+		{"ForEachMsg", testForEachMsg},
+		{"Search", testSearch},
+		{"Versions", testVersions},
+		{"Revisions", testRevisions},
+		{"Trash", testTrash},
+		{"Expiry", testExpiry},
+		{"Batch", testBatch},
+		{"AtomicBatch", testAtomicBatch},
+		{"Watch", testWatch},
+		{"Watch_Update", testWatchUpdate},
+		{"PalindromeProfile", testPalindromeProfile},
+		{"Properties", testProperties},
+		{"Properties_NoAnalyzers", testPropertiesNoAnalyzers},
+	}
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			test(t, newDB(t))
+		})
+	}
+}
+
+// assertMsg checks that got is stored as expected, the mod times can differ up to the precision of the db
+func assertMsg(t *testing.T, expected, got *db.Msg) {
+	assert.Equal(t, expected.Id, got.Id)
+	assert.Equal(t, expected.Content, got.Content)
+	assert.Equal(t, expected.IsPalindrome, got.IsPalindrome)
+	assert.Equal(t, expected.IsWordPalindrome, got.IsWordPalindrome)
+	assert.Equal(t, expected.PalindromeProfile, got.PalindromeProfile)
+	assert.Equal(t, expected.LongestPalindrome, got.LongestPalindrome)
+	assert.Equal(t, expected.Properties, got.Properties)
+	assert.WithinDuration(t, expected.ModTime, got.ModTime, modTimePrecision)
+	assert.Equal(t, expected.Version, got.Version)
+}
+
+func testCreateGetMsg(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	msg1 := db.NewMsg("unicorn", "kayak")
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg1))
+	msg2 := db.NewMsg("1234", "message")
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg2))
+
+	retMsg1, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assertMsg(t, msg1, retMsg1)
+
+	retMsg2, err := msgDb.GetMsg(ctx, "1234")
+	assert.Nil(t, err)
+	assertMsg(t, msg2, retMsg2)
+}
+
+func testCreateMsgErrIdUnavailable(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("fly", "this is the message")))
+	err := msgDb.CreateMsg(ctx, db.NewMsg("fly", "other message"))
+	assert.IsType(t, db.ErrIdUnavailable{}, err)
+
+	// the msg stored must be left untouched
+	retMsg, err := msgDb.GetMsg(ctx, "fly")
+	assert.Nil(t, err)
+	assert.Equal(t, "this is the message", retMsg.Content)
+}
+
+func testGetMsgErrMsgNotFound(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	msg, err := msgDb.GetMsg(ctx, "potato")
+	assert.Nil(t, msg)
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+func testGetAllMsgs(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	ids := []string{"unicorn", "1234", "potato"}
+	for i, id := range ids {
+		assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg(id, "kayak")))
+
+		msgs, err := msgDb.GetAllMsgs(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, len(msgs))
+	}
+
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	var retIds []string
+	for _, msg := range msgs {
+		retIds = append(retIds, msg.Id)
+	}
+	assert.ElementsMatch(t, ids, retIds)
+}
+
+func testUpdateMsg(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+
+	newMsg := db.NewMsg("unicorn", "iAmGroot")
+	assert.Nil(t, msgDb.UpdateMsg(ctx, newMsg))
+
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assertMsg(t, newMsg, retMsg)
+}
+
+func testUpdateMsgErrMsgNotFound(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	err := msgDb.UpdateMsg(ctx, db.NewMsg("nonexistent", "iAmGroot"))
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	// nothing must be created by the update
+	_, err = msgDb.GetMsg(ctx, "nonexistent")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+func testDeleteMsg(t *testing.T, msgDb db.MsgDB) {
+	// delete, then delete again and make sure it returns ErrMsgNotFound
+	ctx := context.Background()
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+
+	_, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	err = msgDb.DeleteMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+func testCreateMsgConcurrent(t *testing.T, msgDb db.MsgDB) {
+	// only one of the concurrent creations of the same id must succeed, those of different ids must all succeed
+	ctx := context.Background()
+	n := 20
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, unavailable := 0, 0
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := msgDb.CreateMsg(ctx, db.NewMsg("racer", "racecar"))
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				created++
+			} else if db.IsErrIdUnavailable(err) {
+				unavailable++
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg(msgId(i), "kayak")))
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, created)
+	assert.Equal(t, n-1, unavailable)
+
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, n+1, len(msgs))
+}
+
+func testPalindromeProfile(t *testing.T, msgDb db.MsgDB) {
+	// the profile a msg was checked with must be kept along with it, by its revisions and through the trash, so must
+	// the longest palindrome found with it
+	ctx := context.Background()
+
+	msg := db.NewMsgWithProfile("panama", "A man, a plan, a canal: Panama", db.ProfileLettersOnly)
+	assert.True(t, msg.IsPalindrome)
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	retMsg, err := msgDb.GetMsg(ctx, "panama")
+	assert.Nil(t, err)
+	assertMsg(t, msg, retMsg)
+
+	updated := db.NewMsgWithProfile("panama", "Kayak", db.ProfileStrict)
+	assert.False(t, updated.IsPalindrome)
+	assert.Nil(t, msgDb.UpdateMsg(ctx, updated))
+	retMsg, err = msgDb.GetMsg(ctx, "panama")
+	assert.Nil(t, err)
+	assertMsg(t, updated, retMsg)
+
+	revisions, err := msgDb.GetRevisions(ctx, "panama")
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(revisions)) {
+		assert.Equal(t, db.ProfileLettersOnly, revisions[0].PalindromeProfile)
+		assert.Equal(t, db.ProfileStrict, revisions[1].PalindromeProfile)
+	}
+
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "panama"))
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(trashed)) {
+		assert.Equal(t, db.ProfileStrict, trashed[0].PalindromeProfile)
+		assert.Equal(t, updated.LongestPalindrome, trashed[0].LongestPalindrome)
+	}
+	assert.Nil(t, msgDb.RestoreMsg(ctx, "panama"))
+	retMsg, err = msgDb.GetMsg(ctx, "panama")
+	assert.Nil(t, err)
+	assertMsg(t, updated, retMsg)
+}
+
+func testProperties(t *testing.T, msgDb db.MsgDB) {
+	// the properties must be returned as the json values they were created with, through updates and the trash, and
+	// the msgs with none must be returned with none
+	ctx := context.Background()
+
+	msg := db.NewMsg("unicorn", "Fall leaves after leaves fall")
+	msg.Properties["tags"] = []interface{}{"autumn", float64(2)}
+	msg.Properties["nested"] = map[string]interface{}{"ok": true}
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assertMsg(t, msg, retMsg)
+
+	updated := db.NewMsg("unicorn", "kayak")
+	updated.Properties = nil
+	assert.Nil(t, msgDb.UpdateMsg(ctx, updated))
+	retMsg, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Nil(t, retMsg.Properties)
+
+	updated = db.NewMsg("unicorn", "level")
+	assert.Nil(t, msgDb.UpdateMsg(ctx, updated))
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(trashed)) {
+		assert.Equal(t, updated.Properties, trashed[0].Properties)
+	}
+}
+
+func testPropertiesNoAnalyzers(t *testing.T, msgDb db.MsgDB) {
+	// the msgs created and updated with no analyzers enabled have no properties, which must read back as none
+	ctx := context.Background()
+	enabled := db.EnabledAnalyzers()
+	assert.Nil(t, db.EnableAnalyzers([]string{}))
+	defer func() {
+		assert.Nil(t, db.EnableAnalyzers(enabled))
+	}()
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	updated := db.NewMsg("unicorn", "racecar")
+	assert.Nil(t, updated.Properties)
+	assert.Nil(t, msgDb.UpdateMsg(ctx, updated))
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assertMsg(t, updated, retMsg)
+	assert.Nil(t, retMsg.Properties)
+
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(msgs)) {
+		assert.Nil(t, msgs[0].Properties)
+	}
+	revisions, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+}
@@ -0,0 +1,132 @@
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"testing"
+	"time"
+)
+
+// eventTimeout is how long nextEvent waits for an event, the dbs with a change feed deliver them asynchronously
+const eventTimeout = 5 * time.Second
+
+// nextEvent returns the next event of events, nil if none comes in time or events is closed
+func nextEvent(t *testing.T, events <-chan *db.MsgEvent) *db.MsgEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Error("the events were closed")
+			return nil
+		}
+		return event
+	case <-time.After(eventTimeout):
+		t.Error("no event came in time")
+		return nil
+	}
+}
+
+// assertEvent checks that event is of the type and msg expected, deleted events must have the msg as it was trashed
+func assertEvent(t *testing.T, event *db.MsgEvent, eventType db.MsgEventType, msgId, content string) {
+	if !assert.NotNil(t, event) {
+		return
+	}
+	assert.NotEmpty(t, event.Id)
+	assert.Equal(t, eventType, event.Type)
+	assert.Equal(t, msgId, event.MsgId)
+	if assert.NotNil(t, event.Msg) {
+		assert.Equal(t, msgId, event.Msg.Id)
+		assert.Equal(t, content, event.Msg.Content)
+		assert.Equal(t, eventType == db.MsgDeleted, event.Msg.DeletedAt != nil)
+	}
+}
+
+// testWatch checks that every change of the msgs is watched in order, and that a watch can resume after an event
+func testWatch(t *testing.T, msgDb db.MsgDB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := msgDb.Watch(ctx, "")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "racecar")))
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+	assert.Nil(t, msgDb.RestoreMsg(ctx, "unicorn"))
+	// failed changes have no events
+	assert.IsType(t, db.ErrIdUnavailable{}, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "canoe")))
+
+	created := nextEvent(t, events)
+	assertEvent(t, created, db.MsgCreated, "unicorn", "kayak")
+	assertEvent(t, nextEvent(t, events), db.MsgUpdated, "unicorn", "racecar")
+	assertEvent(t, nextEvent(t, events), db.MsgDeleted, "unicorn", "racecar")
+	assertEvent(t, nextEvent(t, events), db.MsgCreated, "unicorn", "racecar")
+	if created == nil {
+		return
+	}
+
+	// resuming after the creation gets the events that followed it
+	resumed, err := msgDb.Watch(ctx, created.Id)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assertEvent(t, nextEvent(t, resumed), db.MsgUpdated, "unicorn", "racecar")
+	assertEvent(t, nextEvent(t, resumed), db.MsgDeleted, "unicorn", "racecar")
+	assertEvent(t, nextEvent(t, resumed), db.MsgCreated, "unicorn", "racecar")
+
+	_, err = msgDb.Watch(ctx, "potato")
+	assert.IsType(t, db.ErrEventNotFound{}, err)
+
+	// the events are closed once the ctx is done
+	cancel()
+	for range events {
+	}
+	for range resumed {
+	}
+}
+
+// testWatchUpdate checks that an updated msg is watched as it was stored, as GetMsg returns it, whether it was updated
+// on its own or by an atomic batch
+func testWatchUpdate(t *testing.T, msgDb db.MsgDB) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", time.Now().Add(time.Hour))))
+	events, err := msgDb.Watch(ctx, "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "racecar")))
+
+	event := nextEvent(t, events)
+	assertEvent(t, event, db.MsgUpdated, "unicorn", "racecar")
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	if !assert.Nil(t, err) || event == nil || event.Msg == nil {
+		return
+	}
+	assertStoredEvent(t, retMsg, event)
+
+	op := &db.BatchOp{Type: db.BatchUpdate, Msg: db.NewMsg("unicorn", "level")}
+	results, err := msgDb.ApplyBatch(ctx, []*db.BatchOp{op}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []error{nil}, results)
+
+	event = nextEvent(t, events)
+	assertEvent(t, event, db.MsgUpdated, "unicorn", "level")
+	retMsg, err = msgDb.GetMsg(ctx, "unicorn")
+	if !assert.Nil(t, err) || event == nil || event.Msg == nil {
+		return
+	}
+	assertStoredEvent(t, retMsg, event)
+	assert.NotSame(t, op.Msg, event.Msg)
+}
+
+// assertStoredEvent checks that the msg of event is stored as expected, along with its expiry
+func assertStoredEvent(t *testing.T, expected *db.Msg, event *db.MsgEvent) {
+	assertMsg(t, expected, event.Msg)
+	if assert.NotNil(t, event.Msg.ExpiresAt) && expected.ExpiresAt != nil {
+		assert.WithinDuration(t, *expected.ExpiresAt, *event.Msg.ExpiresAt, modTimePrecision)
+	}
+}
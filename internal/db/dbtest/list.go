@@ -0,0 +1,241 @@
+package dbtest
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// forEachMsgs is the number of msgs testForEachMsg iterates over, past the size of the batches some dbs read at once
+const forEachMsgs = 510
+
+// msgId returns a distinct id for every i
+func msgId(i int) string {
+	return "msg" + strconv.Itoa(i)
+}
+
+// newPageMsgs returns msgs in their pagination order, two of them share the same mod time so they're sorted by id
+// mod times are aligned to the coarsest precision a db stores
+func newPageMsgs() []*db.Msg {
+	t0 := time.Now().Truncate(modTimePrecision)
+	msgs := []*db.Msg{
+		db.NewMsg("zebra", "first"),
+		db.NewMsg("bear", "second"),
+		db.NewMsg("cat", "third"),
+		db.NewMsg("ant", "fourth"),
+		db.NewMsg("dog", "fifth"),
+	}
+	msgs[0].ModTime = t0
+	msgs[1].ModTime = t0.Add(modTimePrecision)
+	msgs[2].ModTime = t0.Add(modTimePrecision)
+	msgs[3].ModTime = t0.Add(2 * modTimePrecision)
+	msgs[4].ModTime = t0.Add(3 * modTimePrecision)
+	return msgs
+}
+
+func testEmpty(t *testing.T, msgDb db.MsgDB) {
+	// an empty db must return empty results, not nil ones nor errors
+	ctx := context.Background()
+
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, msgs)
+	assert.Equal(t, 0, len(msgs))
+
+	page, err := msgDb.ListMsgs(ctx, db.ListOptions{Limit: 10})
+	assert.Nil(t, err)
+	assert.NotNil(t, page.Msgs)
+	assert.Equal(t, 0, len(page.Msgs))
+	assert.Empty(t, page.NextCursor)
+
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.NotNil(t, trashed)
+	assert.Equal(t, 0, len(trashed))
+
+	err = msgDb.ForEachMsg(ctx, func(msg *db.Msg) error {
+		t.Error("no msg should be visited in an empty db")
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func testListMsgs(t *testing.T, msgDb db.MsgDB) {
+	// the pages must follow the mod time and then the id of the msgs, whatever the order they were created in
+	ctx := context.Background()
+
+	msgs := newPageMsgs()
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		assert.Nil(t, msgDb.CreateMsg(ctx, msgs[i]))
+	}
+
+	var ids []string
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		page, err := msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, Cursor: cursor})
+		assert.Nil(t, err)
+		for _, msg := range page.Msgs {
+			ids = append(ids, msg.Id)
+		}
+		cursor = page.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Empty(t, cursor)
+	assert.Equal(t, []string{"zebra", "bear", "cat", "ant", "dog"}, ids)
+
+	// a single page holding them all
+	page, err := msgDb.ListMsgs(ctx, db.ListOptions{Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, len(msgs), len(page.Msgs))
+	assert.Empty(t, page.NextCursor)
+
+	_, err = msgDb.ListMsgs(ctx, db.ListOptions{Limit: 0})
+	assert.IsType(t, db.ErrInvalidLimit{}, err)
+
+	_, err = msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, Cursor: "potato"})
+	assert.IsType(t, db.ErrInvalidCursor{}, err)
+}
+
+func testForEachMsg(t *testing.T, msgDb db.MsgDB) {
+	// every msg must be visited once, and the iteration must stop on errors
+	ctx := context.Background()
+
+	for i := 0; i < forEachMsgs; i++ {
+		assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg(msgId(i), "kayak")))
+	}
+
+	visited := map[string]int{}
+	err := msgDb.ForEachMsg(ctx, func(msg *db.Msg) error {
+		visited[msg.Id]++
+		assert.Equal(t, "kayak", msg.Content)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, forEachMsgs, len(visited))
+	for id, count := range visited {
+		assert.Equal(t, 1, count, id)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = msgDb.ForEachMsg(ctx, func(msg *db.Msg) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+}
+
+// listIds returns the ids of every msg listed with opts, going through the pages of at most 2 msgs
+func listIds(t *testing.T, msgDb db.MsgDB, opts db.ListOptions) []string {
+	ctx := context.Background()
+	ids := []string{}
+	opts.Limit = 2
+	for {
+		page, err := msgDb.ListMsgs(ctx, opts)
+		if !assert.Nil(t, err) {
+			return ids
+		}
+		for _, msg := range page.Msgs {
+			ids = append(ids, msg.Id)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// newFilterMsgs returns msgs in mod time order, with contents of different lengths some of which are palindromes
+func newFilterMsgs() []*db.Msg {
+	t0 := time.Now().Truncate(modTimePrecision)
+	msgs := []*db.Msg{
+		db.NewMsg("race-1", "racecar"),
+		db.NewMsg("race-2", "level"),
+		db.NewMsg("banana", "banana"),
+		db.NewMsg("kayak", "kayak"),
+		db.NewMsg("rhea", "ñandú"), // 5 characters, 7 bytes
+	}
+	for i, msg := range msgs {
+		msg.ModTime = t0.Add(time.Duration(i) * modTimePrecision)
+	}
+	return msgs
+}
+
+func testListFilter(t *testing.T, msgDb db.MsgDB) {
+	// only the msgs that meet every condition set must be listed, still paginated by mod time
+	ctx := context.Background()
+
+	msgs := newFilterMsgs()
+	for _, i := range []int{2, 4, 0, 3, 1} {
+		assert.Nil(t, msgDb.CreateMsg(ctx, msgs[i]))
+	}
+	yes := true
+	two, five, six := 2, 5, 6
+	since, before := msgs[1].ModTime, msgs[3].ModTime
+
+	tests := []struct {
+		name     string
+		filter   db.MsgFilter
+		expected []string
+	}{
+		{"None", db.MsgFilter{}, []string{"race-1", "race-2", "banana", "kayak", "rhea"}},
+		{"IsPalindrome", db.MsgFilter{IsPalindrome: &yes}, []string{"race-1", "race-2", "kayak"}},
+		{"ModTime", db.MsgFilter{ModifiedSince: &since, ModifiedBefore: &before}, []string{"race-2", "banana"}},
+		{"IdPrefix", db.MsgFilter{IdPrefix: "race-"}, []string{"race-1", "race-2"}},
+		{"IdPrefix_CaseSensitive", db.MsgFilter{IdPrefix: "RACE"}, []string{}},
+		{"Length", db.MsgFilter{MinLength: &five, MaxLength: &five}, []string{"race-2", "kayak", "rhea"}},
+		{"Combined", db.MsgFilter{IsPalindrome: &yes, MinLength: &six}, []string{"race-1"}},
+		{"PalindromeLength", db.MsgFilter{MinPalindromeLength: &two, MaxPalindromeLength: &five},
+			[]string{"race-2", "banana", "kayak"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, listIds(t, msgDb, db.ListOptions{Filter: tt.filter}), tt.name)
+	}
+}
+
+func testListSort(t *testing.T, msgDb db.MsgDB) {
+	// the pages must follow the sort requested and then the id, in the direction requested
+	ctx := context.Background()
+
+	msgs := newFilterMsgs()
+	for _, i := range []int{2, 4, 0, 3, 1} {
+		assert.Nil(t, msgDb.CreateMsg(ctx, msgs[i]))
+	}
+
+	tests := []struct {
+		name     string
+		sortBy   db.SortField
+		desc     bool
+		expected []string
+	}{
+		{"ModTime_Desc", db.SortByModTime, true, []string{"rhea", "kayak", "banana", "race-2", "race-1"}},
+		{"Id", db.SortById, false, []string{"banana", "kayak", "race-1", "race-2", "rhea"}},
+		{"Id_Desc", db.SortById, true, []string{"rhea", "race-2", "race-1", "kayak", "banana"}},
+		{"ContentLength", db.SortByContentLength, false, []string{"kayak", "race-2", "rhea", "banana", "race-1"}},
+		{"ContentLength_Desc", db.SortByContentLength, true, []string{"race-1", "banana", "rhea", "race-2", "kayak"}},
+		{"LongestPalindrome", db.SortByLongestPalindrome, false, []string{"rhea", "banana", "kayak", "race-2", "race-1"}},
+		{"LongestPalindrome_Desc", db.SortByLongestPalindrome, true,
+			[]string{"race-1", "race-2", "kayak", "banana", "rhea"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, listIds(t, msgDb, db.ListOptions{SortBy: tt.sortBy, Desc: tt.desc}), tt.name)
+	}
+
+	// a cursor can't be used with another sort than the one it came from
+	page, err := msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, SortBy: db.SortById})
+	assert.Nil(t, err)
+	_, err = msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, Cursor: page.NextCursor})
+	assert.IsType(t, db.ErrInvalidCursor{}, err)
+	_, err = msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, SortBy: db.SortById, Desc: true, Cursor: page.NextCursor})
+	assert.IsType(t, db.ErrInvalidCursor{}, err)
+
+	_, err = msgDb.ListMsgs(ctx, db.ListOptions{Limit: 2, SortBy: "potato"})
+	assert.IsType(t, db.ErrInvalidSort{}, err)
+}
@@ -0,0 +1,65 @@
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"testing"
+)
+
+// searchIds returns the ids of the results of searching q, in order
+func searchIds(t *testing.T, msgDb db.MsgDB, q string) []string {
+	results, err := msgDb.SearchMsgs(context.Background(), q, 10)
+	assert.Nil(t, err, q)
+	ids := []string{}
+	for _, result := range results {
+		ids = append(ids, result.Msg.Id)
+	}
+	return ids
+}
+
+func testSearch(t *testing.T, msgDb db.MsgDB) {
+	// the msgs found must have every word and phrase, whole and in any case, the most relevant first
+	ctx := context.Background()
+
+	for _, msg := range []*db.Msg{
+		db.NewMsg("kayak", "I paddle a kayak, my kayak is red"),
+		db.NewMsg("canoe", "A canoe is not a kayak"),
+		db.NewMsg("boats", "Kayaks and canoes are boats"),
+		db.NewMsg("racecar", "Racecar"),
+		db.NewMsg("gone", "this kayak is gone"),
+	} {
+		assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	}
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "gone"))
+
+	assert.Equal(t, []string{"kayak", "canoe"}, searchIds(t, msgDb, "KAYAK"))
+	assert.Equal(t, []string{"canoe"}, searchIds(t, msgDb, "kayak canoe"))
+	assert.Equal(t, []string{"canoe"}, searchIds(t, msgDb, `"a kayak" not`))
+	assert.Equal(t, []string{"kayak"}, searchIds(t, msgDb, `"paddle a kayak"`))
+	assert.Equal(t, []string{}, searchIds(t, msgDb, `"kayak a"`))
+	assert.Equal(t, []string{}, searchIds(t, msgDb, "kay"))
+	assert.Equal(t, []string{"racecar"}, searchIds(t, msgDb, "racecar"))
+
+	results, err := msgDb.SearchMsgs(ctx, "racecar", 10)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, "<mark>Racecar</mark>", results[0].Snippet)
+		assert.Equal(t, "Racecar", results[0].Msg.Content)
+		assert.True(t, results[0].Score > 0)
+	}
+
+	results, err = msgDb.SearchMsgs(ctx, "kayak", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(results))
+
+	// the updates are searched, their previous content isn't
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("racecar", "A racecar, not a kayak")))
+	assert.Equal(t, []string{}, searchIds(t, msgDb, `"racecar"`+" boats"))
+	assert.Equal(t, []string{"racecar"}, searchIds(t, msgDb, "racecar kayak"))
+
+	_, err = msgDb.SearchMsgs(ctx, `  "" !? `, 10)
+	assert.IsType(t, db.ErrInvalidSearchQuery{}, err)
+	_, err = msgDb.SearchMsgs(ctx, "kayak", 0)
+	assert.IsType(t, db.ErrInvalidLimit{}, err)
+}
@@ -0,0 +1,159 @@
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"testing"
+	"time"
+)
+
+// newExpiringMsg returns a msg that expires at the time provided
+func newExpiringMsg(id, content string, expiresAt time.Time) *db.Msg {
+	msg := db.NewMsg(id, content)
+	msg.ExpiresAt = &expiresAt
+	return msg
+}
+
+// testTrash checks that db moves the deleted msgs to the trash, from which they can be restored or purged
+func testTrash(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(trashed))
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "racecar")))
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+	beforeDelete := time.Now().Add(-time.Second)
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "banana"))
+
+	// trashed msgs are hidden from everything else
+	_, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	_, err = msgDb.GetRevisions(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	err = msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "canoe"))
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	err = msgDb.DeleteMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(msgs))
+
+	trashed, err = msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(trashed))
+	for _, msg := range trashed {
+		assert.NotNil(t, msg.DeletedAt, msg.Id)
+		if msg.DeletedAt != nil {
+			assert.True(t, msg.DeletedAt.After(beforeDelete), msg.Id)
+		}
+	}
+
+	// a restored msg is back as it was, along with its revisions
+	assert.Nil(t, msgDb.RestoreMsg(ctx, "unicorn"))
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", retMsg.Content)
+	assert.Equal(t, int64(2), retMsg.Version)
+	assert.Nil(t, retMsg.DeletedAt)
+	revisions, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(revisions))
+	err = msgDb.RestoreMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	// only the msgs deleted before the time provided are purged
+	purged, err := msgDb.PurgeTrash(ctx, beforeDelete)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = msgDb.PurgeTrash(ctx, time.Now().Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	err = msgDb.RestoreMsg(ctx, "banana")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	trashed, err = msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(trashed))
+
+	// creating a msg with the id of a trashed one purges the trashed one
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+	msg := db.NewMsg("unicorn", "canoe")
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	assert.Equal(t, int64(1), msg.Version)
+	revisions, err = msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(revisions))
+	trashed, err = msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(trashed))
+}
+
+// testExpiry checks that db hides the expired msgs wherever they are, and frees their ids
+func testExpiry(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", future)))
+	assert.Nil(t, msgDb.CreateMsg(ctx, newExpiringMsg("potato", "papa", past)))
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+
+	// the expiry is kept by updates
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "racecar")))
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", retMsg.Content)
+	if assert.NotNil(t, retMsg.ExpiresAt) {
+		assert.WithinDuration(t, future, *retMsg.ExpiresAt, time.Millisecond)
+	}
+
+	// an expired msg is gone for every operation
+	_, err = msgDb.GetMsg(ctx, "potato")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	_, err = msgDb.GetRevisions(ctx, "potato")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	assert.IsType(t, db.ErrMsgNotFound{}, msgDb.UpdateMsg(ctx, db.NewMsg("potato", "papas")))
+	assert.IsType(t, db.ErrMsgNotFound{}, msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("potato", "papas"), 1))
+	assert.IsType(t, db.ErrMsgNotFound{}, msgDb.DeleteMsg(ctx, "potato"))
+	assert.IsType(t, db.ErrMsgNotFound{}, msgDb.DeleteMsgIfVersion(ctx, "potato", 1))
+
+	msgs, err := msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+	page, err := msgDb.ListMsgs(ctx, db.ListOptions{Limit: 10})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(page.Msgs))
+	visited := 0
+	assert.Nil(t, msgDb.ForEachMsg(ctx, func(msg *db.Msg) error {
+		assert.NotEqual(t, "potato", msg.Id)
+		visited++
+		return nil
+	}))
+	assert.Equal(t, 2, visited)
+
+	// its id can be used right away
+	msg := db.NewMsg("potato", "papas")
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	assert.Equal(t, int64(1), msg.Version)
+	revisions, err := msgDb.GetRevisions(ctx, "potato")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(revisions))
+
+	// an expired msg in the trash can't be restored
+	assert.Nil(t, msgDb.CreateMsg(ctx, newExpiringMsg("elephant", "kayak", past)))
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "banana"))
+	trashed, err := msgDb.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trashed))
+
+	_, err = msgDb.PurgeExpired(ctx)
+	assert.Nil(t, err)
+	_, err = msgDb.GetMsg(ctx, "elephant")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	msgs, err = msgDb.GetAllMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+}
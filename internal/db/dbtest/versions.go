@@ -0,0 +1,115 @@
+package dbtest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testVersions checks that db versions the msgs and only applies the conditional changes on the version expected
+func testVersions(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	msg := db.NewMsg("unicorn", "kayak")
+	assert.Nil(t, msgDb.CreateMsg(ctx, msg))
+	assert.Equal(t, int64(1), msg.Version)
+
+	update := db.NewMsg("unicorn", "canoe")
+	assert.Nil(t, msgDb.UpdateMsg(ctx, update))
+	assert.Equal(t, int64(2), update.Version)
+
+	retMsg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), retMsg.Version)
+
+	// a stale version must not overwrite the latest update
+	err = msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("unicorn", "stale"), 1)
+	assert.IsType(t, db.ErrVersionConflict{}, err)
+	retMsg, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "canoe", retMsg.Content)
+
+	update = db.NewMsg("unicorn", "racecar")
+	assert.Nil(t, msgDb.UpdateMsgIfVersion(ctx, update, 2))
+	assert.Equal(t, int64(3), update.Version)
+
+	// only one of the concurrent updates of the same version must succeed
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	updated, conflicts := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("unicorn", "update "+strconv.Itoa(i)), 3)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				updated++
+			} else if db.IsErrVersionConflict(err) {
+				conflicts++
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, updated)
+	assert.Equal(t, 9, conflicts)
+
+	err = msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("nonexistent", "kayak"), 1)
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	err = msgDb.DeleteMsgIfVersion(ctx, "unicorn", 3)
+	assert.IsType(t, db.ErrVersionConflict{}, err)
+	_, err = msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+
+	assert.Nil(t, msgDb.DeleteMsgIfVersion(ctx, "unicorn", 4))
+	err = msgDb.DeleteMsgIfVersion(ctx, "unicorn", 4)
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+// testRevisions checks that db records a revision of every version of a msg, and removes them along with the msg
+func testRevisions(t *testing.T, msgDb db.MsgDB) {
+	ctx := context.Background()
+
+	_, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "canoe")))
+	assert.Nil(t, msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("unicorn", "racecar"), 2))
+	// a failed update must not record anything
+	assert.NotNil(t, msgDb.UpdateMsgIfVersion(ctx, db.NewMsg("unicorn", "stale"), 1))
+
+	revisions, err := msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(revisions))
+	for i, content := range []string{"kayak", "canoe", "racecar"} {
+		assert.Equal(t, int64(i+1), revisions[i].Version)
+		assert.Equal(t, content, revisions[i].Content)
+		assert.Equal(t, content != "canoe", revisions[i].IsPalindrome)
+		assert.False(t, revisions[i].ModTime.IsZero())
+	}
+
+	rev, err := msgDb.GetRevision(ctx, "unicorn", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "canoe", rev.Content)
+
+	_, err = msgDb.GetRevision(ctx, "unicorn", 4)
+	assert.IsType(t, db.ErrRevisionNotFound{}, err)
+	_, err = msgDb.GetRevision(ctx, "potato", 1)
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	// a msg created again with the same id starts a new history
+	assert.Nil(t, msgDb.DeleteMsg(ctx, "unicorn"))
+	_, err = msgDb.GetRevisions(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsg("unicorn", "level")))
+	revisions, err = msgDb.GetRevisions(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(revisions))
+	assert.Equal(t, "level", revisions[0].Content)
+}
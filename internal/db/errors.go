@@ -23,3 +23,138 @@ func IsErrIdUnavailable(err error) bool {
 	_, isErrIdUnavailable := err.(ErrIdUnavailable)
 	return isErrIdUnavailable
 }
+
+// ErrInvalidCursor is used when the cursor provided to list messages is malformed
+type ErrInvalidCursor struct{}
+
+func (e ErrInvalidCursor) Error() string {
+	return "The cursor provided is not valid"
+}
+
+func IsErrInvalidCursor(err error) bool {
+	_, isErrInvalidCursor := err.(ErrInvalidCursor)
+	return isErrInvalidCursor
+}
+
+// ErrInvalidLimit is used when the max number of messages to list is not positive
+type ErrInvalidLimit struct{}
+
+func (e ErrInvalidLimit) Error() string {
+	return "The limit provided must be a positive number"
+}
+
+func IsErrInvalidLimit(err error) bool {
+	_, isErrInvalidLimit := err.(ErrInvalidLimit)
+	return isErrInvalidLimit
+}
+
+// ErrInvalidSort is used when the field provided to sort the listed messages by is unknown
+type ErrInvalidSort struct{}
+
+func (e ErrInvalidSort) Error() string {
+	return "The sort field provided is not valid"
+}
+
+func IsErrInvalidSort(err error) bool {
+	_, isErrInvalidSort := err.(ErrInvalidSort)
+	return isErrInvalidSort
+}
+
+// ErrInvalidSearchQuery is used when the query provided to search messages has no words to search for
+type ErrInvalidSearchQuery struct{}
+
+func (e ErrInvalidSearchQuery) Error() string {
+	return "The search query must have at least a word"
+}
+
+func IsErrInvalidSearchQuery(err error) bool {
+	_, isErrInvalidSearchQuery := err.(ErrInvalidSearchQuery)
+	return isErrInvalidSearchQuery
+}
+
+// ErrEventNotFound is used when the event a watch should resume after is unknown, or the events that followed it are
+// no longer available
+type ErrEventNotFound struct{}
+
+func (e ErrEventNotFound) Error() string {
+	return "The events that followed the event provided are not available"
+}
+
+func IsErrEventNotFound(err error) bool {
+	_, isErrEventNotFound := err.(ErrEventNotFound)
+	return isErrEventNotFound
+}
+
+// ErrVersionConflict is used when a message changed since the version a conditional update or deletion expected
+type ErrVersionConflict struct{}
+
+func (e ErrVersionConflict) Error() string {
+	return "The message was modified since the version provided"
+}
+
+func IsErrVersionConflict(err error) bool {
+	_, isErrVersionConflict := err.(ErrVersionConflict)
+	return isErrVersionConflict
+}
+
+// ErrRevisionNotFound is used when a message has no revision with the version provided
+type ErrRevisionNotFound struct{}
+
+func (e ErrRevisionNotFound) Error() string {
+	return "There was no revision of the message with the version provided"
+}
+
+func IsErrRevisionNotFound(err error) bool {
+	_, isErrRevisionNotFound := err.(ErrRevisionNotFound)
+	return isErrRevisionNotFound
+}
+
+// ErrInvalidBatchOp is used when an operation of a batch has an unknown type, or lacks the msg or id its type needs
+type ErrInvalidBatchOp struct{}
+
+func (e ErrInvalidBatchOp) Error() string {
+	return "The batch operation is not valid"
+}
+
+func IsErrInvalidBatchOp(err error) bool {
+	_, isErrInvalidBatchOp := err.(ErrInvalidBatchOp)
+	return isErrInvalidBatchOp
+}
+
+// ErrBatchAborted is used for the operations of an atomic batch that were not applied because another one failed
+type ErrBatchAborted struct{}
+
+func (e ErrBatchAborted) Error() string {
+	return "The operation was not applied since another operation of the atomic batch failed"
+}
+
+func IsErrBatchAborted(err error) bool {
+	_, isErrBatchAborted := err.(ErrBatchAborted)
+	return isErrBatchAborted
+}
+
+// ErrInvalidProfile is used when a palindrome profile is not one of PalindromeProfiles
+type ErrInvalidProfile struct{}
+
+func (e ErrInvalidProfile) Error() string {
+	return "The palindrome profile must be strict, case-insensitive, letters-only, alphanumeric or diacritic-insensitive"
+}
+
+func IsErrInvalidProfile(err error) bool {
+	_, isErrInvalidProfile := err.(ErrInvalidProfile)
+	return isErrInvalidProfile
+}
+
+// ErrInvalidAnalyzer is used when an analyzer is not one of the analyzers registered
+type ErrInvalidAnalyzer struct {
+	Name string
+}
+
+func (e ErrInvalidAnalyzer) Error() string {
+	return "There is no analyzer named " + e.Name
+}
+
+func IsErrInvalidAnalyzer(err error) bool {
+	_, isErrInvalidAnalyzer := err.(ErrInvalidAnalyzer)
+	return isErrInvalidAnalyzer
+}
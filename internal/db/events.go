@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// eventHistorySize is the number of past events a msgBroadcaster keeps for the watches that resume
+	eventHistorySize = 1000
+	// eventBufferSize is the number of events a watch can fall behind by before a msgBroadcaster drops it
+	eventBufferSize = 100
+)
+
+type MsgEventType string
+
+const (
+	MsgCreated MsgEventType = "created" // restored msgs are created again
+	MsgUpdated MsgEventType = "updated"
+	MsgDeleted MsgEventType = "deleted"
+)
+
+// MsgEvent is a change of a msg, as seen by MsgDB.Watch
+// the expiry and the purges of msgs have no events, they're already gone for the clients
+type MsgEvent struct {
+	// Id identifies the event, watching after it resumes the watch right after the event
+	Id    string       `json:"id"`
+	Type  MsgEventType `json:"type"`
+	MsgId string       `json:"msgId"`
+	// Msg is the msg as written by the change, as it was moved to the trash for deleted events
+	Msg  *Msg      `json:"message,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// msgBroadcaster is the in-process source of the events of the dbs that have no change feed of their own, it only
+// sees the changes made through the db it belongs to. Its zero value is ready to use
+// publishing never blocks: the watches that fall behind by more than eventBufferSize events are closed, and can
+// resume from the last event they got as long as it's among the last eventHistorySize ones
+type msgBroadcaster struct {
+	mu sync.Mutex
+	// epoch tells the events of this broadcaster apart from those of a previous process, whose seq started over
+	epoch   string
+	seq     uint64
+	history []*MsgEvent // the last eventHistorySize events, oldest first
+	watches map[chan *MsgEvent]struct{}
+	done    chan struct{} // closed by close
+}
+
+// init must be called with mu held
+func (mb *msgBroadcaster) init() {
+	if mb.done == nil {
+		mb.epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+		mb.watches = make(map[chan *MsgEvent]struct{})
+		mb.done = make(chan struct{})
+	}
+}
+
+// publish sends the event of msg to every watch
+func (mb *msgBroadcaster) publish(eventType MsgEventType, msg *Msg) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.init()
+
+	mb.seq++
+	cp := *msg
+	event := &MsgEvent{
+		Id:    mb.epoch + "-" + strconv.FormatUint(mb.seq, 10),
+		Type:  eventType,
+		MsgId: msg.Id,
+		Msg:   &cp,
+		Time:  time.Now(),
+	}
+
+	if len(mb.history) == eventHistorySize {
+		copy(mb.history, mb.history[1:])
+		mb.history = mb.history[:eventHistorySize-1]
+	}
+	mb.history = append(mb.history, event)
+
+	for ch := range mb.watches {
+		select {
+		case ch <- event:
+		default:
+			delete(mb.watches, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishBatch publishes the events of the ops of an atomic batch once applied, with the msgs they left stored
+func (mb *msgBroadcaster) publishBatch(ops []*BatchOp, stored []*Msg) {
+	for i, op := range ops {
+		switch op.Type {
+		case BatchCreate:
+			mb.publish(MsgCreated, stored[i])
+		case BatchUpdate:
+			mb.publish(MsgUpdated, stored[i])
+		default:
+			mb.publish(MsgDeleted, stored[i])
+		}
+	}
+}
+
+// watch implements MsgDB.Watch
+func (mb *msgBroadcaster) watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.init()
+
+	missed, err := mb.since(after)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *MsgEvent, eventBufferSize+len(missed))
+	for _, event := range missed {
+		ch <- event
+	}
+
+	select {
+	case <-mb.done:
+		close(ch)
+		return ch, nil
+	default:
+	}
+	mb.watches[ch] = struct{}{}
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-mb.done:
+		}
+		mb.unwatch(ch)
+	}()
+
+	return ch, nil
+}
+
+// since returns the events that followed the one with the id provided, none if empty; mu must be held
+// returns ErrEventNotFound if the id isn't of this broadcaster, or the events that followed it are no longer kept
+func (mb *msgBroadcaster) since(after string) ([]*MsgEvent, error) {
+	if after == "" {
+		return nil, nil
+	}
+
+	i := strings.LastIndex(after, "-")
+	if i < 0 || after[:i] != mb.epoch {
+		return nil, ErrEventNotFound{}
+	}
+	seq, err := strconv.ParseUint(after[i+1:], 10, 64)
+	if err != nil || seq > mb.seq {
+		return nil, ErrEventNotFound{}
+	}
+	// the history holds the events from seq mb.seq-len(history)+1 to mb.seq
+	missed := mb.seq - seq
+	if missed > uint64(len(mb.history)) {
+		return nil, ErrEventNotFound{}
+	}
+
+	return append([]*MsgEvent{}, mb.history[len(mb.history)-int(missed):]...), nil
+}
+
+// unwatch closes the watch with the channel provided, unless already closed
+func (mb *msgBroadcaster) unwatch(ch chan *MsgEvent) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _, ok := mb.watches[ch]; ok {
+		delete(mb.watches, ch)
+		close(ch)
+	}
+}
+
+// close closes every watch, and those started afterwards right away
+func (mb *msgBroadcaster) close() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.init()
+
+	select {
+	case <-mb.done:
+	default:
+		close(mb.done)
+	}
+	for ch := range mb.watches {
+		delete(mb.watches, ch)
+		close(ch)
+	}
+}
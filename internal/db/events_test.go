@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestMsgBroadcaster_DropsSlowWatches(t *testing.T) {
+	var mb msgBroadcaster
+	defer mb.close()
+
+	slow, err := mb.watch(context.Background(), "")
+	assert.Nil(t, err)
+	for i := 0; i <= eventBufferSize; i++ {
+		mb.publish(MsgCreated, NewMsg("unicorn", "kayak"))
+	}
+
+	// the events buffered are still delivered, then the watch is closed
+	n := 0
+	var last *MsgEvent
+	for event := range slow {
+		n++
+		last = event
+	}
+	assert.Equal(t, eventBufferSize, n)
+
+	// and it can resume from the last event it got
+	resumed, err := mb.watch(context.Background(), last.Id)
+	assert.Nil(t, err)
+	event := <-resumed
+	assert.Equal(t, MsgCreated, event.Type)
+	assert.Equal(t, 0, len(resumed))
+}
+
+func TestMsgBroadcaster_Since(t *testing.T) {
+	var mb msgBroadcaster
+	defer mb.close()
+
+	for i := 0; i < eventHistorySize+2; i++ {
+		mb.publish(MsgDeleted, &Msg{Id: "unicorn"})
+	}
+	first := mb.epoch + "-1"
+	latest := mb.epoch + "-" + strconv.Itoa(eventHistorySize+2)
+
+	_, err := mb.watch(context.Background(), first)
+	assert.IsType(t, ErrEventNotFound{}, err)
+	_, err = mb.watch(context.Background(), "1-1")
+	assert.IsType(t, ErrEventNotFound{}, err)
+	_, err = mb.watch(context.Background(), mb.epoch+"-"+strconv.Itoa(eventHistorySize+3))
+	assert.IsType(t, ErrEventNotFound{}, err)
+
+	events, err := mb.watch(context.Background(), mb.epoch+"-2")
+	assert.Nil(t, err)
+	assert.Equal(t, eventHistorySize, len(events))
+	events, err = mb.watch(context.Background(), latest)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+}
+
+func TestMsgBroadcaster_Close(t *testing.T) {
+	var mb msgBroadcaster
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancelled, err := mb.watch(ctx, "")
+	assert.Nil(t, err)
+	cancel()
+	_, ok := <-cancelled
+	assert.False(t, ok)
+
+	open, err := mb.watch(context.Background(), "")
+	assert.Nil(t, err)
+	mb.close()
+	_, ok = <-open
+	assert.False(t, ok)
+
+	// the watches started once closed are closed right away
+	late, err := mb.watch(context.Background(), "")
+	assert.Nil(t, err)
+	_, ok = <-late
+	assert.False(t, ok)
+}
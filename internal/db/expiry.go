@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	DefaultExpiryReapInterval = time.Minute
+)
+
+// ExpiryReaper periodically purges the expired msgs of a MsgDB, freeing the space they still take
+// it is mostly needed by the basic db, which only lives in memory; mongo and redis expire msgs on their own
+type ExpiryReaper struct {
+	msgDb MsgDB
+	task  *periodicTask // nil when disabled
+}
+
+// NewExpiryReaper starts purging the expired msgs of msgDb every interval
+// an interval <= 0 disables it, in which case expired msgs stay hidden but are only purged when their id is reused
+func NewExpiryReaper(msgDb MsgDB, interval time.Duration) *ExpiryReaper {
+	r := &ExpiryReaper{msgDb: msgDb}
+	if interval > 0 {
+		r.task = startPeriodicTask(interval, r.reap)
+	}
+
+	return r
+}
+
+// Stop stops reaping and waits for an ongoing reap to finish, it must be called before closing the msg db
+func (r *ExpiryReaper) Stop() {
+	if r.task != nil {
+		r.task.Stop()
+	}
+}
+
+func (r *ExpiryReaper) reap() {
+	purged, err := r.msgDb.PurgeExpired(context.Background())
+	if err != nil {
+		log.Error("Failed to purge expired messages: ", err.Error())
+		return
+	}
+	if purged > 0 {
+		log.Debugf("Purged %d expired messages", purged)
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newExpiringMsg returns a msg that expires at the time provided
+func newExpiringMsg(id, content string, expiresAt time.Time) *Msg {
+	msg := NewMsg(id, content)
+	msg.ExpiresAt = &expiresAt
+	return msg
+}
+
+func TestBasicMsgDB_ExpiresOverTime(t *testing.T) {
+	ctx := context.Background()
+	db := NewBasicMsgDB()
+	assert.Nil(t, db.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", time.Now().Add(20*time.Millisecond))))
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("banana", "anana")))
+	assert.Nil(t, db.DeleteMsg(ctx, "banana"))
+
+	_, err := db.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	purged, err := db.PurgeExpired(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+
+	time.Sleep(30 * time.Millisecond)
+	_, err = db.GetMsg(ctx, "unicorn")
+	assert.IsType(t, ErrMsgNotFound{}, err)
+
+	purged, err = db.PurgeExpired(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	_, exists := db.revisions.Load("unicorn")
+	assert.False(t, exists)
+	trashed, err := db.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trashed))
+}
+
+func TestExpiryReaper(t *testing.T) {
+	ctx := context.Background()
+	db := NewBasicMsgDB()
+	assert.Nil(t, db.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", time.Now())))
+
+	reaper := NewExpiryReaper(db, 5*time.Millisecond)
+	defer reaper.Stop()
+	assert.Eventually(t, func() bool {
+		_, exists := db.msgs.Load("unicorn")
+		return !exists
+	}, time.Second, 5*time.Millisecond)
+}
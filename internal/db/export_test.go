@@ -0,0 +1,32 @@
+package db
+
+import "testing"
+
+// exports for the db_test package, which runs the dbtest suite against every MsgDB (dbtest can't be imported here)
+var (
+	NewTestBoltMsgDB     = newTestBoltMsgDB
+	NewTestSQLiteMsgDB   = newTestSQLiteMsgDB
+	NewTestRedisMsgDB    = newTestRedisMsgDB
+	NewTestPostgresMsgDB = newTestPostgresMsgDB
+	NewTestMongoMsgDB    = newTestMongoMsgDB
+)
+
+// RunPostgresTests and RunMongoDBTests report whether the suites needing those dbs are enabled
+func RunPostgresTests() bool { return runPostgresTests }
+func RunMongoDBTests() bool  { return runMongoDBTests }
+
+// RestoreAnalyzers puts the analyzers registered and enabled back as they are now once t is done, so a test can
+// register and enable its own without changing the ones the other tests see
+func RestoreAnalyzers(t *testing.T) {
+	analyzers.mu.RLock()
+	registered := append([]Analyzer(nil), analyzers.analyzers...)
+	enabled := analyzers.enabled // EnableAnalyzers replaces the map rather than modifying it
+	analyzers.mu.RUnlock()
+
+	t.Cleanup(func() {
+		analyzers.mu.Lock()
+		defer analyzers.mu.Unlock()
+		analyzers.analyzers = registered
+		analyzers.enabled = enabled
+	})
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"sync"
+)
+
+// invertedIndex maps the words of the msgs to their ids, so the msgs having some words are found without scanning
+// them all; its zero value is empty and ready to use
+type invertedIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]struct{} // term -> ids of the msgs having it
+	terms    map[string][]string            // id -> distinct terms of its msg, to unindex it
+}
+
+// put indexes msg, replacing whatever was indexed with its id
+func (ix *invertedIndex) put(msg *Msg) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.postings == nil {
+		ix.postings = make(map[string]map[string]struct{})
+		ix.terms = make(map[string][]string)
+	}
+	ix.remove(msg.Id)
+
+	var terms []string
+	for _, token := range tokenize(msg.Content) {
+		ids, ok := ix.postings[token.term]
+		if !ok {
+			ids = make(map[string]struct{})
+			ix.postings[token.term] = ids
+		}
+		if _, ok := ids[msg.Id]; !ok {
+			ids[msg.Id] = struct{}{}
+			terms = append(terms, token.term)
+		}
+	}
+	ix.terms[msg.Id] = terms
+}
+
+// delete unindexes the msg with the id provided, if indexed
+func (ix *invertedIndex) delete(id string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(id)
+}
+
+// remove must be called with mu held
+func (ix *invertedIndex) remove(id string) {
+	for _, term := range ix.terms[id] {
+		delete(ix.postings[term], id)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+	delete(ix.terms, id)
+}
+
+// lookup returns the ids of the msgs having every term provided
+func (ix *invertedIndex) lookup(terms []string) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	if len(terms) == 0 {
+		return nil
+	}
+	// the rarest term has the fewest candidates to check the others against
+	rarest := ix.postings[terms[0]]
+	for _, term := range terms[1:] {
+		if len(ix.postings[term]) < len(rarest) {
+			rarest = ix.postings[term]
+		}
+	}
+
+	var ids []string
+	for id := range rarest {
+		hasAll := true
+		for _, term := range terms {
+			if _, ok := ix.postings[term][id]; !ok {
+				hasAll = false
+				break
+			}
+		}
+		if hasAll {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -7,6 +7,8 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -14,20 +16,40 @@ const (
 	DefaultMsgDbName         = "msgDB"
 	DefaultMsgCollectionName = "msgCollection"
 	defaultConnectTimeout    = 5 * time.Second
+	mongoIdIndexName         = "id_unique"
+	mongoRevisionSuffix      = "Revisions"
+	mongoTrashSuffix         = "Trash"
 )
 
 // MongoMsgDB will store the messages in the database running on the address provided
+// the revisions of the messages are stored in a separate collection, named after the msg one with a "Revisions"
+// suffix; since mongo only has multi document transactions on replica sets, a revision is written right after the
+// change of the msg it records, so a failure in between may leave that revision out
+// deleted msgs are moved the same way to a collection with a "Trash" suffix
+// expired msgs are removed by mongo itself through TTL indexes, which run about once a minute: queries skip the msgs
+// that expired in the meantime
 type MongoMsgDB struct {
-	client        *mongo.Client
-	msgCollection *mongo.Collection // we could get it from the client, but this saves a lot of redundant code
+	client             *mongo.Client
+	msgCollection      *mongo.Collection // we could get it from the client, but this saves a lot of redundant code
+	revisionCollection *mongo.Collection
+	trashCollection    *mongo.Collection
+	opTimeout          time.Duration // bounds every operation on top of the ctx it takes, 0 means no bound
+}
+
+// mongoRevision is how a revision is stored, along with the id of its msg
+type mongoRevision struct {
+	Id        string `bson:"id"`
+	Revision  `bson:",inline"`
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty"` // the one of its msg, so the revision expires along
 }
 
 // NewMongoMsgDB returns a new mongo msg db that will connect to the addr provided
 // for now it won't take in a password or user name, only unauthenticated access is available
 // addr expected is in the format 'mongodb://<host>:<port>' e.g: "mongodb://localhost:27017"
 // default values to use for dbName and collectionName are: DefaultMsgDbName and DefaultMsgCollectionName
-func NewMongoMsgDB(addr, dbName, collectionName string) (*MongoMsgDB, error) {
-	m := &MongoMsgDB{}
+// opTimeout is the max time a single operation can take, default value to use is DefaultOpTimeout
+func NewMongoMsgDB(addr, dbName, collectionName string, opTimeout time.Duration) (*MongoMsgDB, error) {
+	m := &MongoMsgDB{opTimeout: opTimeout}
 
 	clientOptions := options.Client().ApplyURI(addr)
 	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
@@ -50,10 +72,86 @@ func NewMongoMsgDB(addr, dbName, collectionName string) (*MongoMsgDB, error) {
 
 	m.client = client
 	m.msgCollection = client.Database(dbName).Collection(collectionName)
+	m.revisionCollection = client.Database(dbName).Collection(collectionName + mongoRevisionSuffix)
+	m.trashCollection = client.Database(dbName).Collection(collectionName + mongoTrashSuffix)
+
+	err = m.ensureIndexes()
+	if err != nil {
+		log.Error("Failed to create indexes: ", err.Error())
+		return nil, err
+	}
 
 	return m, nil
 }
 
+// ensureIndexes creates the indexes the queries rely on, creating an index that already exists is a noop
+// the unique index on id fails to be created if the collection already holds duplicated ids, they must be removed first
+func (m *MongoMsgDB) ensureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	defer cancel()
+
+	_, err := m.msgCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// makes concurrent creations of the same id fail atomically
+			Keys:    bson.D{primitive.E{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true).SetName(mongoIdIndexName),
+		},
+		{
+			// pagination order
+			Keys: bson.D{primitive.E{Key: "modTime", Value: 1}, primitive.E{Key: "id", Value: 1}},
+		},
+		{
+			// listing of the palindromes (or not) by mod time
+			Keys: bson.D{
+				primitive.E{Key: "isPalindrome", Value: 1},
+				primitive.E{Key: "modTime", Value: 1},
+				primitive.E{Key: "id", Value: 1},
+			},
+		},
+		{
+			// search candidates; no language, so the words are neither stemmed nor dropped as stop words
+			Keys:    bson.D{primitive.E{Key: "content", Value: "text"}},
+			Options: options.Index().SetDefaultLanguage("none"),
+		},
+		mongoExpiryIndex(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.revisionCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{primitive.E{Key: "id", Value: 1}, primitive.E{Key: "version", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		mongoExpiryIndex(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = m.trashCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{primitive.E{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// purge order
+			Keys: bson.D{primitive.E{Key: "deletedAt", Value: 1}},
+		},
+		mongoExpiryIndex(),
+	})
+	return err
+}
+
+// mongoExpiryIndex is a TTL index that makes mongo remove the documents once past their expiresAt, if they have one
+func mongoExpiryIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+}
+
 func (m *MongoMsgDB) Close() {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
 	defer cancel()
@@ -63,12 +161,12 @@ func (m *MongoMsgDB) Close() {
 	}
 }
 
-func (m *MongoMsgDB) GetMsg(id string) (*Msg, error) {
+func (m *MongoMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
 	msg := &Msg{}
 
-	filter := bson.D{primitive.E{Key: "id", Value: id}}
+	filter := bson.D{primitive.E{Key: "id", Value: id}, mongoNotExpired()}
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	ctx, cancel := opContext(ctx, m.opTimeout)
 	defer cancel()
 	err := m.msgCollection.FindOne(ctx, filter).Decode(msg)
 	if err != nil {
@@ -82,24 +180,21 @@ func (m *MongoMsgDB) GetMsg(id string) (*Msg, error) {
 	return msg, nil
 }
 
-// todo: verify that if there's nothing it just returns an empty slice
-func (m *MongoMsgDB) GetAllMsgs() ([]*Msg, error) {
-	var msgs []*Msg
+func (m *MongoMsgDB) GetAllMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
 
-	//bson.D{{}} specifies 'all documents'
-	filter := bson.D{{}}
+	filter := bson.D{mongoNotExpired()}
 
 	// cursor is like an iterator
-	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	ctx, cancel := opContext(ctx, m.opTimeout)
 	defer cancel()
 	cursor, err := m.msgCollection.Find(ctx, filter)
 	if err != nil {
 		log.Error("Failed to find documents: ", err.Error())
 		return msgs, err
 	}
+	defer m.closeCursor(cursor)
 
-	ctx, cancel2 := context.WithTimeout(context.Background(), defaultConnectTimeout)
-	defer cancel2()
 	for cursor.Next(ctx) {
 		msg := &Msg{}
 		err = cursor.Decode(msg)
@@ -109,70 +204,823 @@ func (m *MongoMsgDB) GetAllMsgs() ([]*Msg, error) {
 		msgs = append(msgs, msg)
 	}
 
-	ctx, cancel3 := context.WithTimeout(context.Background(), defaultConnectTimeout)
-	defer cancel3()
-	_ = cursor.Close(ctx)
-
-	return msgs, nil
+	return msgs, cursor.Err()
 }
 
-func (m *MongoMsgDB) CreateMsg(msg *Msg) error {
-	_, err := m.GetMsg(msg.Id)
+// ForEachMsg decodes the messages as the mongo cursor fetches them, only a batch of them is held in memory at a time
+func (m *MongoMsgDB) ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error {
+	cursor, err := m.msgCollection.Find(ctx, bson.D{mongoNotExpired()}, options.Find().SetBatchSize(iterBatchSize))
 	if err != nil {
-		if IsErrMsgNotFound(err) {
-			// we'll only add it if it wasn't found
-			ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
-			defer cancel()
-			_, err = m.msgCollection.InsertOne(ctx, msg)
-			if err != nil {
-				return err
-			}
-		} else {
+		log.Error("Failed to find documents: ", err.Error())
+		return err
+	}
+	defer m.closeCursor(cursor)
+
+	for cursor.Next(ctx) {
+		msg := &Msg{}
+		err = cursor.Decode(msg)
+		if err != nil {
+			return err
+		}
+		err = fn(msg)
+		if err != nil {
 			return err
 		}
-	} else {
-		// the message with such Id was already found
-		return ErrIdUnavailable{}
 	}
-	return nil
+
+	return cursor.Err()
 }
 
-func (m *MongoMsgDB) UpdateMsg(msg *Msg) error {
-	filter := bson.D{primitive.E{Key: "id", Value: msg.Id}}
+// ListMsgs runs the filters and the sort in mongo: the content length, not stored, is computed by the pipeline when
+// filtered or sorted by, so is the length of the longest palindrome of the msgs stored before it was
+func (m *MongoMsgDB) ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error) {
+	cursor, err := validateListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sortKey := map[SortField]string{
+		SortByModTime:           "modTime",
+		SortById:                "id",
+		SortByContentLength:     "contentLength",
+		SortByLongestPalindrome: "longestPalindromeLength",
+	}[opts.sortField()]
+	cmp, dir := "$gt", 1
+	if opts.Desc {
+		cmp, dir = "$lt", -1
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{primitive.E{Key: "$match", Value: append(bson.D{mongoNotExpired()}, mongoListFilter(opts.Filter)...)}},
+	}
+	if opts.sortField() == SortByContentLength {
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$addFields", Value: bson.D{
+			primitive.E{Key: "contentLength", Value: bson.D{primitive.E{Key: "$strLenCP", Value: "$content"}}},
+		}}})
+	}
+	if opts.sortField() == SortByLongestPalindrome {
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$addFields", Value: bson.D{
+			primitive.E{Key: "longestPalindromeLength", Value: mongoPalindromeLength()},
+		}}})
+	}
+	if cursor != nil {
+		var value interface{}
+		switch opts.sortField() {
+		case SortByModTime:
+			// mod times are stored with millisecond precision, so is the one in a cursor built from a stored msg
+			value = cursor.modTime()
+		case SortByContentLength:
+			value = cursor.Length
+		case SortByLongestPalindrome:
+			value = cursor.PalindromeLength
+		}
+		after := bson.D{primitive.E{Key: "id", Value: bson.D{primitive.E{Key: cmp, Value: cursor.Id}}}}
+		if value != nil {
+			after = bson.D{primitive.E{Key: "$or", Value: bson.A{
+				bson.D{primitive.E{Key: sortKey, Value: bson.D{primitive.E{Key: cmp, Value: value}}}},
+				bson.D{
+					primitive.E{Key: sortKey, Value: value},
+					primitive.E{Key: "id", Value: bson.D{primitive.E{Key: cmp, Value: cursor.Id}}},
+				},
+			}}}
+		}
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$match", Value: after}})
+	}
+	sort := bson.D{primitive.E{Key: sortKey, Value: dir}}
+	if sortKey != "id" {
+		sort = append(sort, primitive.E{Key: "id", Value: dir})
+	}
+	pipeline = append(pipeline,
+		bson.D{primitive.E{Key: "$sort", Value: sort}},
+		bson.D{primitive.E{Key: "$limit", Value: opts.Limit + 1}},
+	)
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	dbCursor, err := m.msgCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error("Failed to aggregate documents: ", err.Error())
+		return nil, err
+	}
+	defer m.closeCursor(dbCursor)
+
+	var msgs []*Msg
+	for dbCursor.Next(ctx) {
+		// the lengths added by the pipeline aren't fields of Msg, so they're ignored
+		msg := &Msg{}
+		err = dbCursor.Decode(msg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err = dbCursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return newMsgPage(msgs, opts), nil
+}
+
+// SearchMsgs finds the candidates through the text index, which matches every word of the query as a case and
+// diacritic insensitive substring, and checks them like the other dbs do, so the results are the same
+func (m *MongoMsgDB) SearchMsgs(ctx context.Context, q string, limit int) ([]*SearchResult, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit{}
+	}
+	query, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// every word in quotes, so the index requires them all rather than any
+	search := `"` + strings.Join(query.words(), `" "`) + `"`
+	filter := bson.D{
+		primitive.E{Key: "$text", Value: bson.D{primitive.E{Key: "$search", Value: search}}},
+		mongoNotExpired(),
+	}
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	cursor, err := m.msgCollection.Find(ctx, filter, options.Find().SetBatchSize(iterBatchSize))
+	if err != nil {
+		log.Error("Failed to find documents: ", err.Error())
+		return nil, err
+	}
+	defer m.closeCursor(cursor)
 
-	updater := bson.D{primitive.E{Key: "$set", Value: bson.D{
+	results := []*SearchResult{}
+	for cursor.Next(ctx) {
+		msg := &Msg{}
+		err = cursor.Decode(msg)
+		if err != nil {
+			return nil, err
+		}
+		if result := query.match(msg); result != nil {
+			results = append(results, result)
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	return rankResults(results, limit), nil
+}
+
+// mongoListFilter returns the conditions of a query that select the msgs of f
+func mongoListFilter(f MsgFilter) bson.D {
+	filter := bson.D{}
+	if f.IsPalindrome != nil {
+		filter = append(filter, primitive.E{Key: "isPalindrome", Value: *f.IsPalindrome})
+	}
+	modTime := bson.D{}
+	if f.ModifiedSince != nil {
+		modTime = append(modTime, primitive.E{Key: "$gte", Value: *f.ModifiedSince})
+	}
+	if f.ModifiedBefore != nil {
+		modTime = append(modTime, primitive.E{Key: "$lt", Value: *f.ModifiedBefore})
+	}
+	if len(modTime) > 0 {
+		filter = append(filter, primitive.E{Key: "modTime", Value: modTime})
+	}
+	if f.IdPrefix != "" {
+		// an anchored regex can use the index on id
+		filter = append(filter, primitive.E{Key: "id", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(f.IdPrefix)}})
+	}
+	var length bson.A
+	if f.MinLength != nil {
+		length = append(length, bson.D{primitive.E{Key: "$gte", Value: bson.A{
+			bson.D{primitive.E{Key: "$strLenCP", Value: "$content"}}, *f.MinLength,
+		}}})
+	}
+	if f.MaxLength != nil {
+		length = append(length, bson.D{primitive.E{Key: "$lte", Value: bson.A{
+			bson.D{primitive.E{Key: "$strLenCP", Value: "$content"}}, *f.MaxLength,
+		}}})
+	}
+	if f.MinPalindromeLength != nil {
+		length = append(length, bson.D{primitive.E{Key: "$gte", Value: bson.A{
+			mongoPalindromeLength(), *f.MinPalindromeLength,
+		}}})
+	}
+	if f.MaxPalindromeLength != nil {
+		length = append(length, bson.D{primitive.E{Key: "$lte", Value: bson.A{
+			mongoPalindromeLength(), *f.MaxPalindromeLength,
+		}}})
+	}
+	if len(length) > 0 {
+		filter = append(filter, primitive.E{Key: "$expr", Value: bson.D{primitive.E{Key: "$and", Value: length}}})
+	}
+	return filter
+}
+
+// mongoPalindromeLength is the expression of the length of the longest palindrome of a msg, 0 for the msgs stored
+// before it was, like in the other dbs
+func mongoPalindromeLength() bson.D {
+	return bson.D{primitive.E{Key: "$ifNull", Value: bson.A{"$longestPalindrome.length", 0}}}
+}
+
+func (m *MongoMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	stored := *msg
+	stored.Version = initialVersion
+
+	// the unique index on id rejects the insert if the id is already in use
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	_, err := m.msgCollection.InsertOne(ctx, &stored)
+	if mongo.IsDuplicateKeyError(err) {
+		// the id is freed if the msg using it expired but wasn't removed yet
+		err = m.removeExpiredMsg(ctx, msg.Id)
+		if err == nil {
+			_, err = m.msgCollection.InsertOne(ctx, &stored)
+		}
+	}
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrIdUnavailable{}
+		}
+		log.Error("Failed to insert msg: ", err.Error())
+		return err
+	}
+	msg.Version = stored.Version
+
+	// a trashed (or expired) msg with the same id is purged, the new one starts its own revisions
+	err = m.purgeMsgs(ctx, []string{msg.Id}, bson.D{primitive.E{Key: "id", Value: msg.Id}})
+	if err != nil {
+		return err
+	}
+	return m.insertRevision(ctx, &stored)
+}
+
+func (m *MongoMsgDB) UpdateMsg(ctx context.Context, msg *Msg) error {
+	return m.updateMsg(ctx, msg, anyVersion)
+}
+
+func (m *MongoMsgDB) UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error {
+	return m.updateMsg(ctx, msg, version)
+}
+
+func (m *MongoMsgDB) updateMsg(ctx context.Context, msg *Msg, version int64) error {
+	filter := mongoMsgFilter(msg.Id, version)
+
+	set := bson.D{
 		primitive.E{Key: "content", Value: msg.Content},
 		primitive.E{Key: "isPalindrome", Value: msg.IsPalindrome},
+		primitive.E{Key: "isWordPalindrome", Value: msg.IsWordPalindrome},
+		primitive.E{Key: "palindromeProfile", Value: msg.PalindromeProfile},
+		primitive.E{Key: "longestPalindrome", Value: msg.LongestPalindrome},
 		primitive.E{Key: "modTime", Value: msg.ModTime},
-	}}}
+	}
+	updater := bson.D{
+		primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "version", Value: 1}}},
+	}
+	// a msg with no properties has no field, as when it's created, rather than a null one
+	if len(msg.Properties) == 0 {
+		updater = append(updater, primitive.E{Key: "$unset", Value: bson.D{primitive.E{Key: "properties", Value: ""}}})
+	} else {
+		set = append(set, primitive.E{Key: "properties", Value: msg.Properties})
+	}
+	updater = append(updater, primitive.E{Key: "$set", Value: set})
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	ctx, cancel := opContext(ctx, m.opTimeout)
 	defer cancel()
-	result, err := m.msgCollection.UpdateOne(ctx, filter, updater)
+	updated := &Msg{}
+	err := m.msgCollection.FindOneAndUpdate(ctx, filter, updater,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
 	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return m.missedDocErr(ctx, msg.Id, version)
+		}
 		log.Error("Failed to update document: ", err.Error())
 		return err
 	}
-	if result.MatchedCount == 0 {
-		return ErrMsgNotFound{}
+
+	msg.Version = updated.Version
+	return m.insertRevision(ctx, updated)
+}
+
+func (m *MongoMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	return m.deleteMsg(ctx, id, anyVersion)
+}
+
+func (m *MongoMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	return m.deleteMsg(ctx, id, version)
+}
+
+func (m *MongoMsgDB) deleteMsg(ctx context.Context, id string, version int64) error {
+	filter := mongoMsgFilter(id, version)
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	msg := &Msg{}
+	err := m.msgCollection.FindOneAndDelete(ctx, filter).Decode(msg)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return m.missedDocErr(ctx, id, version)
+		}
+		log.Error("Failed to delete document: ", err.Error())
+		return err
+	}
+
+	now := time.Now()
+	msg.DeletedAt = &now
+	_, err = m.trashCollection.ReplaceOne(ctx, bson.D{primitive.E{Key: "id", Value: id}}, msg,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Error("Failed to move msg to trash: ", err.Error())
+		return err
 	}
 
 	return nil
 }
 
-func (m *MongoMsgDB) DeleteMsg(id string) error {
-	filter := bson.D{primitive.E{Key: "id", Value: id}}
+// ApplyBatch inserts the consecutive creations of a batch that isn't atomic at once, with InsertMany; the other ops are
+// applied one at a time. Atomic batches are applied in a multi document transaction, which needs a replica set
+func (m *MongoMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	if atomic {
+		return m.applyBatchInTx(ctx, ops)
+	}
+
+	results := make([]error, len(ops))
+	for i := 0; i < len(ops); {
+		end := i
+		for end < len(ops) && ops[end].Type == BatchCreate && ops[end].Msg != nil {
+			end++
+		}
+		if end > i {
+			m.createMsgs(ctx, ops[i:end], results[i:end])
+			i = end
+			continue
+		}
+		results[i] = applyBatchOp(ctx, m, ops[i])
+		i++
+	}
+	return results, nil
+}
+
+// createMsgs creates the msgs of ops with a single InsertMany, and sets the result of each op in results
+// the ids found in use are retried one at a time, since they may belong to expired msgs that weren't removed yet
+func (m *MongoMsgDB) createMsgs(ctx context.Context, ops []*BatchOp, results []error) {
+	docs := make([]interface{}, len(ops))
+	for i, op := range ops {
+		stored := *op.Msg
+		stored.Version = initialVersion
+		docs[i] = &stored
+	}
+
+	opCtx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	_, err := m.msgCollection.InsertMany(opCtx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		bulkErr, ok := err.(mongo.BulkWriteException)
+		if !ok {
+			log.Error("Failed to insert msgs: ", err.Error())
+			for i := range results {
+				results[i] = err
+			}
+			return
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			results[writeErr.Index] = writeErr.WriteError
+		}
+	}
+
+	var inserted []int
+	var ids []string
+	var revisions []interface{}
+	for i, op := range ops {
+		if results[i] == nil {
+			stored := docs[i].(*Msg)
+			inserted = append(inserted, i)
+			ids = append(ids, stored.Id)
+			revisions = append(revisions, &mongoRevision{Id: stored.Id, Revision: *newRevision(stored),
+				ExpiresAt: stored.ExpiresAt})
+			op.Msg.Version = stored.Version
+		} else if mongo.IsDuplicateKeyError(results[i]) {
+			results[i] = m.CreateMsg(ctx, op.Msg)
+		} else {
+			log.Error("Failed to insert msg: ", results[i].Error())
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	// the trashed (or expired) msgs with the same ids are purged, the new ones start their own revisions
+	err = m.purgeMsgs(opCtx, ids, bson.D{primitive.E{Key: "id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}})
+	if err == nil {
+		_, err = m.revisionCollection.InsertMany(opCtx, revisions)
+		if err != nil {
+			log.Error("Failed to insert revisions: ", err.Error())
+		}
+	}
+	if err != nil {
+		for _, i := range inserted {
+			results[i] = err
+		}
+	}
+}
+
+// applyBatchInTx applies ops in a transaction, through the single operation methods
+func (m *MongoMsgDB) applyBatchInTx(ctx context.Context, ops []*BatchOp) ([]error, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		log.Error("Failed to start session: ", err.Error())
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	var stored []*Msg
+	var failure *batchFailure
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		// the ops are applied to copies of their msgs, the transaction may be retried or aborted
+		stored, failure = runBatch(ops, func(op *BatchOp) (*Msg, error) {
+			if op.Type == BatchDelete {
+				return nil, m.deleteMsg(sc, op.id(), op.version())
+			}
+			msg := *op.Msg
+			if op.Type == BatchUpdate {
+				err := m.updateMsg(sc, &msg, op.version())
+				return &msg, err
+			}
+
+			// a duplicated key aborts the transaction, so the id is checked and freed beforehand
+			_, err := m.GetMsg(sc, msg.Id)
+			if err == nil {
+				return nil, ErrIdUnavailable{}
+			}
+			if !IsErrMsgNotFound(err) {
+				return nil, err
+			}
+			err = m.removeExpiredMsg(sc, msg.Id)
+			if err != nil && !IsErrIdUnavailable(err) {
+				return nil, err
+			}
+			err = m.CreateMsg(sc, &msg)
+			return &msg, err
+		})
+		if failure != nil {
+			return nil, failure
+		}
+		return nil, nil
+	})
+	if failure != nil {
+		return failure.results(len(ops)), nil
+	}
+	if err != nil {
+		log.Error("Failed to apply batch: ", err.Error())
+		return nil, err
+	}
+
+	setBatchVersions(ops, stored)
+	return make([]error, len(ops)), nil
+}
+
+// Watch follows a change stream of the msg and trash collections, so it sees the changes made by every process; event
+// ids are the resume tokens of the stream. Change streams are only available on replica sets and sharded clusters
+// the updated msgs are looked up once their events are read, so they may already hold later changes
+func (m *MongoMsgDB) Watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	pipeline := mongo.Pipeline{bson.D{primitive.E{Key: "$match", Value: bson.D{
+		primitive.E{Key: "ns.coll", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{
+			m.msgCollection.Name(), m.trashCollection.Name(),
+		}}}},
+		primitive.E{Key: "operationType", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{
+			"insert", "update", "replace",
+		}}}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if after != "" {
+		opts.SetResumeAfter(bson.D{primitive.E{Key: "_data", Value: after}})
+	}
+
+	stream, err := m.msgCollection.Database().Watch(ctx, pipeline, opts)
+	if err != nil {
+		if after != "" && isMongoLostResumeErr(err) {
+			return nil, ErrEventNotFound{}
+		}
+		log.Error("Failed to open change stream: ", err.Error())
+		return nil, err
+	}
+
+	ch := make(chan *MsgEvent, eventBufferSize)
+	go func() {
+		defer close(ch)
+		defer m.closeChangeStream(stream)
+
+		for stream.Next(ctx) {
+			event, err := m.decodeChangeEvent(stream)
+			if err != nil {
+				log.Error("Failed to decode change event: ", err.Error())
+				return
+			}
+			if event == nil {
+				continue
+			}
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			log.Error("Failed to follow change stream: ", err.Error())
+		}
+	}()
+
+	return ch, nil
+}
+
+// mongoChangeEvent is the part of a change stream event that Watch uses
+type mongoChangeEvent struct {
+	Token struct {
+		Data string `bson:"_data"`
+	} `bson:"_id"`
+	OperationType string `bson:"operationType"`
+	Ns            struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument *Msg                `bson:"fullDocument"`
+	ClusterTime  primitive.Timestamp `bson:"clusterTime"`
+}
+
+// decodeChangeEvent returns the MsgEvent of the current event of stream, nil if it has none: the msgs whose update
+// was followed by their deletion can't be looked up anymore, their deleted event comes next
+// inserts in the msg collection are creations (or restores), and inserts in the trash collection deletions
+func (m *MongoMsgDB) decodeChangeEvent(stream *mongo.ChangeStream) (*MsgEvent, error) {
+	change := &mongoChangeEvent{}
+	err := stream.Decode(change)
+	if err != nil {
+		return nil, err
+	}
+	if change.FullDocument == nil {
+		return nil, nil
+	}
+
+	event := &MsgEvent{
+		Id:    change.Token.Data,
+		MsgId: change.FullDocument.Id,
+		Msg:   change.FullDocument,
+		Time:  time.Unix(int64(change.ClusterTime.T), 0),
+	}
+	switch {
+	case change.Ns.Coll == m.trashCollection.Name():
+		event.Type = MsgDeleted
+	case change.OperationType == "insert":
+		event.Type = MsgCreated
+	default:
+		event.Type = MsgUpdated
+	}
+	return event, nil
+}
 
+// isMongoLostResumeErr returns true if err is due to a resume token that is invalid or whose events are no longer in
+// the oplog
+func isMongoLostResumeErr(err error) bool {
+	serverErr, ok := err.(mongo.ServerError)
+	if !ok {
+		return false
+	}
+	// BadValue, InvalidResumeToken, ChangeStreamFatalError and ChangeStreamHistoryLost
+	for _, code := range []int{2, 260, 280, 286} {
+		if serverErr.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeChangeStream releases the change stream on the server, even if the ctx it was followed with is already done
+func (m *MongoMsgDB) closeChangeStream(stream *mongo.ChangeStream) {
 	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
 	defer cancel()
-	result, err := m.msgCollection.DeleteOne(ctx, filter)
+	_ = stream.Close(ctx)
+}
+
+func (m *MongoMsgDB) GetTrashedMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	cursor, err := m.trashCollection.Find(ctx, bson.D{mongoNotExpired()})
 	if err != nil {
-		log.Error("Failed to delete document: ", err.Error())
+		log.Error("Failed to find trashed documents: ", err.Error())
+		return msgs, err
+	}
+	defer m.closeCursor(cursor)
+
+	for cursor.Next(ctx) {
+		msg := &Msg{}
+		err = cursor.Decode(msg)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, cursor.Err()
+}
+
+// RestoreMsg inserts the msg before removing it from the trash, so it isn't lost if the insert fails (e.g. the id was
+// taken in the meantime)
+func (m *MongoMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	filter := bson.D{primitive.E{Key: "id", Value: id}, mongoNotExpired()}
+	msg := &Msg{}
+	err := m.trashCollection.FindOne(ctx, filter).Decode(msg)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrMsgNotFound{}
+		}
+		log.Error("Failed to find trashed msg: ", err.Error())
+		return err
+	}
+
+	msg.DeletedAt = nil
+	_, err = m.msgCollection.InsertOne(ctx, msg)
+	if mongo.IsDuplicateKeyError(err) {
+		// the id is freed if the msg using it expired but wasn't removed yet
+		err = m.removeExpiredMsg(ctx, id)
+		if err == nil {
+			_, err = m.msgCollection.InsertOne(ctx, msg)
+		}
+	}
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrIdUnavailable{}
+		}
+		log.Error("Failed to restore msg: ", err.Error())
+		return err
+	}
+
+	_, err = m.trashCollection.DeleteOne(ctx, filter)
+	if err != nil {
+		log.Error("Failed to remove msg from trash: ", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongoMsgDB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	filter := bson.D{primitive.E{Key: "deletedAt", Value: bson.D{primitive.E{Key: "$lt", Value: before}}}}
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	cursor, err := m.trashCollection.Find(ctx, filter,
+		options.Find().SetProjection(bson.D{primitive.E{Key: "id", Value: 1}}))
+	if err != nil {
+		log.Error("Failed to find trashed documents: ", err.Error())
+		return 0, err
+	}
+	defer m.closeCursor(cursor)
+
+	var ids []string
+	for cursor.Next(ctx) {
+		msg := &Msg{}
+		err = cursor.Decode(msg)
+		if err != nil {
+			return 0, err
+		}
+		ids = append(ids, msg.Id)
+	}
+	if err = cursor.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// a msg restored in the meantime keeps its revisions, since only the ones still in the trash are purged
+	filter = append(filter, primitive.E{Key: "id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}})
+	err = m.purgeMsgs(ctx, ids, filter)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func (m *MongoMsgDB) GetRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	_, err := m.GetMsg(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := opContext(ctx, m.opTimeout)
+	defer cancel()
+	cursor, err := m.revisionCollection.Find(ctx, bson.D{primitive.E{Key: "id", Value: id}},
+		options.Find().SetSort(bson.D{primitive.E{Key: "version", Value: 1}}))
+	if err != nil {
+		log.Error("Failed to find revisions: ", err.Error())
+		return nil, err
+	}
+	defer m.closeCursor(cursor)
+
+	revisions := []*Revision{}
+	for cursor.Next(ctx) {
+		rev := &mongoRevision{}
+		err = cursor.Decode(rev)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &rev.Revision)
+	}
+
+	return revisions, cursor.Err()
+}
+
+func (m *MongoMsgDB) GetRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, err := m.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// PurgeExpired is a noop, the TTL indexes make mongo remove the expired msgs and revisions on its own
+func (m *MongoMsgDB) PurgeExpired(ctx context.Context) (int, error) {
+	return 0, ctx.Err()
+}
+
+// removeExpiredMsg deletes the msg with the id provided if it expired
+// returns ErrIdUnavailable if it didn't
+func (m *MongoMsgDB) removeExpiredMsg(ctx context.Context, id string) error {
+	result, err := m.msgCollection.DeleteOne(ctx, bson.D{
+		primitive.E{Key: "id", Value: id},
+		primitive.E{Key: "expiresAt", Value: bson.D{primitive.E{Key: "$lte", Value: time.Now()}}},
+	})
+	if err != nil {
+		log.Error("Failed to delete expired msg: ", err.Error())
 		return err
 	}
 	if result.DeletedCount == 0 {
-		return ErrMsgNotFound{}
+		return ErrIdUnavailable{}
 	}
+	return nil
+}
 
+// purgeMsgs permanently deletes the trashed msgs matching trashFilter, and the revisions of the ids provided
+func (m *MongoMsgDB) purgeMsgs(ctx context.Context, ids []string, trashFilter bson.D) error {
+	_, err := m.trashCollection.DeleteMany(ctx, trashFilter)
+	if err != nil {
+		log.Error("Failed to purge trashed documents: ", err.Error())
+		return err
+	}
+
+	_, err = m.revisionCollection.DeleteMany(ctx,
+		bson.D{primitive.E{Key: "id", Value: bson.D{primitive.E{Key: "$in", Value: ids}}}})
+	if err != nil {
+		log.Error("Failed to delete revisions: ", err.Error())
+		return err
+	}
 	return nil
 }
+
+// insertRevision records the revision of msg
+func (m *MongoMsgDB) insertRevision(ctx context.Context, msg *Msg) error {
+	_, err := m.revisionCollection.InsertOne(ctx,
+		&mongoRevision{Id: msg.Id, Revision: *newRevision(msg), ExpiresAt: msg.ExpiresAt})
+	if err != nil {
+		log.Error("Failed to insert revision: ", err.Error())
+	}
+	return err
+}
+
+// missedDocErr tells why an operation on the msg with the id and version provided didn't match any document: either
+// the msg doesn't exist (ErrMsgNotFound) or its version is not the one expected (ErrVersionConflict)
+func (m *MongoMsgDB) missedDocErr(ctx context.Context, id string, version int64) error {
+	if version == anyVersion {
+		return ErrMsgNotFound{}
+	}
+
+	_, err := m.GetMsg(ctx, id)
+	if err != nil {
+		return err
+	}
+	return ErrVersionConflict{}
+}
+
+// mongoMsgFilter matches the msg with the id provided, as long as it has the version provided (unless anyVersion)
+// documents stored before versions were introduced have no version field, they match version 0
+func mongoMsgFilter(id string, version int64) bson.D {
+	filter := bson.D{primitive.E{Key: "id", Value: id}, mongoNotExpired()}
+	if version == 0 {
+		filter = append(filter, primitive.E{Key: "version", Value: bson.D{primitive.E{Key: "$in", Value: bson.A{0, nil}}}})
+	} else if version != anyVersion {
+		filter = append(filter, primitive.E{Key: "version", Value: version})
+	}
+	return filter
+}
+
+// mongoNotExpired matches the documents that have no expiry or haven't reached it yet
+func mongoNotExpired() primitive.E {
+	return primitive.E{Key: "expiresAt", Value: bson.D{primitive.E{Key: "$not", Value: bson.D{
+		primitive.E{Key: "$lte", Value: time.Now()},
+	}}}}
+}
+
+// closeCursor releases the cursor on the server, even if the ctx it was iterated with is already done
+func (m *MongoMsgDB) closeCursor(cursor *mongo.Cursor) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	defer cancel()
+	_ = cursor.Close(ctx)
+}
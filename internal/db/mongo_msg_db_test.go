@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 	"testing"
 )
 
@@ -14,188 +15,81 @@ var (
 	testCollectionName = "testMsgCollection"
 )
 
-func TestNewMongoMsgDB(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
-	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	assert.NotNil(t, db.client)
-	assert.NotNil(t, db.msgCollection)
-}
-
-func TestMongoMsgDB_CreateGetMsg(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
-	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	msg1 := NewMsg("unicorn", "kayak")
-	err = db.CreateMsg(msg1)
+// newTestMongoMsgDB returns a db on an empty test database, which is dropped and the db closed when the test finishes
+func newTestMongoMsgDB(t *testing.T) *MongoMsgDB {
+	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName, DefaultOpTimeout)
 	assert.Nil(t, err)
-
-	msg2 := NewMsg("1234", "message")
-	err = db.CreateMsg(msg2)
-	assert.Nil(t, err)
-
-	retMsg1, err := db.GetMsg("unicorn")
-	assert.Nil(t, err)
-	assert.Equal(t, msg1.Id, retMsg1.Id)
-	assert.Equal(t, msg1.Content, retMsg1.Content)
-	assert.Equal(t, msg1.IsPalindrome, retMsg1.IsPalindrome)
-	assert.EqualValues(t, msg1.ModTime.Unix(), retMsg1.ModTime.Unix())
-
-	retMsg2, err := db.GetMsg("1234")
-	assert.Nil(t, err)
-	assert.Equal(t, msg2.Id, retMsg2.Id)
-	assert.Equal(t, msg2.Content, retMsg2.Content)
-	assert.Equal(t, msg2.IsPalindrome, retMsg2.IsPalindrome)
-	assert.EqualValues(t, msg2.ModTime.Unix(), retMsg2.ModTime.Unix())
+	t.Cleanup(func() {
+		_ = db.client.Database(testDBName).Drop(context.TODO())
+		db.Close()
+	})
+	return db
 }
 
-func TestMongoMsgDB_CreateMsg_ErrIdUnavailable(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
-	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	msg1 := NewMsg("fly", "this is the message")
-	err = db.CreateMsg(msg1)
-	assert.Nil(t, err)
-
-	msg2 := NewMsg("fly", "other message")
-	err = db.CreateMsg(msg2)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrIdUnavailable{}, err)
-}
-
-func TestMongoMsgDB_GetMsg_ErrMsgNotFound(t *testing.T) {
+func TestNewMongoMsgDB(t *testing.T) {
 	if !runMongoDBTests {
 		t.Skip("MongoDB tests are disabled")
 	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
+	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName, DefaultOpTimeout)
 	assert.Nil(t, err)
 	defer db.Close()
 	defer db.client.Database(testDBName).Drop(context.TODO())
 
-	msg, err := db.GetMsg("potato")
-	assert.Nil(t, msg)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
-
-	msg, err = db.GetMsg("88888")
-	assert.Nil(t, msg)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
+	assert.NotNil(t, db.client)
+	assert.NotNil(t, db.msgCollection)
 }
 
-func TestMongoMsgDB_GetAllMsgs(t *testing.T) {
+func TestMongoMsgDB_UniqueIdIndex(t *testing.T) {
 	if !runMongoDBTests {
 		t.Skip("MongoDB tests are disabled")
 	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
+	ctx := context.Background()
+	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName, DefaultOpTimeout)
 	assert.Nil(t, err)
 	defer db.Close()
 	defer db.client.Database(testDBName).Drop(context.TODO())
 
-	msgs, err := db.GetAllMsgs()
-	assert.Equal(t, 0, len(msgs))
-
-	msg1 := NewMsg("horse", "caballo")
-	err = db.CreateMsg(msg1)
-	assert.Nil(t, err)
-
-	msgs, err = db.GetAllMsgs()
-	assert.Equal(t, 1, len(msgs))
-
-	msg2 := NewMsg("quertyuiop", "zxcvbnm,")
-	err = db.CreateMsg(msg2)
+	specs, err := db.msgCollection.Indexes().ListSpecifications(ctx)
 	assert.Nil(t, err)
-
-	msgs, err = db.GetAllMsgs()
-	assert.Equal(t, 2, len(msgs))
-
-	for _, id := range []string{"horse", "quertyuiop"} {
-		idFound := false
-		for _, m := range msgs {
-			if id == m.Id {
-				idFound = true
-				break
-			}
+	found := false
+	for _, spec := range specs {
+		if spec.Name == mongoIdIndexName {
+			found = true
+			assert.NotNil(t, spec.Unique)
+			assert.True(t, *spec.Unique)
 		}
-		assert.True(t, idFound)
 	}
-}
+	assert.True(t, found)
 
-func TestMongoMsgDB_UpdateMsg(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
+	// reconnecting must not fail on the existing indexes
+	db2, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName, DefaultOpTimeout)
 	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	msg := NewMsg("pegasus", "123456")
-	err = db.CreateMsg(msg)
-	assert.Nil(t, err)
-
-	newMsg := NewMsg(msg.Id, "iAmGroot")
-	err = db.UpdateMsg(newMsg)
-	assert.Nil(t, err)
-
-	retMsg, err := db.GetMsg(msg.Id)
-	assert.Nil(t, err)
-
-	assert.Equal(t, newMsg.Content, retMsg.Content)
-	assert.Equal(t, newMsg.IsPalindrome, retMsg.IsPalindrome)
+	db2.Close()
 }
 
-func TestMongoMsgDB_UpdateMsg_ErrMsgNotFound(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
+func TestMsgProperties_BSON(t *testing.T) {
+	// the properties must be decoded as json values, like the other dbs return them, no server is needed
+	msg := NewMsg("unicorn", "a kayak")
+	msg.Properties["count"] = float64(3)
+	data, err := bson.Marshal(msg)
 	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	newMsg := NewMsg("nonexistent", "iAmGroot")
-	err = db.UpdateMsg(newMsg)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
-}
 
-func TestMongoMsgDB_DeleteMsg(t *testing.T) {
-	if !runMongoDBTests {
-		t.Skip("MongoDB tests are disabled")
-	}
+	decoded := &Msg{}
+	assert.Nil(t, bson.Unmarshal(data, decoded))
+	assert.Equal(t, msg.Properties, decoded.Properties)
+	assert.Equal(t, msg.LongestPalindrome, decoded.LongestPalindrome)
 
-	// delete, then delete again and make sure it returns ErrMsgNotFound
-
-	db, err := NewMongoMsgDB(testMongoDBAddr, testDBName, testCollectionName)
-	assert.Nil(t, err)
-	defer db.Close()
-	defer db.client.Database(testDBName).Drop(context.TODO())
-
-	msg := NewMsg("helloMsg", "goodbye my friend")
-	err = db.CreateMsg(msg)
+	// the msgs stored before the properties were have none
+	data, err = bson.Marshal(&Msg{Id: "unicorn"})
 	assert.Nil(t, err)
+	decoded = &Msg{}
+	assert.Nil(t, bson.Unmarshal(data, decoded))
+	assert.Nil(t, decoded.Properties)
 
-	err = db.DeleteMsg(msg.Id)
+	// nor do the ones updated with none before they were unset
+	data, err = bson.Marshal(bson.D{{Key: "_id", Value: "unicorn"}, {Key: "properties", Value: nil}})
 	assert.Nil(t, err)
-
-	// try to delete again now that it's deleted
-	err = db.DeleteMsg(msg.Id)
-	assert.NotNil(t, err)
-	assert.IsType(t, ErrMsgNotFound{}, err)
+	decoded = &Msg{}
+	assert.Nil(t, bson.Unmarshal(data, decoded))
+	assert.Nil(t, decoded.Properties)
 }
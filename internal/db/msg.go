@@ -2,46 +2,126 @@ package db
 
 import (
 	"fmt"
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 	"strconv"
-	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Msg will be used as both an input and an output structure to describe a message
 type Msg struct {
-	Id           string    `json:"id"           bson:"id"`
-	Content      string    `json:"content"      bson:"content"`
-	IsPalindrome bool      `json:"isPalindrome" bson:"isPalindrome"`
-	ModTime      time.Time `json:"modTime"      bson:"modTime"`
+	Id                string            `json:"id"                bson:"id"`
+	Content           string            `json:"content"           bson:"content"`
+	IsPalindrome      bool              `json:"isPalindrome"      bson:"isPalindrome"`
+	IsWordPalindrome  bool              `json:"isWordPalindrome"  bson:"isWordPalindrome"`  // see isWordPalindrome
+	PalindromeProfile PalindromeProfile `json:"palindromeProfile" bson:"palindromeProfile"` // see PalindromeProfile
+	LongestPalindrome PalindromeSpan    `json:"longestPalindrome" bson:"longestPalindrome"` // checked with the same profile
+	ModTime           time.Time         `json:"modTime"           bson:"modTime"`
+	Version           int64             `json:"version"           bson:"version"` // set by the db, increased by every update
+
+	// Properties are the results of the analyzers enabled when the msg was created or updated, by their name
+	// the results of the analyzers registered by default are also kept in the fields above (false or empty if their
+	// analyzer isn't enabled), which the dbs filter and sort by
+	Properties MsgProperties `json:"properties,omitempty" bson:"properties,omitempty"`
+	// DeletedAt is only set on the msgs in the trash, it's when they were deleted
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// ExpiresAt is optionally set on creation and kept by updates, past it the msg is gone (even from the trash)
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
 }
 
 func NewMsg(id, content string) *Msg {
+	return NewMsgWithProfile(id, content, DefaultPalindromeProfile)
+}
+
+// NewMsgWithProfile returns a new msg analyzed by the analyzers enabled, whose content is checked for being a
+// palindrome with the profile provided
+func NewMsgWithProfile(id, content string, profile PalindromeProfile) *Msg {
 	msg := &Msg{
-		Id:           id,
-		Content:      content,
-		IsPalindrome: isPalindrome(content),
-		ModTime:      time.Now(),
+		Id:                id,
+		Content:           content,
+		PalindromeProfile: profile,
+		ModTime:           time.Now(),
 	}
+	results := analyze(msg)
+	msg.Properties = newMsgProperties(results)
+	msg.IsPalindrome, _ = results[PalindromeAnalyzer].(bool)
+	msg.IsWordPalindrome, _ = results[WordPalindromeAnalyzer].(bool)
+	msg.LongestPalindrome, _ = results[LongestPalindromeAnalyzer].(PalindromeSpan)
 
 	return msg
 }
 
 func (m *Msg) String() string {
-	return fmt.Sprintf("Msg: { id: %s, content: %s, isPalindrome: %s, modTime: %s }",
-		m.Id, m.Content, strconv.FormatBool(m.IsPalindrome), m.ModTime.Format(time.RFC822Z))
+	return fmt.Sprintf("Msg: { id: %s, content: %s, isPalindrome: %s, palindromeProfile: %s, modTime: %s, version: %d }",
+		m.Id, m.Content, strconv.FormatBool(m.IsPalindrome), m.PalindromeProfile, m.ModTime.Format(time.RFC822Z), m.Version)
+}
+
+// expired returns true if the msg has an expiry that is not after now
+func (m *Msg) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
 }
 
 // isPalindrome returns true if the given string is a palindrome, false otherwise
-// it will ignore the case, but not the whitespaces or punctuations
-func isPalindrome(sequence string) bool {
-	seq := strings.ToLower(sequence)
-	isPalindrome := true
-	l := len(seq)
+// it compares user-perceived characters (grapheme clusters, e.g. an accented letter or an emoji with its modifiers),
+// so multi-byte characters are kept whole; what it ignores (e.g. the case) is up to the profile
+func isPalindrome(sequence string, profile PalindromeProfile) bool {
+	units := profile.units(sequence)
+	l := len(units)
+	for i := 0; i < l/2; i++ {
+		if units[i].key != units[l-1-i].key {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordPalindrome returns true if the words of sequence read the same backwards, e.g. "Fall leaves after leaves fall"
+// words are split on the unicode word boundaries and compared ignoring the case, whitespaces and punctuations between
+// them are ignored
+func isWordPalindrome(sequence string) bool {
+	w := words(sequence)
+	l := len(w)
 	for i := 0; i < l/2; i++ {
-		if seq[i] != seq[l-1-i] {
-			isPalindrome = false
-			break
+		if w[i] != w[l-1-i] {
+			return false
 		}
 	}
-	return isPalindrome
+	return true
+}
+
+// words returns the words of s case folded, the segments between its word boundaries that start with a letter or a
+// digit (so not the whitespaces or punctuations)
+func words(s string) []string {
+	var w []string
+	state := -1
+	for s != "" {
+		var word string
+		word, s, state = uniseg.FirstWordInString(s, state)
+		r, _ := utf8.DecodeRuneInString(word)
+		if isAlphanumeric(r) {
+			w = append(w, foldCase(word))
+		}
+	}
+	return w
+}
+
+// foldCase returns s case folded (e.g. "ß" becomes "ss", and "ς" "σ") in NFC, so that the characters that only
+// differ in case or in the composition of their code points compare equal
+func foldCase(s string) string {
+	// casers hold state, they can't be shared among goroutines
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(s)))
+}
+
+// graphemeClusters splits s into its grapheme clusters
+func graphemeClusters(s string) []string {
+	var clusters []string
+	state := -1
+	for s != "" {
+		var cluster string
+		cluster, s, _, state = uniseg.FirstGraphemeClusterInString(s, state)
+		clusters = append(clusters, cluster)
+	}
+	return clusters
 }
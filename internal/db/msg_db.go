@@ -1,25 +1,124 @@
 package db
 
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultOpTimeout is the default time a single database operation may take before being canceled
+	DefaultOpTimeout = 5 * time.Second
+	// initialVersion is the version of a msg when created
+	initialVersion int64 = 1
+	// anyVersion is used internally by the dbs to update or delete a msg regardless of its version
+	anyVersion int64 = -1
+	// iterBatchSize is the number of messages the dbs that iterate in batches read at once
+	iterBatchSize = 500
+)
+
 // MsgDB exposes the functionality to create, delete, update and retrieve a message
+// every operation is canceled when the ctx provided is done, e.g. when the client of a request disconnects
+// msgs past their ExpiresAt behave as if they didn't exist (ErrMsgNotFound), whether they were purged yet or not
 type MsgDB interface {
 	// GetMsg returns the msg  if available,
 	// returns ErrMsgNotFound if a msg with such id wasn't found
-	GetMsg(id string) (*Msg, error)
+	GetMsg(ctx context.Context, id string) (*Msg, error)
 
 	// GetAllMsgs will return all the messages in the DB, an empty slice if none
-	GetAllMsgs() ([]*Msg, error)
+	GetAllMsgs(ctx context.Context) ([]*Msg, error)
+
+	// ForEachMsg calls fn with every message in the DB, one at a time, so they don't all have to be held in memory
+	// messages are visited in no particular order, iteration stops at the first error fn returns, which is returned
+	// it isn't bound by the operation timeout of the DB, since it can take as long as fn takes; only by ctx
+	ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error
+
+	// ListMsgs returns a page of at most opts.Limit of the messages selected by opts.Filter, sorted by opts.SortBy
+	// (mod time by default) and then by id. The page starts right after opts.Cursor, its NextCursor can be used to
+	// get the following page
+	// returns ErrInvalidLimit, ErrInvalidSort or ErrInvalidCursor if opts are not valid
+	ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error)
+
+	// SearchMsgs returns up to limit msgs whose content has every word and phrase (words in double quotes) of query,
+	// most relevant first; words are matched whole, ignoring the case
+	// returns ErrInvalidSearchQuery if query has no words, ErrInvalidLimit if limit is not positive
+	SearchMsgs(ctx context.Context, query string, limit int) ([]*SearchResult, error)
 
-	// CreateMsg will add the msg provided into the database
+	// GetRevisions returns the revisions of the msg with the id provided, oldest first
+	// returns ErrMsgNotFound if a msg with such id wasn't found
+	GetRevisions(ctx context.Context, id string) ([]*Revision, error)
+
+	// GetRevision returns the revision of the msg with the id provided at the version provided
+	// returns ErrMsgNotFound if a msg with such id wasn't found, ErrRevisionNotFound if it has no such revision
+	GetRevision(ctx context.Context, id string, version int64) (*Revision, error)
+
+	// CreateMsg will add the msg provided into the database, msg.Version is set to the initial version
+	// it records the first revision of the msg, UpdateMsg and UpdateMsgIfVersion record the following ones
+	// msg.ExpiresAt, if set, is kept by the updates; the id of an expired msg can be reused right away
 	// returns ErrIdUnavailable if the msg.Id is already in use
-	CreateMsg(msg *Msg) error
+	CreateMsg(ctx context.Context, msg *Msg) error
 
-	// UpdateMsg will update the msg stored with the provided msg.Id
+	// UpdateMsg will update the msg stored with the provided msg.Id, whatever its version
+	// the version stored is increased, msg.Version is set to it
 	// returns ErrMsgNotFound if a msg with such id wasn't found
-	UpdateMsg(msg *Msg) error
+	UpdateMsg(ctx context.Context, msg *Msg) error
 
-	// DeleteMsg will delete the message associated with the id provided
+	// UpdateMsgIfVersion works like UpdateMsg, but only if the version stored is still the version provided
+	// returns ErrVersionConflict otherwise, in which case nothing is updated
+	UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error
+
+	// DeleteMsg will move the message associated with the id provided to the trash, setting its DeletedAt
+	// trashed msgs are hidden from every other method, until they are restored by RestoreMsg or purged by PurgeTrash
+	// (along with their revisions). Creating a msg with the id of a trashed one purges the trashed one
 	// returns ErrMsgNotFound if a msg with such id wasn't found
-	DeleteMsg(id string) error
+	DeleteMsg(ctx context.Context, id string) error
+
+	// DeleteMsgIfVersion works like DeleteMsg, but only if the version stored is still the version provided
+	// returns ErrVersionConflict otherwise, in which case nothing is deleted
+	DeleteMsgIfVersion(ctx context.Context, id string, version int64) error
+
+	// ApplyBatch applies the ops provided in order, and returns the result of each: nil if it succeeded, otherwise the
+	// error the single operation methods return (or ErrInvalidBatchOp). The error returned is about the batch as a
+	// whole, e.g. a transaction that couldn't be committed, in which case the results are nil
+	// unless atomic, every op is applied whether the previous ones failed or not; when atomic, either every op is
+	// applied or none is: if an op fails, its result is its error and the result of every other op is ErrBatchAborted
+	ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error)
+
+	// Watch returns a channel with the events of the msgs created, updated and deleted from now on or, if after isn't
+	// empty, right after the event with that id. The channel is closed once ctx is done, or if the watch fails or
+	// falls behind; watching again after the last event received resumes it without missing any
+	// returns ErrEventNotFound if the events that followed after are not available (anymore)
+	Watch(ctx context.Context, after string) (<-chan *MsgEvent, error)
+
+	// GetTrashedMsgs returns all the msgs in the trash, an empty slice if none
+	GetTrashedMsgs(ctx context.Context) ([]*Msg, error)
+
+	// RestoreMsg moves the msg with the id provided out of the trash, as it was when deleted
+	// returns ErrMsgNotFound if a msg with such id wasn't found in the trash
+	RestoreMsg(ctx context.Context, id string) error
+
+	// PurgeTrash permanently deletes the msgs that were moved to the trash before the time provided, along with
+	// their revisions, and returns how many were purged
+	PurgeTrash(ctx context.Context, before time.Time) (int, error)
+
+	// PurgeExpired permanently deletes the expired msgs, in the trash or not, along with their revisions, and returns
+	// how many were purged; expired msgs are already hidden, purging them only frees their space
+	PurgeExpired(ctx context.Context) (int, error)
 
 	Close()
 }
+
+// opContext returns ctx bounded by timeout, a timeout of 0 leaves ctx unbounded
+func opContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// checkVersion returns ErrVersionConflict if the stored version isn't the one expected (unless anyVersion is)
+func checkVersion(stored, expected int64) error {
+	if expected != anyVersion && stored != expected {
+		return ErrVersionConflict{}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestOpContext(t *testing.T) {
+	ctx, cancel := opContext(context.Background(), time.Millisecond)
+	defer cancel()
+	_, hasDeadline := ctx.Deadline()
+	assert.True(t, hasDeadline)
+	<-ctx.Done()
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+
+	// no timeout, only bounded by the parent
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel = opContext(parent, 0)
+	defer cancel()
+	_, hasDeadline = ctx.Deadline()
+	assert.False(t, hasDeadline)
+	cancelParent()
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
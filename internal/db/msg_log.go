@@ -0,0 +1,288 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.jsonl"
+
+	walOpCreate  = "create"
+	walOpPut     = "put"
+	walOpTrash   = "trash"
+	walOpRestore = "restore"
+	walOpDelete  = "delete"
+)
+
+// walRecord is a single change written to the log, one json object per line
+// changes are stored as the resulting state (put the whole msg, delete the id), which makes replaying them idempotent
+// create, put, trash and restore carry the resulting msg, delete purges the id for good
+type walRecord struct {
+	Op  string `json:"op"`
+	Id  string `json:"id"`
+	Msg *Msg   `json:"msg,omitempty"`
+}
+
+// msgState is the state of a BasicMsgDB that msgLog persists: the msgs, the trashed ones and their revisions
+type msgState struct {
+	msgs      map[string]*Msg
+	trash     map[string]*Msg
+	revisions map[string][]*Revision
+}
+
+func newMsgState() *msgState {
+	return &msgState{
+		msgs:      make(map[string]*Msg),
+		trash:     make(map[string]*Msg),
+		revisions: make(map[string][]*Revision),
+	}
+}
+
+// apply changes the state as rec describes
+func (s *msgState) apply(rec walRecord) {
+	switch {
+	case rec.Op == walOpCreate && rec.Msg != nil:
+		s.create(rec.Msg)
+	case rec.Op == walOpPut && rec.Msg != nil:
+		s.put(rec.Msg)
+	case rec.Op == walOpTrash && rec.Msg != nil:
+		delete(s.msgs, rec.Id)
+		s.trash[rec.Id] = rec.Msg
+	case rec.Op == walOpRestore && rec.Msg != nil:
+		delete(s.trash, rec.Id)
+		s.msgs[rec.Id] = rec.Msg
+	case rec.Op == walOpDelete:
+		s.delete(rec.Id)
+	}
+}
+
+// create stores msg as the first version of its id, replacing whatever was stored with it (e.g. a trashed msg)
+func (s *msgState) create(msg *Msg) {
+	s.delete(msg.Id)
+	s.msgs[msg.Id] = msg
+	s.revisions[msg.Id] = []*Revision{newRevision(msg)}
+}
+
+// put stores msg and records its revision, unless it's already recorded (e.g. a record replayed on top of the
+// snapshot that already includes it)
+func (s *msgState) put(msg *Msg) {
+	s.msgs[msg.Id] = msg
+	revisions := s.revisions[msg.Id]
+	if n := len(revisions); n == 0 || revisions[n-1].Version < msg.Version {
+		s.revisions[msg.Id] = append(revisions, newRevision(msg))
+	}
+}
+
+func (s *msgState) delete(id string) {
+	delete(s.msgs, id)
+	delete(s.trash, id)
+	delete(s.revisions, id)
+}
+
+// snapshotRecord is a line of the snapshot: a msg (in the trash if its DeletedAt is set) along with its revisions
+// snapshots taken before revisions were introduced only hold the msg, which is still decoded as is
+type snapshotRecord struct {
+	*Msg
+	Revisions []*Revision `json:"revisions,omitempty"`
+}
+
+// msgLog makes BasicMsgDB durable: every change is appended to a fsync'd write ahead log, and the log is
+// periodically compacted into a snapshot of all the messages
+// the state is recovered by loading the snapshot and replaying the log on top of it
+type msgLog struct {
+	dir  string
+	wal  *os.File
+	size int64 // size of the valid records in wal
+}
+
+// openMsgLog recovers the messages stored in dir (created if needed) and opens its log for appending
+// a partially written last record (e.g. the process crashed mid write) is discarded
+func openMsgLog(dir string) (*msgLog, *msgState, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := newMsgState()
+	err = loadSnapshot(filepath.Join(dir, snapshotFileName), state)
+	if err != nil {
+		log.Error("Failed to load snapshot: ", err.Error())
+		return nil, nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := replayWal(wal, state)
+	if err != nil {
+		log.Error("Failed to replay write ahead log: ", err.Error())
+		_ = wal.Close()
+		return nil, nil, err
+	}
+
+	log.Infof("Recovered %d messages from %s", len(state.msgs), dir)
+	return &msgLog{dir: dir, wal: wal, size: size}, state, nil
+}
+
+// append writes rec at the end of the log, it only returns once the record is on disk
+// if it fails, the log is rolled back to its previous size so a partial record never precedes the next ones
+func (l *msgLog) append(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = l.wal.Write(append(data, '\n'))
+	if err == nil {
+		err = l.wal.Sync()
+	}
+	if err != nil {
+		_ = l.wal.Truncate(l.size)
+		_, _ = l.wal.Seek(l.size, io.SeekStart)
+		return err
+	}
+
+	l.size += int64(len(data)) + 1
+	return nil
+}
+
+// snapshot atomically replaces the snapshot with state and empties the log
+// the caller must make sure no record is appended while the snapshot is taken
+func (l *msgLog) snapshot(state *msgState) error {
+	path := filepath.Join(l.dir, snapshotFileName)
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, msgs := range []map[string]*Msg{state.msgs, state.trash} {
+		for id, msg := range msgs {
+			err = enc.Encode(snapshotRecord{Msg: msg, Revisions: state.revisions[id]})
+			if err != nil {
+				_ = f.Close()
+				return err
+			}
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	err = syncDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	// the snapshot is safely stored, the records in the log are no longer needed
+	// if we crash before this point, replaying them on top of the new snapshot is harmless
+	err = l.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.wal.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	l.size = 0
+	return l.wal.Sync()
+}
+
+func (l *msgLog) close() error {
+	return l.wal.Close()
+}
+
+func loadSnapshot(path string, state *msgState) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		rec := snapshotRecord{Msg: &Msg{}}
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.DeletedAt != nil {
+			state.trash[rec.Id] = rec.Msg
+		} else {
+			state.msgs[rec.Id] = rec.Msg
+		}
+		if len(rec.Revisions) > 0 {
+			state.revisions[rec.Id] = rec.Revisions
+		}
+	}
+}
+
+// replayWal applies the records of wal to state and leaves wal positioned at the end of its last valid record
+// returns the size of the valid records
+func replayWal(wal *os.File, state *msgState) (int64, error) {
+	r := bufio.NewReader(wal)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warn("Discarding incomplete record at the end of the write ahead log")
+			}
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var rec walRecord
+		if json.Unmarshal(line, &rec) != nil {
+			log.Warn("Discarding corrupted write ahead log from offset ", offset)
+			break
+		}
+		state.apply(rec)
+		offset += int64(len(line))
+	}
+
+	// drop whatever follows the last valid record, so new records are appended right after it
+	err := wal.Truncate(offset)
+	if err != nil {
+		return 0, err
+	}
+	_, err = wal.Seek(offset, io.SeekStart)
+	return offset, err
+}
+
+// syncDir makes sure a rename within dir is persisted
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
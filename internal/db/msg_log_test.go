@@ -0,0 +1,145 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenMsgLog_Empty(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+
+	assert.Equal(t, 0, len(state.msgs))
+	_, err = os.Stat(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+}
+
+func TestMsgLog_AppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, _, err := openMsgLog(dir)
+	assert.Nil(t, err)
+
+	msg := NewMsg("unicorn", "kayak")
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: msg.Id, Msg: msg}))
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: "potato", Msg: NewMsg("potato", "papa")}))
+	assert.Nil(t, l.append(walRecord{Op: walOpDelete, Id: "potato"}))
+	assert.Nil(t, l.close())
+
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+
+	assert.Equal(t, 1, len(state.msgs))
+	assert.Equal(t, msg.Content, state.msgs["unicorn"].Content)
+	assert.True(t, msg.ModTime.Equal(state.msgs["unicorn"].ModTime))
+}
+
+func TestMsgLog_TornRecord(t *testing.T) {
+	// a record cut in half by a crash must be discarded, and the next records must be appended after the valid ones
+	dir := t.TempDir()
+	l, _, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: "unicorn", Msg: NewMsg("unicorn", "kayak")}))
+	_, err = l.wal.WriteString(`{"op":"put","id":"pota`)
+	assert.Nil(t, err)
+	assert.Nil(t, l.close())
+
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(state.msgs))
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: "banana", Msg: NewMsg("banana", "anana")}))
+	assert.Nil(t, l.close())
+
+	l, state, err = openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+	assert.Equal(t, 2, len(state.msgs))
+	assert.NotNil(t, state.msgs["unicorn"])
+	assert.NotNil(t, state.msgs["banana"])
+}
+
+func TestMsgLog_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _, err := openMsgLog(dir)
+	assert.Nil(t, err)
+
+	msg1 := NewMsg("unicorn", "kayak")
+	msg2 := NewMsg("banana", "anana")
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: msg1.Id, Msg: msg1}))
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: msg2.Id, Msg: msg2}))
+	snapshot := newMsgState()
+	snapshot.put(msg1)
+	snapshot.put(msg2)
+	assert.Nil(t, l.snapshot(snapshot))
+
+	// the log must have been compacted into the snapshot
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, info.Size())
+
+	assert.Nil(t, l.append(walRecord{Op: walOpDelete, Id: msg1.Id}))
+	assert.Nil(t, l.close())
+
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+	assert.Equal(t, 1, len(state.msgs))
+	assert.Equal(t, msg2.Content, state.msgs["banana"].Content)
+}
+
+func TestMsgLog_Revisions(t *testing.T) {
+	// revisions must be recovered from both the snapshot and the log, without duplicates
+	dir := t.TempDir()
+	l, _, err := openMsgLog(dir)
+	assert.Nil(t, err)
+
+	msg := NewMsg("unicorn", "kayak")
+	msg.Version = 1
+	update := NewMsg("unicorn", "canoe")
+	update.Version = 2
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: msg.Id, Msg: msg}))
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: update.Id, Msg: update}))
+
+	snapshot := newMsgState()
+	snapshot.put(msg)
+	snapshot.put(update)
+	assert.Nil(t, l.snapshot(snapshot))
+
+	// a record already included in the snapshot, as if the log wasn't emptied before a crash
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: update.Id, Msg: update}))
+	last := NewMsg("unicorn", "racecar")
+	last.Version = 3
+	assert.Nil(t, l.append(walRecord{Op: walOpPut, Id: last.Id, Msg: last}))
+	assert.Nil(t, l.close())
+
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+
+	revisions := state.revisions["unicorn"]
+	assert.Equal(t, 3, len(revisions))
+	for i, content := range []string{"kayak", "canoe", "racecar"} {
+		assert.Equal(t, int64(i+1), revisions[i].Version)
+		assert.Equal(t, content, revisions[i].Content)
+	}
+}
+
+func TestLoadSnapshot_WithoutRevisions(t *testing.T) {
+	// snapshots taken before revisions were introduced hold plain msgs
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, snapshotFileName),
+		[]byte(`{"id":"unicorn","content":"kayak","isPalindrome":true,"modTime":"2022-05-01T10:00:00Z"}`+"\n"), 0600)
+	assert.Nil(t, err)
+
+	l, state, err := openMsgLog(dir)
+	assert.Nil(t, err)
+	defer l.close()
+
+	assert.Equal(t, "kayak", state.msgs["unicorn"].Content)
+	assert.True(t, state.msgs["unicorn"].IsPalindrome)
+	assert.Equal(t, 0, len(state.revisions["unicorn"]))
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SortField is a field the messages can be listed by
+type SortField string
+
+const (
+	SortByModTime           SortField = "modTime"
+	SortById                SortField = "id"
+	SortByContentLength     SortField = "contentLength"
+	SortByLongestPalindrome SortField = "longestPalindromeLength"
+)
+
+// ListOptions selects the page of messages returned by MsgDB.ListMsgs
+type ListOptions struct {
+	// Limit is the max number of messages in the page, it must be positive
+	Limit int
+	// Cursor is the NextCursor of the previous page, empty to get the first page
+	// it can only be used with the same sort as the page it came from
+	Cursor string
+	// Filter selects the messages listed, the zero value selects them all
+	Filter MsgFilter
+	// SortBy is the field the messages are sorted by, and then by id; mod time if empty
+	SortBy SortField
+	// Desc sorts the messages in descending order, both by SortBy and by id
+	Desc bool
+}
+
+// MsgFilter selects the messages that meet every condition set, the conditions left unset are ignored
+type MsgFilter struct {
+	IsPalindrome   *bool
+	ModifiedSince  *time.Time // inclusive
+	ModifiedBefore *time.Time // exclusive
+	IdPrefix       string
+	// MinLength and MaxLength bound the length of the content in characters (unicode code points), both inclusive
+	MinLength *int
+	MaxLength *int
+	// MinPalindromeLength and MaxPalindromeLength bound the length of the longest palindrome, both inclusive
+	MinPalindromeLength *int
+	MaxPalindromeLength *int
+}
+
+// isEmpty returns true if f selects every message
+func (f MsgFilter) isEmpty() bool {
+	return f == MsgFilter{}
+}
+
+// Matches returns true if msg meets every condition of f
+func (f MsgFilter) Matches(msg *Msg) bool {
+	if f.IsPalindrome != nil && msg.IsPalindrome != *f.IsPalindrome {
+		return false
+	}
+	if f.ModifiedSince != nil && msg.ModTime.Before(*f.ModifiedSince) {
+		return false
+	}
+	if f.ModifiedBefore != nil && !msg.ModTime.Before(*f.ModifiedBefore) {
+		return false
+	}
+	if !strings.HasPrefix(msg.Id, f.IdPrefix) {
+		return false
+	}
+	length := contentLength(msg.Content)
+	if f.MinLength != nil && length < *f.MinLength {
+		return false
+	}
+	if f.MaxLength != nil && length > *f.MaxLength {
+		return false
+	}
+	if f.MinPalindromeLength != nil && msg.LongestPalindrome.Length < *f.MinPalindromeLength {
+		return false
+	}
+	if f.MaxPalindromeLength != nil && msg.LongestPalindrome.Length > *f.MaxPalindromeLength {
+		return false
+	}
+	return true
+}
+
+// contentLength is the length of content in characters, as filtered and sorted by
+func contentLength(content string) int {
+	return utf8.RuneCountInString(content)
+}
+
+// sortField returns the field opts sort by, mod time by default
+func (opts ListOptions) sortField() SortField {
+	if opts.SortBy == "" {
+		return SortByModTime
+	}
+	return opts.SortBy
+}
+
+// isDefault returns true if opts list every message by mod time ascending, the order the dbs index natively
+func (opts ListOptions) isDefault() bool {
+	return opts.Filter.isEmpty() && opts.sortField() == SortByModTime && !opts.Desc
+}
+
+// compare returns a negative number if the msg with key a sorts before the one with key b in the order of opts, a
+// positive one if it sorts after, 0 if they're the same msg; keys are built by newPageCursor
+func (opts ListOptions) compare(a, b pageCursor) int {
+	c := 0
+	switch opts.sortField() {
+	case SortByModTime:
+		c = compareInt64(a.ModTime, b.ModTime)
+	case SortByContentLength:
+		c = compareInt64(int64(a.Length), int64(b.Length))
+	case SortByLongestPalindrome:
+		c = compareInt64(int64(a.PalindromeLength), int64(b.PalindromeLength))
+	}
+	if c == 0 {
+		c = strings.Compare(a.Id, b.Id)
+	}
+	if opts.Desc {
+		return -c
+	}
+	return c
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// MsgPage is a page of messages, sorted as requested by ListOptions
+type MsgPage struct {
+	Msgs []*Msg
+	// NextCursor points to the following page, it is empty if this is the last one
+	NextCursor string
+}
+
+// pageCursor is the position after which the next page starts, it is handed out base64 encoded so clients treat it
+// as opaque. It holds the values of the msg it points to for every sort field, along with the sort it was built for
+type pageCursor struct {
+	ModTime          int64     `json:"t"` // unix nanoseconds
+	Id               string    `json:"id"`
+	Length           int       `json:"n,omitempty"`
+	PalindromeLength int       `json:"p,omitempty"` // of the longest palindrome
+	SortBy           SortField `json:"s,omitempty"` // empty in the cursors built before sorting was configurable
+	Desc             bool      `json:"d,omitempty"`
+}
+
+// newPageCursor returns the cursor pointing to msg in the order of opts, it's also the sort key of msg
+func newPageCursor(msg *Msg, opts ListOptions) pageCursor {
+	return pageCursor{
+		ModTime:          msg.ModTime.UnixNano(),
+		Id:               msg.Id,
+		Length:           contentLength(msg.Content),
+		PalindromeLength: msg.LongestPalindrome.Length,
+		SortBy:           opts.sortField(),
+		Desc:             opts.Desc,
+	}
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageCursor returns the cursor encoded in s, a nil cursor if s is empty (first page)
+// returns ErrInvalidCursor if s wasn't produced by pageCursor.encode
+func decodePageCursor(s string) (*pageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor{}
+	}
+	c := &pageCursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.Id == "" {
+		return nil, ErrInvalidCursor{}
+	}
+
+	return c, nil
+}
+
+func (c pageCursor) modTime() time.Time {
+	return time.Unix(0, c.ModTime)
+}
+
+// sortField returns the field c was built for, mod time for the cursors that predate the others
+func (c pageCursor) sortField() SortField {
+	if c.SortBy == "" {
+		return SortByModTime
+	}
+	return c.SortBy
+}
+
+// validateListOptions checks opts and decodes its cursor
+// returns ErrInvalidCursor if the cursor was built for another sort than the one of opts
+func validateListOptions(opts ListOptions) (*pageCursor, error) {
+	if opts.Limit <= 0 {
+		return nil, ErrInvalidLimit{}
+	}
+	switch opts.sortField() {
+	case SortByModTime, SortById, SortByContentLength, SortByLongestPalindrome:
+	default:
+		return nil, ErrInvalidSort{}
+	}
+
+	cursor, err := decodePageCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil && (cursor.sortField() != opts.sortField() || cursor.Desc != opts.Desc) {
+		return nil, ErrInvalidCursor{}
+	}
+	return cursor, nil
+}
+
+// sortMsgs sorts msgs in the order of opts, the order in which they are paginated
+func sortMsgs(msgs []*Msg, opts ListOptions) {
+	sort.Slice(msgs, func(i, j int) bool {
+		return opts.compare(newPageCursor(msgs[i], opts), newPageCursor(msgs[j], opts)) < 0
+	})
+}
+
+// paginateMsgs returns the page of msgs selected by opts, it is used by the dbs that can't filter or paginate natively
+func paginateMsgs(msgs []*Msg, opts ListOptions) (*MsgPage, error) {
+	cursor, err := validateListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []*Msg{}
+	for _, msg := range msgs {
+		if opts.Filter.Matches(msg) {
+			selected = append(selected, msg)
+		}
+	}
+	sortMsgs(selected, opts)
+	start := 0
+	if cursor != nil {
+		// the first msg after the cursor, i.e. the first one that wasn't part of a previous page
+		start = sort.Search(len(selected), func(i int) bool {
+			return opts.compare(newPageCursor(selected[i], opts), *cursor) > 0
+		})
+	}
+
+	return newMsgPage(selected[start:], opts), nil
+}
+
+// newMsgPage builds a page out of the (sorted) msgs that follow the cursor, up to opts.Limit of them are kept
+// a next cursor is only set if more messages than limit were provided, so the last page is never followed by an empty one
+func newMsgPage(msgs []*Msg, opts ListOptions) *MsgPage {
+	limit := opts.Limit
+	page := &MsgPage{Msgs: []*Msg{}}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		page.NextCursor = newPageCursor(msgs[limit-1], opts).encode()
+	}
+	page.Msgs = append(page.Msgs, msgs...)
+
+	return page
+}
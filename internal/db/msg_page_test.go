@@ -0,0 +1,99 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPageCursor_EncodeDecode(t *testing.T) {
+	msg := NewMsg("unicorn", "kayak")
+	cursor := newPageCursor(msg, ListOptions{})
+
+	decoded, err := decodePageCursor(cursor.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, cursor, *decoded)
+	assert.True(t, msg.ModTime.Equal(decoded.modTime()))
+
+	// first page
+	decoded, err = decodePageCursor("")
+	assert.Nil(t, err)
+	assert.Nil(t, decoded)
+}
+
+func TestDecodePageCursor_Invalid(t *testing.T) {
+	for _, cursor := range []string{"potato", "!!!", "e30", "bnVsbA"} {
+		_, err := decodePageCursor(cursor)
+		assert.IsType(t, ErrInvalidCursor{}, err, cursor)
+	}
+}
+
+func TestPaginateMsgs(t *testing.T) {
+	msgs := newTestPageMsgs()
+	// the input order must not matter
+	shuffled := []*Msg{msgs[3], msgs[0], msgs[4], msgs[2], msgs[1]}
+
+	page, err := paginateMsgs(shuffled, ListOptions{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, msgs[:2], page.Msgs)
+	assert.NotEmpty(t, page.NextCursor)
+
+	page, err = paginateMsgs(shuffled, ListOptions{Limit: 2, Cursor: page.NextCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, msgs[2:4], page.Msgs)
+	assert.NotEmpty(t, page.NextCursor)
+
+	page, err = paginateMsgs(shuffled, ListOptions{Limit: 2, Cursor: page.NextCursor})
+	assert.Nil(t, err)
+	assert.Equal(t, msgs[4:], page.Msgs)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestPaginateMsgs_Empty(t *testing.T) {
+	page, err := paginateMsgs(nil, ListOptions{Limit: 10})
+	assert.Nil(t, err)
+	assert.NotNil(t, page.Msgs)
+	assert.Equal(t, 0, len(page.Msgs))
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestPaginateMsgs_InvalidOptions(t *testing.T) {
+	_, err := paginateMsgs(newTestPageMsgs(), ListOptions{Limit: 0})
+	assert.IsType(t, ErrInvalidLimit{}, err)
+
+	_, err = paginateMsgs(newTestPageMsgs(), ListOptions{Limit: 1, Cursor: "potato"})
+	assert.IsType(t, ErrInvalidCursor{}, err)
+}
+
+// newTestPageMsgs returns msgs in their pagination order, two of them share the same mod time so they're sorted by id
+// mod times are millisecond aligned, the coarsest precision a db stores
+func newTestPageMsgs() []*Msg {
+	t0 := time.Now().Truncate(time.Millisecond)
+	msgs := []*Msg{
+		NewMsg("zebra", "first"),
+		NewMsg("bear", "second"),
+		NewMsg("cat", "third"),
+		NewMsg("ant", "fourth"),
+		NewMsg("dog", "fifth"),
+	}
+	msgs[0].ModTime = t0
+	msgs[1].ModTime = t0.Add(time.Millisecond)
+	msgs[2].ModTime = t0.Add(time.Millisecond)
+	msgs[3].ModTime = t0.Add(2 * time.Millisecond)
+	msgs[4].ModTime = t0.Add(3 * time.Millisecond)
+	return msgs
+}
+
+func TestValidateListOptions_Sort(t *testing.T) {
+	// the cursors built before sorting was configurable carry no sort, they're mod time ones
+	legacy := pageCursor{ModTime: time.Now().UnixNano(), Id: "unicorn"}.encode()
+	cursor, err := validateListOptions(ListOptions{Limit: 1, Cursor: legacy})
+	assert.Nil(t, err)
+	assert.Equal(t, "unicorn", cursor.Id)
+
+	_, err = validateListOptions(ListOptions{Limit: 1, Cursor: legacy, SortBy: SortById})
+	assert.IsType(t, ErrInvalidCursor{}, err)
+
+	_, err = validateListOptions(ListOptions{Limit: 1, SortBy: "potato"})
+	assert.IsType(t, ErrInvalidSort{}, err)
+}
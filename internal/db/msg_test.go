@@ -14,6 +14,9 @@ func TestNewMsg(t *testing.T) {
 	assert.Equal(t, "unicorn", msg.Id)
 	assert.Equal(t, "a message", msg.Content)
 	assert.False(t, msg.IsPalindrome)
+	assert.False(t, msg.IsWordPalindrome)
+	assert.Equal(t, DefaultPalindromeProfile, msg.PalindromeProfile)
+	assert.Equal(t, PalindromeSpan{Text: "ss", Offset: 4, Length: 2}, msg.LongestPalindrome)
 	assert.True(t, msg.ModTime.After(t0))
 }
 
@@ -70,7 +73,177 @@ func TestIsPalindrome(t *testing.T) {
 
 	for i, test := range testDetails {
 		t.Run("test#"+strconv.Itoa(i), func(t *testing.T) {
-			assert.Equal(t, test.isPalindrome, isPalindrome(test.msg))
+			assert.Equal(t, test.isPalindrome, isPalindrome(test.msg, ProfileCaseInsensitive))
 		})
 	}
 }
+
+func TestIsPalindrome_Unicode(t *testing.T) {
+	tests := []struct {
+		name         string
+		msg          string
+		isPalindrome bool
+	}{
+		// accented latin
+		{"Latin_Tilde", "añña", true},
+		{"Latin_Acute", "été", true},
+		{"Latin_Case", "ÉtÉ", true},
+		{"Latin_Mismatch", "étè", false},
+		{"Latin_Decomposed", "e\u0301te\u0301", true},
+		{"Latin_MixedComposition", "\u00e9te\u0301", true},
+		{"Latin_FoldSharpS", "ßSS", true},
+		{"Greek_FinalSigma", "σας", true},
+		{"Cyrillic", "Топот", true},
+		// cjk
+		{"CJK", "上海自来水来自海上", true},
+		{"CJK_Mismatch", "日本", false},
+		{"Hiragana", "たけやぶやけた", true},
+		{"Hangul", "기러기", true},
+		// combining marks stay on their base letter
+		{"Combining", "a\u0301ba\u0301", true},
+		{"Combining_Moved", "a\u0301b\u0301a", false},
+		{"Combining_Stacked", "o\u0302\u0323xo\u0323\u0302", true},
+		{"Devanagari", "नमन", true},
+		{"Devanagari_VowelSign", "कीक", false},
+		// emoji sequences
+		{"Emoji", "🙂x🙂", true},
+		{"Emoji_Mismatch", "🙂🙃", false},
+		{"Emoji_SkinTone", "👍🏽o👍🏽", true},
+		{"Emoji_SkinToneMismatch", "👍🏽👍🏻", false},
+		{"Emoji_ZWJ", "👨‍👩‍👧=👨‍👩‍👧", true},
+		{"Emoji_ZWJReversed", "👨‍👩‍👧👧‍👩‍👨", false},
+		{"Emoji_Flags", "🇫🇷🇫🇷", true},
+		// reversing the code points would make these palindromes
+		{"Emoji_FlagsReversed", "🇫🇷🇷🇫", false},
+		{"Emoji_Keycap", "1️⃣21️⃣", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.isPalindrome, isPalindrome(tt.msg, ProfileCaseInsensitive), tt.msg)
+		})
+	}
+}
+
+func TestIsPalindrome_Profiles(t *testing.T) {
+	tests := []struct {
+		msg string
+		// whether msg is a palindrome with each of PalindromeProfiles, in order
+		expected []bool
+	}{
+		{"kayak", []bool{true, true, true, true, true}},
+		{"Kayak", []bool{false, true, true, true, true}},
+		{"Step on no pets", []bool{false, true, true, true, true}},
+		{"stepOnNoPets", []bool{false, true, true, true, true}},
+		{"step on no pets!", []bool{false, false, true, true, true}},
+		{"A man, a plan, a canal: Panama", []bool{false, false, true, true, true}},
+		{"Was it a car or a cat I saw?", []bool{false, false, true, true, true}},
+		{"1 kayak 2", []bool{false, false, true, false, false}},
+		{"No 'x' in 1881 Nixon", []bool{false, false, true, true, true}},
+		{"Ésope reste ici et se repose", []bool{false, false, false, false, true}},
+		{"été", []bool{true, true, true, true, true}},
+		{"Ete, été!", []bool{false, false, false, false, true}},
+		{"?!", []bool{false, false, true, true, true}},
+	}
+
+	for _, tt := range tests {
+		for i, profile := range PalindromeProfiles {
+			assert.Equal(t, tt.expected[i], isPalindrome(tt.msg, profile), "%s with %s", tt.msg, profile)
+		}
+	}
+}
+
+func TestIsWordPalindrome(t *testing.T) {
+	tests := []struct {
+		msg      string
+		expected bool
+	}{
+		{"", true},
+		{"kayak", true},
+		{"fall leaves after leaves fall", true},
+		{"Fall leaves, after leaves... FALL!", true},
+		{"  you can cage a swallow, can't you, but you can't swallow a cage, can you?", true},
+		{"king, are you glad you are king", true},
+		{"fall leaves after leaves", false},
+		{"kayak racecar", false},
+		{"kayak ka yak", false},
+		{"Straße über STRASSE", true},
+		{"le café et le CAFÉ", false},
+		{"café le et le café", true},
+		{"123 go 123", true},
+		{"東京 へ 東京", false}, // every ideograph is a word of its own
+		{"京 へ 京", true},
+		{"?!", true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isWordPalindrome(tt.msg), tt.msg)
+	}
+}
+
+func TestParsePalindromeProfile(t *testing.T) {
+	for _, profile := range PalindromeProfiles {
+		parsed, err := ParsePalindromeProfile(string(profile))
+		assert.Nil(t, err)
+		assert.Equal(t, profile, parsed)
+	}
+
+	for _, name := range []string{"", "potato", "Strict"} {
+		_, err := ParsePalindromeProfile(name)
+		assert.IsType(t, ErrInvalidProfile{}, err, name)
+	}
+}
+
+func TestLongestPalindrome(t *testing.T) {
+	tests := []struct {
+		msg      string
+		profile  PalindromeProfile
+		expected PalindromeSpan
+	}{
+		{"", ProfileCaseInsensitive, PalindromeSpan{}},
+		{"x", ProfileCaseInsensitive, PalindromeSpan{Text: "x", Offset: 0, Length: 1}},
+		{"abc", ProfileCaseInsensitive, PalindromeSpan{Text: "a", Offset: 0, Length: 1}},
+		{"kayak", ProfileCaseInsensitive, PalindromeSpan{Text: "kayak", Offset: 0, Length: 5}},
+		{"a noon b", ProfileCaseInsensitive, PalindromeSpan{Text: " noon ", Offset: 1, Length: 6}},
+		{"abba racecar", ProfileCaseInsensitive, PalindromeSpan{Text: "racecar", Offset: 5, Length: 7}},
+		{"abaxcdc", ProfileCaseInsensitive, PalindromeSpan{Text: "aba", Offset: 0, Length: 3}},
+		{"xRaCar", ProfileStrict, PalindromeSpan{Text: "aCa", Offset: 2, Length: 3}},
+		{"xRaCar", ProfileCaseInsensitive, PalindromeSpan{Text: "RaCar", Offset: 1, Length: 5}},
+		{"I said: Step on no pets!", ProfileLettersOnly, PalindromeSpan{Text: "Step on no pets", Offset: 8, Length: 15}},
+		{"ok: été!", ProfileCaseInsensitive, PalindromeSpan{Text: "été", Offset: 4, Length: 3}},
+		{"e\u0301te\u0301", ProfileStrict, PalindromeSpan{Text: "e\u0301te\u0301", Offset: 0, Length: 5}},
+		{"Ete, été", ProfileDiacriticInsensitive, PalindromeSpan{Text: "Ete, été", Offset: 0, Length: 8}},
+		{"🇮🇹 wow 🇮🇹", ProfileCaseInsensitive, PalindromeSpan{Text: "🇮🇹 wow 🇮🇹", Offset: 0, Length: 9}},
+		{"?!", ProfileAlphanumeric, PalindromeSpan{}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, longestPalindrome(tt.msg, tt.profile), "%s with %s", tt.msg, tt.profile)
+	}
+}
+
+// TestLongestPalindrome_AllStrings checks every string of up to 8 letters out of 3 against the palindromes found by
+// brute force
+func TestLongestPalindrome_AllStrings(t *testing.T) {
+	var check func(s string)
+	check = func(s string) {
+		bestStart, bestLength := 0, 0
+		for i := range s {
+			for j := len(s); j-i > bestLength; j-- {
+				if isPalindrome(s[i:j], ProfileStrict) {
+					bestStart, bestLength = i, j-i
+					break
+				}
+			}
+		}
+		expected := PalindromeSpan{Text: s[bestStart : bestStart+bestLength], Offset: bestStart, Length: bestLength}
+		assert.Equal(t, expected, longestPalindrome(s, ProfileStrict), s)
+
+		if len(s) < 8 {
+			for _, c := range []string{"a", "b", "c"} {
+				check(s + c)
+			}
+		}
+	}
+	check("")
+}
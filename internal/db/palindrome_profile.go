@@ -0,0 +1,111 @@
+package db
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PalindromeProfile is the normalization a content goes through before it's checked for being a palindrome
+// the msgs stored before profiles have none (an empty one), they were checked ignoring the case
+type PalindromeProfile string
+
+const (
+	// ProfileStrict compares the characters as they are, only their composition is normalized
+	ProfileStrict PalindromeProfile = "strict"
+	// ProfileCaseInsensitive ignores the case, but not the whitespaces or punctuations
+	ProfileCaseInsensitive PalindromeProfile = "case-insensitive"
+	// ProfileLettersOnly ignores the case and everything but the letters
+	ProfileLettersOnly PalindromeProfile = "letters-only"
+	// ProfileAlphanumeric ignores the case and everything but the letters and digits
+	ProfileAlphanumeric PalindromeProfile = "alphanumeric"
+	// ProfileDiacriticInsensitive is ProfileAlphanumeric that also ignores the diacritics, e.g. "é" is checked as "e"
+	ProfileDiacriticInsensitive PalindromeProfile = "diacritic-insensitive"
+
+	// DefaultPalindromeProfile is the profile of the msgs created with NewMsg
+	DefaultPalindromeProfile = ProfileCaseInsensitive
+)
+
+// PalindromeProfiles are all the profiles, from the strictest to the most lenient
+var PalindromeProfiles = []PalindromeProfile{
+	ProfileStrict,
+	ProfileCaseInsensitive,
+	ProfileLettersOnly,
+	ProfileAlphanumeric,
+	ProfileDiacriticInsensitive,
+}
+
+// ParsePalindromeProfile returns the profile named name
+// returns ErrInvalidProfile if there's none
+func ParsePalindromeProfile(name string) (PalindromeProfile, error) {
+	for _, profile := range PalindromeProfiles {
+		if string(profile) == name {
+			return profile, nil
+		}
+	}
+	return "", ErrInvalidProfile{}
+}
+
+// profileUnit is a character the profile compares: key is how it compares it, start and end are the bytes of the
+// grapheme cluster of the content it comes from
+type profileUnit struct {
+	key        string
+	start, end int
+}
+
+// units returns the characters of sequence that the profile compares, in order
+// a character of sequence can make up several units (e.g. "ß" is compared as "ss"), which all point back to it
+func (p PalindromeProfile) units(sequence string) []profileUnit {
+	var units []profileUnit
+	start := 0
+	for _, cluster := range graphemeClusters(sequence) {
+		end := start + len(cluster)
+		for _, key := range graphemeClusters(p.fold(cluster)) {
+			r, _ := utf8.DecodeRuneInString(key)
+			if p.keeps(r) {
+				units = append(units, profileUnit{key: key, start: start, end: end})
+			}
+		}
+		start = end
+	}
+	return units
+}
+
+// fold returns the grapheme cluster s as the profile compares it
+func (p PalindromeProfile) fold(s string) string {
+	switch p {
+	case ProfileStrict:
+		return norm.NFC.String(s)
+	case ProfileDiacriticInsensitive:
+		return removeDiacritics(foldCase(s))
+	default:
+		return foldCase(s)
+	}
+}
+
+// keeps returns true if the profile compares the grapheme clusters whose base character (their first one) is r
+func (p PalindromeProfile) keeps(r rune) bool {
+	switch p {
+	case ProfileLettersOnly:
+		return unicode.IsLetter(r)
+	case ProfileAlphanumeric, ProfileDiacriticInsensitive:
+		return isAlphanumeric(r)
+	default:
+		return true
+	}
+}
+
+func isAlphanumeric(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// removeDiacritics returns s without the nonspacing marks its characters decompose into, in NFC
+func removeDiacritics(s string) string {
+	return norm.NFC.String(strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFD.String(s)))
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"unicode/utf8"
+)
+
+// PalindromeSpan is a part of the content of a msg that is a palindrome
+// Offset and Length are in characters (unicode code points), like the length msgs are filtered and sorted by
+type PalindromeSpan struct {
+	Text   string `json:"text"   bson:"text"`
+	Offset int    `json:"offset" bson:"offset"`
+	Length int    `json:"length" bson:"length"`
+}
+
+// longestPalindrome returns the longest part of sequence that is a palindrome for the profile provided, the leftmost
+// one if there are several; it is empty if the profile compares none of the characters of sequence
+// the span starts and ends on characters the profile compares, those it ignores in between are part of it
+func longestPalindrome(sequence string, profile PalindromeProfile) PalindromeSpan {
+	units := profile.units(sequence)
+	if len(units) == 0 {
+		return PalindromeSpan{}
+	}
+
+	start, length := manacher(units)
+	first, last := units[start], units[start+length-1]
+	return PalindromeSpan{
+		Text:   sequence[first.start:last.end],
+		Offset: utf8.RuneCountInString(sequence[:first.start]),
+		Length: utf8.RuneCountInString(sequence[first.start:last.end]),
+	}
+}
+
+// manacher returns the start and the length (in units) of the leftmost longest palindrome among units, in linear time
+// it runs on the units interleaved with gaps (u0, u1 becomes _ u0 _ u1 _), so that the palindromes of even length
+// are centered on a gap like those of odd length are on a unit
+func manacher(units []profileUnit) (start, length int) {
+	n := 2*len(units) + 1
+	// radius[i] is the number of positions each side of i that mirror each other, which is also the length in
+	// units of the palindrome centered on i
+	radius := make([]int, n)
+	// center and right are the center and the right bound of the palindrome reaching the furthest right so far
+	center, right := 0, 0
+	best := 0
+	for i := 1; i < n; i++ {
+		if i < right {
+			radius[i] = radius[2*center-i]
+			if radius[i] > right-i {
+				radius[i] = right - i
+			}
+		}
+		for i-radius[i]-1 >= 0 && i+radius[i]+1 < n && mirrors(units, i-radius[i]-1, i+radius[i]+1) {
+			radius[i]++
+		}
+		if i+radius[i] > right {
+			center, right = i, i+radius[i]
+		}
+		if radius[i] > radius[best] {
+			best = i
+		}
+	}
+	return (best - radius[best]) / 2, radius[best]
+}
+
+// mirrors returns true if the positions a and b of the interleaved units match, gaps always do
+func mirrors(units []profileUnit, a, b int) bool {
+	if a%2 == 0 {
+		return true
+	}
+	return units[a/2].key == units[b/2].key
+}
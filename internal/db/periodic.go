@@ -0,0 +1,40 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// periodicTask runs a function every interval in the background, until stopped
+type periodicTask struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startPeriodicTask(interval time.Duration, fn func()) *periodicTask {
+	t := &periodicTask{stop: make(chan struct{})}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+
+	return t
+}
+
+// Stop stops the task and waits for an ongoing run to finish
+func (t *periodicTask) Stop() {
+	close(t.stop)
+	t.wg.Wait()
+}
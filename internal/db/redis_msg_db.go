@@ -0,0 +1,852 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultRedisKeyPrefix = "palermo:"
+	redisScanCount        = 100
+	redisMaxTxRetries     = 10
+)
+
+// RedisMsgDB stores each message in a redis hash ('<prefix>msg:<id>') and keeps the ids in a sorted set
+// ('<prefix>msgs:byModTime') scored by mod time, so several palermo instances can share the same store
+// writes run as optimistic (WATCH/MULTI) transactions so the hash and the sorted set never diverge
+// deleted msgs are renamed to '<prefix>trash:msg:<id>' and indexed in '<prefix>trash:byDeletedAt' until purged
+// msgs with an expiry are expired by redis itself (their revisions along), which leaves their ids in the indexes until
+// PurgeExpired removes them; reads skip them in the meantime
+type RedisMsgDB struct {
+	client    *redis.Client
+	keyPrefix string
+	opTimeout time.Duration // bounds every operation on top of the ctx it takes, 0 means no bound
+	// events are published once the changes are committed, the changes made by other processes are not seen
+	events msgBroadcaster
+}
+
+// NewRedisMsgDB returns a new redis msg db that will connect to the addr provided (in the format '<host>:<port>')
+// every key it uses starts with keyPrefix, which allows several deployments to share a redis instance
+// default value to use for keyPrefix is DefaultRedisKeyPrefix
+// opTimeout is the max time a single operation can take, default value to use is DefaultOpTimeout
+func NewRedisMsgDB(addr, keyPrefix string, opTimeout time.Duration) (*RedisMsgDB, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	// Check the connection
+	ctx, cancel := context.WithTimeout(context.Background(), defaultConnectTimeout)
+	defer cancel()
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		log.Errorf("Failed to ping redis at addr: %s; err: %s", addr, err.Error())
+		_ = client.Close()
+		return nil, err
+	}
+	log.Debug("Successfully connected to redis at: ", addr)
+
+	return &RedisMsgDB{client: client, keyPrefix: keyPrefix, opTimeout: opTimeout}, nil
+}
+
+func (r *RedisMsgDB) Close() {
+	r.events.close()
+	err := r.client.Close()
+	if err != nil {
+		log.Error("Failed to close redis client: ", err.Error())
+	}
+}
+
+func (r *RedisMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+	fields, err := r.client.HGetAll(ctx, r.msgKey(id)).Result()
+	if err != nil {
+		log.Error("Failed to find msg: ", err.Error())
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrMsgNotFound{}
+	}
+
+	return msgFromRedisHash(fields)
+}
+
+func (r *RedisMsgDB) GetAllMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+	iter := r.client.Scan(ctx, 0, r.msgKey("*"), redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		fields, err := r.client.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			log.Error("Failed to read msg: ", err.Error())
+			return msgs, err
+		}
+		if len(fields) == 0 {
+			// deleted after being scanned
+			continue
+		}
+		msg, err := msgFromRedisHash(fields)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := iter.Err(); err != nil {
+		log.Error("Failed to scan msgs: ", err.Error())
+		return msgs, err
+	}
+
+	return msgs, nil
+}
+
+// ForEachMsg scans the msg keys in batches of about redisScanCount, whose msgs are read at once
+// like any SCAN, a msg that is modified during the iteration may be visited more than once
+func (r *RedisMsgDB) ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error {
+	var cursor uint64
+	for {
+		scanCtx, cancel := opContext(ctx, r.opTimeout)
+		keys, next, err := r.client.Scan(scanCtx, cursor, r.msgKey("*"), redisScanCount).Result()
+		if err != nil {
+			cancel()
+			log.Error("Failed to scan msgs: ", err.Error())
+			return err
+		}
+		ids := make([]string, len(keys))
+		for i, key := range keys {
+			ids[i] = strings.TrimPrefix(key, r.msgKey(""))
+		}
+		batch, err := r.getMsgs(scanCtx, ids)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range batch {
+			err = fn(msg)
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// ListMsgs walks the mod time index, whose scores are in microseconds: msgs modified within the same microsecond are
+// sorted by id. The filtered or otherwise sorted listings are done in memory, since there is no index for them
+func (r *RedisMsgDB) ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error) {
+	cursor, err := validateListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.isDefault() {
+		msgs, err := r.GetAllMsgs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return paginateMsgs(msgs, opts)
+	}
+
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+
+	min := "-inf"
+	var cursorScore float64
+	if cursor != nil {
+		cursorScore = redisModTimeScore(cursor.modTime())
+		min = strconv.FormatFloat(cursorScore, 'f', -1, 64)
+	}
+
+	// one extra msg tells whether there's a next page
+	batchSize := int64(opts.Limit + 1)
+	var msgs []*Msg
+	for offset := int64(0); len(msgs) <= opts.Limit; offset += batchSize {
+		entries, err := r.client.ZRangeByScoreWithScores(ctx, r.byModTimeKey(),
+			&redis.ZRangeBy{Min: min, Max: "+inf", Offset: offset, Count: batchSize}).Result()
+		if err != nil {
+			log.Error("Failed to read mod time index: ", err.Error())
+			return nil, err
+		}
+
+		var ids []string
+		for _, z := range entries {
+			id := z.Member.(string)
+			if cursor != nil && z.Score == cursorScore && id <= cursor.Id {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		batch, err := r.getMsgs(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, batch...)
+
+		if int64(len(entries)) < batchSize {
+			break
+		}
+	}
+
+	if len(msgs) > opts.Limit+1 {
+		msgs = msgs[:opts.Limit+1]
+	}
+	return newMsgPage(msgs, opts), nil
+}
+
+// SearchMsgs checks every msg, there is no index to search with
+func (r *RedisMsgDB) SearchMsgs(ctx context.Context, query string, limit int) ([]*SearchResult, error) {
+	return searchAllMsgs(ctx, r, query, limit)
+}
+
+func (r *RedisMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	stored := *msg
+	stored.Version = initialVersion
+	key := r.msgKey(msg.Id)
+	err := r.watch(ctx, []string{key, r.trashKey(msg.Id)}, func(ctx context.Context, tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrIdUnavailable{}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return r.queueCreate(ctx, pipe, &stored)
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	r.events.publish(MsgCreated, &stored)
+	return nil
+}
+
+func (r *RedisMsgDB) UpdateMsg(ctx context.Context, msg *Msg) error {
+	return r.updateMsg(ctx, msg, anyVersion)
+}
+
+func (r *RedisMsgDB) UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error {
+	return r.updateMsg(ctx, msg, version)
+}
+
+func (r *RedisMsgDB) updateMsg(ctx context.Context, msg *Msg, version int64) error {
+	stored := *msg
+	key := r.msgKey(msg.Id)
+	err := r.watch(ctx, []string{key}, func(ctx context.Context, tx *redis.Tx) error {
+		current, err := r.checkStoredMsg(ctx, tx, key, version)
+		if err != nil {
+			return err
+		}
+
+		stored.Version = current.Version + 1
+		stored.ExpiresAt = nil // the hash keeps the one set on creation
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return r.putMsg(ctx, pipe, &stored)
+		})
+		stored.ExpiresAt = current.ExpiresAt
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	r.events.publish(MsgUpdated, &stored)
+	return nil
+}
+
+func (r *RedisMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	return r.deleteMsg(ctx, id, anyVersion)
+}
+
+func (r *RedisMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	return r.deleteMsg(ctx, id, version)
+}
+
+func (r *RedisMsgDB) deleteMsg(ctx context.Context, id string, version int64) error {
+	key := r.msgKey(id)
+	var trashed *Msg
+	err := r.watch(ctx, []string{key}, func(ctx context.Context, tx *redis.Tx) error {
+		msg, err := r.checkStoredMsg(ctx, tx, key, version)
+		if err != nil {
+			return err
+		}
+
+		deletedAt := time.Now()
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.queueTrash(ctx, pipe, id, deletedAt)
+			return nil
+		})
+		if err != nil {
+			log.Error("Failed to move msg to trash: ", err.Error())
+			return err
+		}
+		msg.DeletedAt = &deletedAt
+		trashed = msg
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.events.publish(MsgDeleted, trashed)
+	return nil
+}
+
+// ApplyBatch applies atomic batches in a single transaction, which watches the keys of every msg of the batch: the ops
+// are checked against the versions stored, and only queued once all of them are known to succeed
+func (r *RedisMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	if !atomic {
+		return applyBatchOps(ctx, r, ops), nil
+	}
+
+	var keys []string
+	for _, op := range ops {
+		if op.validate() == nil {
+			keys = append(keys, r.msgKey(op.id()), r.trashKey(op.id()))
+		}
+	}
+
+	var stored []*Msg
+	var failure *batchFailure
+	err := r.watch(ctx, keys, func(ctx context.Context, tx *redis.Tx) error {
+		stored, failure = checkBatch(ops, func(id string) (*Msg, error) {
+			return r.storedMsg(ctx, tx, r.msgKey(id))
+		})
+		if failure != nil {
+			return failure
+		}
+
+		deletedAt := time.Now()
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, op := range ops {
+				if op.Type == BatchDelete {
+					r.queueTrash(ctx, pipe, op.id(), deletedAt)
+					stored[i].DeletedAt = &deletedAt
+					continue
+				}
+
+				msg := *stored[i]
+				if op.Type == BatchUpdate {
+					msg.ExpiresAt = nil // the hash keeps the one set on creation
+					err := r.putMsg(ctx, pipe, &msg)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				err := r.queueCreate(ctx, pipe, &msg)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if failure != nil {
+		return failure.results(len(ops)), nil
+	}
+	if err != nil {
+		log.Error("Failed to apply batch: ", err.Error())
+		return nil, err
+	}
+
+	setBatchVersions(ops, stored)
+	r.events.publishBatch(ops, stored)
+	return make([]error, len(ops)), nil
+}
+
+func (r *RedisMsgDB) Watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	return r.events.watch(ctx, after)
+}
+
+func (r *RedisMsgDB) GetTrashedMsgs(ctx context.Context) ([]*Msg, error) {
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+
+	ids, err := r.client.ZRange(ctx, r.trashByDeletedAtKey(), 0, -1).Result()
+	if err != nil {
+		log.Error("Failed to read trash index: ", err.Error())
+		return []*Msg{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.trashKey(id)
+	}
+
+	msgs, err := r.readMsgHashes(ctx, keys)
+	if msgs == nil {
+		msgs = []*Msg{}
+	}
+	return msgs, err
+}
+
+func (r *RedisMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	key, trashKey := r.msgKey(id), r.trashKey(id)
+	var restored *Msg
+	err := r.watch(ctx, []string{key, trashKey}, func(ctx context.Context, tx *redis.Tx) error {
+		fields, err := tx.HGetAll(ctx, trashKey).Result()
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			return ErrMsgNotFound{}
+		}
+		msg, err := msgFromRedisHash(fields)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Rename(ctx, trashKey, key)
+			pipe.HDel(ctx, key, "deletedAt")
+			pipe.ZRem(ctx, r.trashByDeletedAtKey(), id)
+			pipe.ZAdd(ctx, r.byModTimeKey(), &redis.Z{Score: redisModTimeScore(msg.ModTime), Member: id})
+			return nil
+		})
+		if err != nil {
+			log.Error("Failed to restore msg: ", err.Error())
+		}
+		restored = msg
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	restored.DeletedAt = nil
+	r.events.publish(MsgCreated, restored)
+	return nil
+}
+
+// PurgeTrash purges the msgs one transaction at a time, checking that each of them wasn't restored (or recreated and
+// deleted again) since the trash index was read
+func (r *RedisMsgDB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	rangeCtx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+	ids, err := r.client.ZRangeByScore(rangeCtx, r.trashByDeletedAtKey(),
+		&redis.ZRangeBy{Min: "-inf", Max: "(" + strconv.FormatFloat(redisModTimeScore(before), 'f', -1, 64)}).Result()
+	if err != nil {
+		log.Error("Failed to read trash index: ", err.Error())
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		trashKey := r.trashKey(id)
+		err = r.watch(ctx, []string{trashKey}, func(ctx context.Context, tx *redis.Tx) error {
+			fields, err := tx.HGetAll(ctx, trashKey).Result()
+			if err != nil {
+				return err
+			}
+			if len(fields) == 0 {
+				return nil
+			}
+			msg, err := msgFromRedisHash(fields)
+			if err != nil {
+				return err
+			}
+			if msg.DeletedAt == nil || !msg.DeletedAt.Before(before) {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				r.purgeMsg(ctx, pipe, id)
+				return nil
+			})
+			if err == nil {
+				purged++
+			}
+			return err
+		})
+		if err != nil {
+			log.Error("Failed to purge trashed msg: ", err.Error())
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// PurgeExpired only has to remove the ids of the msgs redis expired from the indexes, which it walks in batches
+func (r *RedisMsgDB) PurgeExpired(ctx context.Context) (int, error) {
+	purged := 0
+	for _, index := range []struct {
+		key   string
+		msgFn func(id string) string
+	}{{r.byModTimeKey(), r.msgKey}, {r.trashByDeletedAtKey(), r.trashKey}} {
+		for start := int64(0); ; {
+			n, removed, err := r.removeExpiredIds(ctx, index.key, index.msgFn, start)
+			if err != nil {
+				log.Error("Failed to purge expired msgs: ", err.Error())
+				return purged, err
+			}
+			purged += removed
+			if n < iterBatchSize {
+				break
+			}
+			start += int64(n - removed)
+		}
+	}
+
+	return purged, nil
+}
+
+// removeExpiredIds removes from the index at indexKey the ids, out of a batch starting at rank start, whose msg key
+// (as returned by msgFn) no longer exists; returns the size of the batch and how many ids were removed
+func (r *RedisMsgDB) removeExpiredIds(ctx context.Context, indexKey string, msgFn func(id string) string,
+	start int64) (int, int, error) {
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+
+	ids, err := r.client.ZRange(ctx, indexKey, start, start+iterBatchSize-1).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	exists := make([]*redis.IntCmd, len(ids))
+	_, err = r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			exists[i] = pipe.Exists(ctx, msgFn(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	for i, id := range ids {
+		if exists[i].Val() > 0 {
+			continue
+		}
+		// the msg may have been created again since it was checked
+		key := msgFn(id)
+		err = r.watch(ctx, []string{key}, func(ctx context.Context, tx *redis.Tx) error {
+			n, err := tx.Exists(ctx, key).Result()
+			if err != nil || n > 0 {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZRem(ctx, indexKey, id)
+				return nil
+			})
+			if err == nil {
+				removed++
+			}
+			return err
+		})
+		if err != nil {
+			return len(ids), removed, err
+		}
+	}
+
+	return len(ids), removed, nil
+}
+
+// checkStoredMsg returns the msg stored at key, which is expected to be watched by tx
+// returns ErrMsgNotFound if there's no msg, ErrVersionConflict if its version is not the one expected
+func (r *RedisMsgDB) checkStoredMsg(ctx context.Context, tx *redis.Tx, key string, expected int64) (*Msg, error) {
+	msg, err := r.storedMsg(ctx, tx, key)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrMsgNotFound{}
+	}
+	return msg, checkVersion(msg.Version, expected)
+}
+
+// storedMsg returns the msg stored at key, nil if there's none
+func (r *RedisMsgDB) storedMsg(ctx context.Context, tx *redis.Tx, key string) (*Msg, error) {
+	fields, err := tx.HGetAll(ctx, key).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	return msgFromRedisHash(fields)
+}
+
+func (r *RedisMsgDB) GetRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+
+	var exists *redis.IntCmd
+	var members *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, r.msgKey(id))
+		members = pipe.ZRange(ctx, r.revisionsKey(id), 0, -1)
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to read revisions: ", err.Error())
+		return nil, err
+	}
+	if exists.Val() == 0 {
+		return nil, ErrMsgNotFound{}
+	}
+
+	revisions := make([]*Revision, len(members.Val()))
+	for i, member := range members.Val() {
+		revisions[i] = &Revision{}
+		err = json.Unmarshal([]byte(member), revisions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revisions, nil
+}
+
+func (r *RedisMsgDB) GetRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, err := r.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+// getMsgs reads the msgs with the ids provided in a single round trip, the ones that no longer exist are skipped
+func (r *RedisMsgDB) getMsgs(ctx context.Context, ids []string) ([]*Msg, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = r.msgKey(id)
+	}
+	return r.readMsgHashes(ctx, keys)
+}
+
+// readMsgHashes reads the msg hashes at the keys provided in a single round trip, the ones that no longer exist are
+// skipped
+func (r *RedisMsgDB) readMsgHashes(ctx context.Context, keys []string) ([]*Msg, error) {
+	var msgs []*Msg
+	if len(keys) == 0 {
+		return msgs, nil
+	}
+
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to read msgs: ", err.Error())
+		return msgs, err
+	}
+
+	for _, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		msg, err := msgFromRedisHash(cmd.Val())
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// watch runs fn in an optimistic transaction watching keys, it is retried if any of them changes before fn commits
+func (r *RedisMsgDB) watch(ctx context.Context, keys []string, fn func(ctx context.Context, tx *redis.Tx) error) error {
+	ctx, cancel := opContext(ctx, r.opTimeout)
+	defer cancel()
+
+	txFn := func(tx *redis.Tx) error {
+		return fn(ctx, tx)
+	}
+	for i := 0; i < redisMaxTxRetries; i++ {
+		err := r.client.Watch(ctx, txFn, keys...)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		return err
+	}
+
+	log.Error("Failed to commit redis transaction on keys ", keys, " after ", redisMaxTxRetries, " attempts")
+	return redis.TxFailedErr
+}
+
+// putMsg queues the writes that store msg in its hash, index it by mod time and record its revision
+func (r *RedisMsgDB) putMsg(ctx context.Context, pipe redis.Pipeliner, msg *Msg) error {
+	rev, err := json.Marshal(newRevision(msg))
+	if err != nil {
+		return err
+	}
+
+	pipe.HSet(ctx, r.msgKey(msg.Id), msgToRedisHash(msg))
+	pipe.ZAdd(ctx, r.byModTimeKey(), &redis.Z{Score: redisModTimeScore(msg.ModTime), Member: msg.Id})
+	pipe.ZAdd(ctx, r.revisionsKey(msg.Id), &redis.Z{Score: float64(msg.Version), Member: rev})
+	return nil
+}
+
+// queueCreate queues the creation of msg in pipe, purging the trashed msg with its id (if any), the new one starts its
+// own revisions
+func (r *RedisMsgDB) queueCreate(ctx context.Context, pipe redis.Pipeliner, msg *Msg) error {
+	r.purgeMsg(ctx, pipe, msg.Id)
+	err := r.putMsg(ctx, pipe, msg)
+	if err != nil {
+		return err
+	}
+	if msg.ExpiresAt != nil {
+		pipe.PExpireAt(ctx, r.msgKey(msg.Id), *msg.ExpiresAt)
+		pipe.PExpireAt(ctx, r.revisionsKey(msg.Id), *msg.ExpiresAt)
+	}
+	return nil
+}
+
+// queueTrash queues the move of the msg with the id provided to the trash in pipe
+func (r *RedisMsgDB) queueTrash(ctx context.Context, pipe redis.Pipeliner, id string, deletedAt time.Time) {
+	pipe.Rename(ctx, r.msgKey(id), r.trashKey(id))
+	pipe.HSet(ctx, r.trashKey(id), "deletedAt", deletedAt.Format(time.RFC3339Nano))
+	pipe.ZRem(ctx, r.byModTimeKey(), id)
+	pipe.ZAdd(ctx, r.trashByDeletedAtKey(), &redis.Z{Score: redisModTimeScore(deletedAt), Member: id})
+}
+
+// purgeMsg queues the writes that permanently delete the trashed msg with the id provided (if any) and its revisions
+func (r *RedisMsgDB) purgeMsg(ctx context.Context, pipe redis.Pipeliner, id string) {
+	pipe.Del(ctx, r.trashKey(id), r.revisionsKey(id))
+	pipe.ZRem(ctx, r.trashByDeletedAtKey(), id)
+}
+
+func (r *RedisMsgDB) msgKey(id string) string {
+	return r.keyPrefix + "msg:" + id
+}
+
+func (r *RedisMsgDB) byModTimeKey() string {
+	return r.keyPrefix + "msgs:byModTime"
+}
+
+// revisionsKey is the sorted set of the revisions of a msg, json encoded and scored by version
+// it must not share the msg key prefix, which would make SCAN return it along the msgs
+func (r *RedisMsgDB) revisionsKey(id string) string {
+	return r.keyPrefix + "revisions:" + id
+}
+
+// trashKey is the hash of a trashed msg, which is its msg hash renamed plus a deletedAt field
+func (r *RedisMsgDB) trashKey(id string) string {
+	return r.keyPrefix + "trash:msg:" + id
+}
+
+// trashByDeletedAtKey is the sorted set of the ids of the trashed msgs, scored by deletion time in microseconds
+func (r *RedisMsgDB) trashByDeletedAtKey() string {
+	return r.keyPrefix + "trash:byDeletedAt"
+}
+
+// redisModTimeScore returns the mod time in microseconds, which (unlike nanoseconds) a float64 score holds exactly
+func redisModTimeScore(modTime time.Time) float64 {
+	return float64(modTime.UnixNano() / int64(time.Microsecond))
+}
+
+// msgToRedisHash returns the fields of the msg hash, an update leaves out the expiry, which the hash already has
+func msgToRedisHash(msg *Msg) map[string]interface{} {
+	fields := map[string]interface{}{
+		"id":                msg.Id,
+		"content":           msg.Content,
+		"isPalindrome":      strconv.FormatBool(msg.IsPalindrome),
+		"isWordPalindrome":  strconv.FormatBool(msg.IsWordPalindrome),
+		"palindromeProfile": string(msg.PalindromeProfile),
+		"modTime":           msg.ModTime.Format(time.RFC3339Nano),
+		"version":           strconv.FormatInt(msg.Version, 10),
+
+		"longestPalindrome":       msg.LongestPalindrome.Text,
+		"longestPalindromeOffset": strconv.Itoa(msg.LongestPalindrome.Offset),
+		"longestPalindromeLength": strconv.Itoa(msg.LongestPalindrome.Length),
+		"properties":              encodeMsgProperties(msg.Properties),
+	}
+	if msg.ExpiresAt != nil {
+		fields["expiresAt"] = msg.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	return fields
+}
+
+func msgFromRedisHash(fields map[string]string) (*Msg, error) {
+	isPalindrome, err := strconv.ParseBool(fields["isPalindrome"])
+	if err != nil {
+		return nil, err
+	}
+	modTime, err := time.Parse(time.RFC3339Nano, fields["modTime"])
+	if err != nil {
+		return nil, err
+	}
+	version, err := parseRedisVersion(fields["version"])
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Msg{
+		Id:                fields["id"],
+		Content:           fields["content"],
+		IsPalindrome:      isPalindrome,
+		PalindromeProfile: PalindromeProfile(fields["palindromeProfile"]),
+		ModTime:           modTime,
+		Version:           version,
+	}
+	// the msgs stored before words were checked have no such field, they're not word palindromes
+	msg.IsWordPalindrome = fields["isWordPalindrome"] == "true"
+	msg.LongestPalindrome.Text = fields["longestPalindrome"]
+	msg.LongestPalindrome.Offset, err = parseRedisInt(fields, "longestPalindromeOffset")
+	if err != nil {
+		return nil, err
+	}
+	msg.LongestPalindrome.Length, err = parseRedisInt(fields, "longestPalindromeLength")
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties, err = decodeMsgProperties(fields["properties"])
+	if err != nil {
+		return nil, err
+	}
+	msg.DeletedAt, err = parseRedisTime(fields, "deletedAt")
+	if err != nil {
+		return nil, err
+	}
+	msg.ExpiresAt, err = parseRedisTime(fields, "expiresAt")
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// parseRedisInt parses the int field of a msg hash, 0 if the hash has no such field (it was stored before the field was)
+func parseRedisInt(fields map[string]string, name string) (int, error) {
+	field, ok := fields[name]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(field)
+}
+
+// parseRedisTime parses the optional time field of a msg hash, nil if the hash has no such field
+func parseRedisTime(fields map[string]string, name string) (*time.Time, error) {
+	field, ok := fields[name]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, field)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseRedisVersion parses the version field of a msg hash, msgs stored before versions were introduced have none
+func parseRedisVersion(field string) (int64, error) {
+	if field == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(field, 10, 64)
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// newTestRedisMsgDB returns a db connected to an in-process miniredis server that is stopped when the test finishes
+func newTestRedisMsgDB(t *testing.T) *RedisMsgDB {
+	server := miniredis.RunT(t)
+	db, err := NewRedisMsgDB(server.Addr(), DefaultRedisKeyPrefix, DefaultOpTimeout)
+	assert.Nil(t, err)
+	return db
+}
+
+func TestNewRedisMsgDB(t *testing.T) {
+	db := newTestRedisMsgDB(t)
+	defer db.Close()
+
+	assert.NotNil(t, db.client)
+	assert.Equal(t, DefaultRedisKeyPrefix, db.keyPrefix)
+}
+
+func TestNewRedisMsgDB_Unreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+
+	db, err := NewRedisMsgDB(addr, DefaultRedisKeyPrefix, DefaultOpTimeout)
+	assert.Nil(t, db)
+	assert.NotNil(t, err)
+}
+
+func TestRedisMsgDB_ByModTimeIndex(t *testing.T) {
+	// the sorted set must follow the creations, updates and deletions of the messages
+	ctx := context.Background()
+	db := newTestRedisMsgDB(t)
+	defer db.Close()
+
+	msg := NewMsg("unicorn", "kayak")
+	err := db.CreateMsg(ctx, msg)
+	assert.Nil(t, err)
+
+	ids, err := db.client.ZRange(context.Background(), db.byModTimeKey(), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unicorn"}, ids)
+
+	err = db.DeleteMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+
+	ids, err = db.client.ZRange(context.Background(), db.byModTimeKey(), 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+}
+
+func TestRedisMsgDB_PurgeExpired(t *testing.T) {
+	// redis expires the msg itself, purging removes what's left of it in the indexes
+	ctx := context.Background()
+	db := newTestRedisMsgDB(t)
+	defer db.Close()
+
+	assert.Nil(t, db.CreateMsg(ctx, newExpiringMsg("unicorn", "kayak", time.Now().Add(-time.Second))))
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("banana", "anana")))
+	assert.Equal(t, int64(2), db.client.ZCard(ctx, db.byModTimeKey()).Val())
+
+	purged, err := db.PurgeExpired(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, []string{"banana"}, db.client.ZRange(ctx, db.byModTimeKey(), 0, -1).Val())
+	assert.Equal(t, int64(0), db.client.Exists(ctx, db.revisionsKey("unicorn")).Val())
+}
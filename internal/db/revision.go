@@ -0,0 +1,123 @@
+package db
+
+import (
+	"time"
+	"unicode"
+)
+
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// Revision is an immutable record of a msg as it was at one of its versions
+// every creation and update of a msg records one, they are removed when the msg is purged from the trash
+type Revision struct {
+	Version           int64             `json:"version"           bson:"version"`
+	Content           string            `json:"content"           bson:"content"`
+	IsPalindrome      bool              `json:"isPalindrome"      bson:"isPalindrome"`
+	PalindromeProfile PalindromeProfile `json:"palindromeProfile" bson:"palindromeProfile"`
+	ModTime           time.Time         `json:"modTime"           bson:"modTime"`
+}
+
+func newRevision(msg *Msg) *Revision {
+	return &Revision{
+		Version:           msg.Version,
+		Content:           msg.Content,
+		IsPalindrome:      msg.IsPalindrome,
+		PalindromeProfile: msg.PalindromeProfile,
+		ModTime:           msg.ModTime,
+	}
+}
+
+// findRevision returns the revision with the version provided out of revisions
+// returns ErrRevisionNotFound if there's none
+func findRevision(revisions []*Revision, version int64) (*Revision, error) {
+	for _, rev := range revisions {
+		if rev.Version == version {
+			return rev, nil
+		}
+	}
+	return nil, ErrRevisionNotFound{}
+}
+
+// DiffOp is a piece of the difference between two contents: Text is either in both of them (DiffEqual), only in the
+// new one (DiffInsert) or only in the old one (DiffDelete)
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffContents returns the ops that turn the content from into the content to
+// contents are compared word by word (runs of whitespace count as words), joining the text of the ops that aren't
+// DiffInsert gives back from, and the ones that aren't DiffDelete gives back to
+func DiffContents(from, to string) []DiffOp {
+	a, b := splitWords(from), splitWords(to)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := []DiffOp{}
+	add := func(op, text string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: text})
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] == b[j] {
+			add(DiffEqual, a[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			add(DiffDelete, a[i])
+			i++
+		} else {
+			add(DiffInsert, b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add(DiffDelete, a[i])
+	}
+	for ; j < len(b); j++ {
+		add(DiffInsert, b[j])
+	}
+
+	return ops
+}
+
+// splitWords splits s into words and runs of whitespace, joining them gives back s
+func splitWords(s string) []string {
+	var words []string
+	start := 0
+	inSpace := false
+	for i, r := range s {
+		if i > start && unicode.IsSpace(r) != inSpace {
+			words = append(words, s[start:i])
+			start = i
+		}
+		inSpace = unicode.IsSpace(r)
+	}
+	if start < len(s) {
+		words = append(words, s[start:])
+	}
+	return words
+}
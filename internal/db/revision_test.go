@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDiffContents(t *testing.T) {
+	ops := DiffContents("the quick brown fox", "the slow brown dog jumps")
+	assert.Equal(t, []DiffOp{
+		{Op: DiffEqual, Text: "the "},
+		{Op: DiffDelete, Text: "quick"},
+		{Op: DiffInsert, Text: "slow"},
+		{Op: DiffEqual, Text: " brown "},
+		{Op: DiffDelete, Text: "fox"},
+		{Op: DiffInsert, Text: "dog jumps"},
+	}, ops)
+}
+
+func TestDiffContents_Reconstruct(t *testing.T) {
+	// joining the ops must give back both contents
+	pairs := [][2]string{
+		{"", ""},
+		{"", "kayak"},
+		{"kayak", ""},
+		{"a man a plan", "a man  a canal\tpanama"},
+		{"  leading and trailing  ", "trailing and leading"},
+		{"ñandú común", "ñandú raro común"},
+	}
+	for _, pair := range pairs {
+		var from, to strings.Builder
+		for _, op := range DiffContents(pair[0], pair[1]) {
+			if op.Op != DiffInsert {
+				from.WriteString(op.Text)
+			}
+			if op.Op != DiffDelete {
+				to.WriteString(op.Text)
+			}
+		}
+		assert.Equal(t, pair[0], from.String())
+		assert.Equal(t, pair[1], to.String())
+	}
+}
+
+func TestDiffContents_Equal(t *testing.T) {
+	assert.Equal(t, []DiffOp{{Op: DiffEqual, Text: "kayak kayak"}}, DiffContents("kayak kayak", "kayak kayak"))
+	assert.Equal(t, []DiffOp{}, DiffContents("", ""))
+}
+
+func TestSplitWords(t *testing.T) {
+	assert.Equal(t, []string{"a", " ", "man", "\t\n", "ñandú"}, splitWords("a man\t\nñandú"))
+	assert.Equal(t, []string(nil), splitWords(""))
+}
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"context"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// snippetLength is the max number of characters of the content a snippet shows
+	snippetLength = 160
+	// snippetContext is the number of characters a snippet shows before the first match, when it can't show it all
+	snippetContext = 40
+	// phraseWeight is how much more a phrase counts towards the score than a single term
+	phraseWeight = 2
+)
+
+// SearchResult is a msg found by MsgDB.SearchMsgs, along with how relevant it is to the query and a snippet of its
+// content where the terms and phrases found are highlighted
+type SearchResult struct {
+	Msg   *Msg    `json:"message"`
+	Score float64 `json:"score"`
+	// Snippet is the part of the content around the first match, html escaped, with every match wrapped in
+	// <mark></mark>; it starts or ends with an ellipsis if the content was cut
+	Snippet string `json:"snippet"`
+}
+
+// searchToken is a word of a content, its term is the word in lower case
+type searchToken struct {
+	term       string
+	start, end int // byte offsets of the word in the content
+}
+
+// tokenize splits content into its words: the sequences of letters and digits
+func tokenize(content string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range content {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			tokens = append(tokens, searchToken{term: strings.ToLower(content[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{term: strings.ToLower(content[start:]), start: start, end: len(content)})
+	}
+	return tokens
+}
+
+// searchQuery is a parsed query: the msgs found must have every term and every phrase (terms in a row)
+type searchQuery struct {
+	terms   []string
+	phrases [][]string
+}
+
+// parseSearchQuery parses q: the text in double quotes is a phrase, every other word is a term
+// returns ErrInvalidSearchQuery if q has no words
+func parseSearchQuery(q string) (*searchQuery, error) {
+	query := &searchQuery{}
+	seen := map[string]bool{}
+	// the parts at odd indexes were in quotes, an unclosed quote runs to the end of q
+	for i, part := range strings.Split(q, `"`) {
+		var words []string
+		for _, token := range tokenize(part) {
+			words = append(words, token.term)
+		}
+		if i%2 == 1 && len(words) > 1 {
+			query.phrases = append(query.phrases, words)
+			continue
+		}
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				query.terms = append(query.terms, word)
+			}
+		}
+	}
+
+	if len(query.terms) == 0 && len(query.phrases) == 0 {
+		return nil, ErrInvalidSearchQuery{}
+	}
+	return query, nil
+}
+
+// words returns the distinct words of the query, those of its phrases included
+func (q *searchQuery) words() []string {
+	words := append([]string{}, q.terms...)
+	seen := map[string]bool{}
+	for _, word := range words {
+		seen[word] = true
+	}
+	for _, phrase := range q.phrases {
+		for _, word := range phrase {
+			if !seen[word] {
+				seen[word] = true
+				words = append(words, word)
+			}
+		}
+	}
+	return words
+}
+
+// match returns the result of msg if it has every term and phrase of the query, nil otherwise
+// the score adds up how often each term and phrase occurs, with diminishing returns, relative to the number of words
+// of the content: the more matches and the shorter the content, the higher
+func (q *searchQuery) match(msg *Msg) *SearchResult {
+	tokens := tokenize(msg.Content)
+	var spans []searchSpan
+	score := 0.0
+
+	for _, term := range q.terms {
+		tf := 0
+		for _, token := range tokens {
+			if token.term == term {
+				tf++
+				spans = append(spans, searchSpan{start: token.start, end: token.end})
+			}
+		}
+		if tf == 0 {
+			return nil
+		}
+		score += 1 + math.Log(float64(tf))
+	}
+
+	for _, phrase := range q.phrases {
+		tf := 0
+		for i := 0; i+len(phrase) <= len(tokens); i++ {
+			if phraseAt(tokens, i, phrase) {
+				tf++
+				spans = append(spans, searchSpan{start: tokens[i].start, end: tokens[i+len(phrase)-1].end})
+			}
+		}
+		if tf == 0 {
+			return nil
+		}
+		score += phraseWeight * (1 + math.Log(float64(tf)))
+	}
+
+	return &SearchResult{
+		Msg:     msg,
+		Score:   score / math.Sqrt(float64(len(tokens))),
+		Snippet: snippet(msg.Content, tokens, mergeSpans(spans)),
+	}
+}
+
+// phraseAt returns true if the tokens starting at i are the words of phrase
+func phraseAt(tokens []searchToken, i int, phrase []string) bool {
+	for j, word := range phrase {
+		if tokens[i+j].term != word {
+			return false
+		}
+	}
+	return true
+}
+
+// searchSpan is the part of a content a term or phrase was found at, in byte offsets
+type searchSpan struct {
+	start, end int
+}
+
+// mergeSpans sorts spans and merges those that overlap
+func mergeSpans(spans []searchSpan) []searchSpan {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	var merged []searchSpan
+	for _, span := range spans {
+		last := len(merged) - 1
+		if last >= 0 && span.start <= merged[last].end {
+			if span.end > merged[last].end {
+				merged[last].end = span.end
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+// snippet returns the part of content around the first of the (merged, not empty) spans, html escaped, with the
+// spans wrapped in <mark></mark>. Contents longer than snippetLength are cut at word boundaries
+func snippet(content string, tokens []searchToken, spans []searchSpan) string {
+	begin, end := 0, len(content)
+	if utf8.RuneCountInString(content) > snippetLength {
+		first := spans[0]
+		// the window starts snippetContext characters before the first match, at the start of a word
+		begin = first.start
+		for n := 0; n < snippetContext && begin > 0; n++ {
+			_, size := utf8.DecodeLastRuneInString(content[:begin])
+			begin -= size
+		}
+		for _, token := range tokens {
+			if token.start >= begin {
+				begin = token.start
+				break
+			}
+		}
+		// and ends snippetLength characters later, at the end of a word, though never within the first match
+		end = begin
+		for n := 0; n < snippetLength && end < len(content); n++ {
+			_, size := utf8.DecodeRuneInString(content[end:])
+			end += size
+		}
+		limit := end
+		for _, token := range tokens {
+			if token.end > limit {
+				break
+			}
+			end = token.end
+		}
+		if end < first.end {
+			end = first.end
+		}
+	}
+
+	var sb strings.Builder
+	if begin > 0 {
+		sb.WriteString("…")
+	}
+	pos := begin
+	for _, span := range spans {
+		if span.end <= begin || span.start >= end {
+			continue
+		}
+		start, stop := span.start, span.end
+		if start < begin {
+			start = begin
+		}
+		if stop > end {
+			stop = end
+		}
+		sb.WriteString(html.EscapeString(content[pos:start]))
+		sb.WriteString("<mark>" + html.EscapeString(content[start:stop]) + "</mark>")
+		pos = stop
+	}
+	sb.WriteString(html.EscapeString(content[pos:end]))
+	if end < len(content) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+// rankResults sorts results by score, then by id, and keeps the first limit of them
+func rankResults(results []*SearchResult, limit int) []*SearchResult {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Msg.Id < results[j].Msg.Id
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// searchAllMsgs searches every msg of msgDb, it is used by the dbs that have no index to search with
+func searchAllMsgs(ctx context.Context, msgDb MsgDB, q string, limit int) ([]*SearchResult, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit{}
+	}
+	query, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*SearchResult{}
+	err = msgDb.ForEachMsg(ctx, func(msg *Msg) error {
+		if result := query.match(msg); result != nil {
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rankResults(results, limit), nil
+}
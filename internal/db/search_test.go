@@ -0,0 +1,94 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenize("Hello, wörld! it's 2 o'clock")
+	var terms []string
+	for _, token := range tokens {
+		terms = append(terms, token.term)
+	}
+	assert.Equal(t, []string{"hello", "wörld", "it", "s", "2", "o", "clock"}, terms)
+	assert.Equal(t, "wörld", "Hello, wörld! it's 2 o'clock"[tokens[1].start:tokens[1].end])
+
+	assert.Empty(t, tokenize(" ?! "))
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	query, err := parseSearchQuery(`Kayak "red  Canoe" kayak "boat" "unclosed phrase`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kayak", "boat"}, query.terms)
+	assert.Equal(t, [][]string{{"red", "canoe"}, {"unclosed", "phrase"}}, query.phrases)
+	assert.Equal(t, []string{"kayak", "boat", "red", "canoe", "unclosed", "phrase"}, query.words())
+
+	for _, q := range []string{"", "  ", `""`, "?!"} {
+		_, err = parseSearchQuery(q)
+		assert.IsType(t, ErrInvalidSearchQuery{}, err, q)
+	}
+}
+
+func TestSearchQuery_Match(t *testing.T) {
+	query, err := parseSearchQuery(`kayak "red canoe"`)
+	assert.Nil(t, err)
+
+	result := query.match(NewMsg("1", "A <red> canoe & a kayak"))
+	if assert.NotNil(t, result) {
+		assert.Equal(t, "A &lt;<mark>red&gt; canoe</mark> &amp; a <mark>kayak</mark>", result.Snippet)
+	}
+	assert.Nil(t, query.match(NewMsg("2", "A canoe, red, and a kayak")))
+	assert.Nil(t, query.match(NewMsg("3", "A red canoe")))
+
+	// more matches in fewer words score higher
+	once := query.match(NewMsg("4", "kayak, red canoe and other boats"))
+	twice := query.match(NewMsg("5", "kayak, red canoe and other kayaks or kayak"))
+	short := query.match(NewMsg("6", "kayak red canoe"))
+	assert.True(t, twice.Score > once.Score)
+	assert.True(t, short.Score > once.Score)
+}
+
+func TestSnippet_Long(t *testing.T) {
+	content := strings.Repeat("lorem ipsum ", 20) + "the kayak " + strings.Repeat("dolor sit amet ", 20)
+	query, err := parseSearchQuery("kayak")
+	assert.Nil(t, err)
+
+	result := query.match(NewMsg("1", content))
+	if !assert.NotNil(t, result) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(result.Snippet, "…"), result.Snippet)
+	assert.True(t, strings.HasSuffix(result.Snippet, "…"), result.Snippet)
+	assert.Contains(t, result.Snippet, "the <mark>kayak</mark> dolor")
+	// cut at word boundaries
+	assert.True(t, strings.HasPrefix(result.Snippet, "…lorem ") || strings.HasPrefix(result.Snippet, "…ipsum "),
+		result.Snippet)
+	assert.True(t, strings.HasSuffix(result.Snippet, " dolor…") || strings.HasSuffix(result.Snippet, " sit…") ||
+		strings.HasSuffix(result.Snippet, " amet…"), result.Snippet)
+}
+
+func TestMergeSpans(t *testing.T) {
+	spans := mergeSpans([]searchSpan{{10, 15}, {0, 3}, {2, 5}, {12, 14}, {20, 22}})
+	assert.Equal(t, []searchSpan{{0, 5}, {10, 15}, {20, 22}}, spans)
+}
+
+func TestInvertedIndex(t *testing.T) {
+	var index invertedIndex
+	index.put(NewMsg("1", "red kayak"))
+	index.put(NewMsg("2", "red canoe, red boat"))
+	index.put(NewMsg("3", "blue kayak"))
+
+	assert.ElementsMatch(t, []string{"1", "2"}, index.lookup([]string{"red"}))
+	assert.ElementsMatch(t, []string{"1"}, index.lookup([]string{"red", "kayak"}))
+	assert.Empty(t, index.lookup([]string{"green"}))
+
+	index.put(NewMsg("1", "green kayak"))
+	assert.ElementsMatch(t, []string{"2"}, index.lookup([]string{"red"}))
+	index.delete("3")
+	assert.ElementsMatch(t, []string{"1"}, index.lookup([]string{"kayak"}))
+	index.delete("1")
+	index.delete("2")
+	assert.Empty(t, index.postings)
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// migration is a versioned change to a sql schema, its version is its (1 based) position in the migrations list
+// migrations are append only: once released, a migration must never be edited or reordered
+type migration struct {
+	description string
+	statements  []string
+}
+
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	applied_at BIGINT  NOT NULL
+)`
+
+// migrate brings the schema of sqlDb up to date by applying, in order, the migrations it hasn't seen yet
+// each migration runs in its own transaction along with the record of its version in schema_migrations
+func migrate(sqlDb *sql.DB, migrations []migration) error {
+	_, err := sqlDb.Exec(createMigrationsTable)
+	if err != nil {
+		log.Error("Failed to create schema migrations table: ", err.Error())
+		return err
+	}
+
+	var current int
+	err = sqlDb.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current)
+	if err != nil {
+		log.Error("Failed to read current schema version: ", err.Error())
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		err = applyMigration(sqlDb, version, migrations[i])
+		if err != nil {
+			log.Errorf("Failed to apply migration %d (%s): %s", version, migrations[i].description, err.Error())
+			return err
+		}
+		log.Infof("Applied schema migration %d: %s", version, migrations[i].description)
+	}
+
+	return nil
+}
+
+func applyMigration(sqlDb *sql.DB, version int, m migration) error {
+	tx, err := sqlDb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)", version, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	sqlDb, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.sqlite"))
+	assert.Nil(t, err)
+	defer sqlDb.Close()
+
+	migrations := []migration{
+		{description: "create table", statements: []string{"CREATE TABLE potatoes (id TEXT PRIMARY KEY)"}},
+		{description: "add column", statements: []string{"ALTER TABLE potatoes ADD COLUMN size INTEGER"}},
+	}
+
+	err = migrate(sqlDb, migrations[:1])
+	assert.Nil(t, err)
+
+	// running it again with an extra migration must only apply the new one
+	err = migrate(sqlDb, migrations)
+	assert.Nil(t, err)
+	err = migrate(sqlDb, migrations)
+	assert.Nil(t, err)
+
+	var version int
+	err = sqlDb.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, version)
+
+	_, err = sqlDb.Exec("INSERT INTO potatoes (id, size) VALUES ('russet', 3)")
+	assert.Nil(t, err)
+}
+
+func TestMigrate_Failure(t *testing.T) {
+	sqlDb, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.sqlite"))
+	assert.Nil(t, err)
+	defer sqlDb.Close()
+
+	migrations := []migration{
+		{description: "create table", statements: []string{"CREATE TABLE potatoes (id TEXT PRIMARY KEY)"}},
+		{description: "broken", statements: []string{"ALTER TABLE tomatoes ADD COLUMN size INTEGER"}},
+	}
+
+	err = migrate(sqlDb, migrations)
+	assert.NotNil(t, err)
+
+	// the first migration must have been kept, the broken one must not be recorded
+	var version int
+	err = sqlDb.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+}
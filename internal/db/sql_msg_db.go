@@ -0,0 +1,737 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// sqlMsgColumns are the columns scanSQLMsg expects, in order
+	sqlMsgColumns = "id, content, is_palindrome, is_word_palindrome, palindrome_profile, longest_palindrome, " +
+		"longest_palindrome_offset, longest_palindrome_length, properties, mod_time, version, expires_at"
+	// sqlTrashColumns are the columns scanSQLTrashedMsg expects, in order
+	sqlTrashColumns = sqlMsgColumns + ", deleted_at"
+	// sqlMsgArgsLen is the number of sqlMsgColumns, as returned by sqlMsgArgs
+	sqlMsgArgsLen = 12
+)
+
+// sqlMsgDB implements MsgDB on top of database/sql, it is shared by the sql backends (sqlite, postgres)
+// queries only use syntax both dialects understand; the schema itself is defined by each backend's migrations
+// the mod time is stored as unix nanoseconds to keep it exact and sortable, so is the expiry (NULL if none)
+type sqlMsgDB struct {
+	db        *sql.DB
+	opTimeout time.Duration // bounds every operation on top of the ctx it takes, 0 means no bound
+	// events are published once the changes are committed, the changes made by other processes are not seen
+	events msgBroadcaster
+}
+
+func (s *sqlMsgDB) Close() {
+	s.events.close()
+	err := s.db.Close()
+	if err != nil {
+		log.Error("Failed to close sql db: ", err.Error())
+	}
+}
+
+func (s *sqlMsgDB) GetMsg(ctx context.Context, id string) (*Msg, error) {
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	row := s.db.QueryRowContext(ctx, "SELECT "+sqlMsgColumns+" FROM msgs WHERE id = $1 AND "+sqlNotExpired(2),
+		id, time.Now().UnixNano())
+	msg, err := scanSQLMsg(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMsgNotFound{}
+		}
+		log.Error("Failed to find msg: ", err.Error())
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *sqlMsgDB) GetAllMsgs(ctx context.Context) ([]*Msg, error) {
+	return s.queryMsgs(ctx, "SELECT "+sqlMsgColumns+" FROM msgs WHERE "+sqlNotExpired(1), time.Now().UnixNano())
+}
+
+// ForEachMsg reads the messages in batches sorted by id, so fn doesn't hold a connection while it runs (sqlite only
+// has one)
+func (s *sqlMsgDB) ForEachMsg(ctx context.Context, fn func(msg *Msg) error) error {
+	after := ""
+	for {
+		batch, err := s.queryMsgs(ctx, "SELECT "+sqlMsgColumns+" FROM msgs WHERE id > $1 AND "+sqlNotExpired(3)+
+			" ORDER BY id LIMIT $2", after, iterBatchSize, time.Now().UnixNano())
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range batch {
+			err = fn(msg)
+			if err != nil {
+				return err
+			}
+		}
+		if len(batch) < iterBatchSize {
+			return nil
+		}
+		after = batch[len(batch)-1].Id
+	}
+}
+
+func (s *sqlMsgDB) ListMsgs(ctx context.Context, opts ListOptions) (*MsgPage, error) {
+	cursor, err := validateListOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{opts.Limit + 1, time.Now().UnixNano()}
+	// arg adds an argument to the query and returns its placeholder
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conds := append([]string{sqlNotExpired(2)}, sqlFilterConds(opts.Filter, arg)...)
+	// (mod_time, id) is indexed, so the default page is found without scanning the msgs before the cursor
+	sortExpr := map[SortField]string{
+		SortByModTime:           "mod_time",
+		SortById:                "id",
+		SortByContentLength:     "LENGTH(content)",
+		SortByLongestPalindrome: "longest_palindrome_length",
+	}[opts.sortField()]
+	cmp, dir := ">", "ASC"
+	if opts.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if cursor != nil {
+		id := arg(cursor.Id)
+		switch opts.sortField() {
+		case SortByModTime:
+			value := arg(cursor.ModTime)
+			conds = append(conds, "(mod_time "+cmp+" "+value+" OR (mod_time = "+value+" AND id "+cmp+" "+id+"))")
+		case SortByContentLength:
+			value := arg(cursor.Length)
+			conds = append(conds, "(LENGTH(content) "+cmp+" "+value+
+				" OR (LENGTH(content) = "+value+" AND id "+cmp+" "+id+"))")
+		case SortByLongestPalindrome:
+			value := arg(cursor.PalindromeLength)
+			conds = append(conds, "(longest_palindrome_length "+cmp+" "+value+
+				" OR (longest_palindrome_length = "+value+" AND id "+cmp+" "+id+"))")
+		default:
+			conds = append(conds, "id "+cmp+" "+id)
+		}
+	}
+
+	query := "SELECT " + sqlMsgColumns + " FROM msgs WHERE " + strings.Join(conds, " AND ")
+	if opts.sortField() != SortById {
+		query += " ORDER BY " + sortExpr + " " + dir + ", id " + dir + " LIMIT $1"
+	} else {
+		query += " ORDER BY id " + dir + " LIMIT $1"
+	}
+
+	msgs, err := s.queryMsgs(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return newMsgPage(msgs, opts), nil
+}
+
+// sqlFilterConds returns the conditions of the WHERE clause that select the msgs of f, arg adds their arguments
+// the content length is in characters in both dialects; the id prefix is compared with SUBSTR rather than LIKE, which
+// ignores the case in sqlite
+func sqlFilterConds(f MsgFilter, arg func(v interface{}) string) []string {
+	var conds []string
+	if f.IsPalindrome != nil {
+		conds = append(conds, "is_palindrome = "+arg(*f.IsPalindrome))
+	}
+	if f.ModifiedSince != nil {
+		conds = append(conds, "mod_time >= "+arg(f.ModifiedSince.UnixNano()))
+	}
+	if f.ModifiedBefore != nil {
+		conds = append(conds, "mod_time < "+arg(f.ModifiedBefore.UnixNano()))
+	}
+	if f.IdPrefix != "" {
+		conds = append(conds, "SUBSTR(id, 1, "+arg(utf8.RuneCountInString(f.IdPrefix))+") = "+arg(f.IdPrefix))
+	}
+	if f.MinLength != nil {
+		conds = append(conds, "LENGTH(content) >= "+arg(*f.MinLength))
+	}
+	if f.MaxLength != nil {
+		conds = append(conds, "LENGTH(content) <= "+arg(*f.MaxLength))
+	}
+	if f.MinPalindromeLength != nil {
+		conds = append(conds, "longest_palindrome_length >= "+arg(*f.MinPalindromeLength))
+	}
+	if f.MaxPalindromeLength != nil {
+		conds = append(conds, "longest_palindrome_length <= "+arg(*f.MaxPalindromeLength))
+	}
+	return conds
+}
+
+// SearchMsgs checks every msg, there is no index to search with
+func (s *sqlMsgDB) SearchMsgs(ctx context.Context, query string, limit int) ([]*SearchResult, error) {
+	return searchAllMsgs(ctx, s, query, limit)
+}
+
+// queryMsgs runs a query selecting sqlMsgColumns and returns the msgs it found
+func (s *sqlMsgDB) queryMsgs(ctx context.Context, query string, args ...interface{}) ([]*Msg, error) {
+	msgs := []*Msg{}
+
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Error("Failed to query msgs: ", err.Error())
+		return msgs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanSQLMsg(rows)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, rows.Err()
+}
+
+func (s *sqlMsgDB) GetRevisions(ctx context.Context, id string) ([]*Revision, error) {
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+
+	revisions := []*Revision{}
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRowContext(ctx, "SELECT 1 FROM msgs WHERE id = $1 AND "+sqlNotExpired(2), id,
+			time.Now().UnixNano()).Scan(&exists)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMsgNotFound{}
+			}
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, "SELECT version, content, is_palindrome, palindrome_profile, mod_time "+
+			"FROM msg_revisions "+
+			"WHERE id = $1 ORDER BY version", id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			rev := &Revision{}
+			var modTime int64
+			err = rows.Scan(&rev.Version, &rev.Content, &rev.IsPalindrome, &rev.PalindromeProfile, &modTime)
+			if err != nil {
+				return err
+			}
+			rev.ModTime = time.Unix(0, modTime)
+			revisions = append(revisions, rev)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		if !IsErrMsgNotFound(err) {
+			log.Error("Failed to query revisions: ", err.Error())
+		}
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+func (s *sqlMsgDB) GetRevision(ctx context.Context, id string, version int64) (*Revision, error) {
+	revisions, err := s.GetRevisions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return findRevision(revisions, version)
+}
+
+func (s *sqlMsgDB) CreateMsg(ctx context.Context, msg *Msg) error {
+	var stored *Msg
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		stored, err = createSQLMsg(ctx, tx, msg)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	s.events.publish(MsgCreated, stored)
+	return nil
+}
+
+func (s *sqlMsgDB) UpdateMsg(ctx context.Context, msg *Msg) error {
+	return s.updateMsg(ctx, msg, anyVersion)
+}
+
+func (s *sqlMsgDB) UpdateMsgIfVersion(ctx context.Context, msg *Msg, version int64) error {
+	return s.updateMsg(ctx, msg, version)
+}
+
+func (s *sqlMsgDB) updateMsg(ctx context.Context, msg *Msg, version int64) error {
+	var stored *Msg
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		stored, err = updateSQLMsg(ctx, tx, msg, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Version = stored.Version
+	s.events.publish(MsgUpdated, stored)
+	return nil
+}
+
+func (s *sqlMsgDB) DeleteMsg(ctx context.Context, id string) error {
+	return s.deleteMsg(ctx, id, anyVersion)
+}
+
+func (s *sqlMsgDB) DeleteMsgIfVersion(ctx context.Context, id string, version int64) error {
+	return s.deleteMsg(ctx, id, version)
+}
+
+func (s *sqlMsgDB) deleteMsg(ctx context.Context, id string, version int64) error {
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	var trashed *Msg
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		trashed, err = trashSQLMsg(ctx, tx, id, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.events.publish(MsgDeleted, trashed)
+	return nil
+}
+
+// ApplyBatch applies atomic batches in a single transaction, bounded by the operation timeout as a whole
+func (s *sqlMsgDB) ApplyBatch(ctx context.Context, ops []*BatchOp, atomic bool) ([]error, error) {
+	if !atomic {
+		return applyBatchOps(ctx, s, ops), nil
+	}
+
+	var stored []*Msg
+	var failure *batchFailure
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		stored, failure = runBatch(ops, func(op *BatchOp) (*Msg, error) {
+			switch op.Type {
+			case BatchCreate:
+				return createSQLMsg(ctx, tx, op.Msg)
+			case BatchUpdate:
+				return updateSQLMsg(ctx, tx, op.Msg, op.version())
+			default:
+				return trashSQLMsg(ctx, tx, op.id(), op.version())
+			}
+		})
+		if failure != nil {
+			return failure
+		}
+		return nil
+	})
+	if failure != nil {
+		return failure.results(len(ops)), nil
+	}
+	if err != nil {
+		log.Error("Failed to apply batch: ", err.Error())
+		return nil, err
+	}
+
+	setBatchVersions(ops, stored)
+	s.events.publishBatch(ops, stored)
+	return make([]error, len(ops)), nil
+}
+
+func (s *sqlMsgDB) Watch(ctx context.Context, after string) (<-chan *MsgEvent, error) {
+	return s.events.watch(ctx, after)
+}
+
+func (s *sqlMsgDB) GetTrashedMsgs(ctx context.Context) ([]*Msg, error) {
+	msgs := []*Msg{}
+
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, "SELECT "+sqlTrashColumns+" FROM msg_trash WHERE "+sqlNotExpired(1),
+		time.Now().UnixNano())
+	if err != nil {
+		log.Error("Failed to query trashed msgs: ", err.Error())
+		return msgs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		msg, err := scanSQLTrashedMsg(rows)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, rows.Err()
+}
+
+func (s *sqlMsgDB) RestoreMsg(ctx context.Context, id string) error {
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	var restored *Msg
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, "DELETE FROM msg_trash WHERE id = $1 AND "+sqlNotExpired(2)+
+			" RETURNING "+sqlMsgColumns, id, time.Now().UnixNano())
+		msg, err := scanSQLMsg(row)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return ErrMsgNotFound{}
+			}
+			log.Error("Failed to remove msg from trash: ", err.Error())
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO msgs ("+sqlMsgColumns+") VALUES ("+sqlPlaceholders(1, sqlMsgArgsLen)+")",
+			sqlMsgArgs(msg, msg.Version)...)
+		if err != nil {
+			log.Error("Failed to restore msg: ", err.Error())
+		}
+		restored = msg
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.events.publish(MsgCreated, restored)
+	return nil
+}
+
+func (s *sqlMsgDB) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	var purged int64
+
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM msg_revisions WHERE id IN "+
+			"(SELECT id FROM msg_trash WHERE deleted_at < $1)", before.UnixNano())
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, "DELETE FROM msg_trash WHERE deleted_at < $1", before.UnixNano())
+		if err != nil {
+			return err
+		}
+		purged, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		log.Error("Failed to purge trash: ", err.Error())
+		return 0, err
+	}
+
+	return int(purged), nil
+}
+
+func (s *sqlMsgDB) PurgeExpired(ctx context.Context) (int, error) {
+	var purged int64
+	now := time.Now().UnixNano()
+
+	ctx, cancel := opContext(ctx, s.opTimeout)
+	defer cancel()
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM msg_revisions WHERE id IN (SELECT id FROM msgs WHERE expires_at <= $1 "+
+			"UNION SELECT id FROM msg_trash WHERE expires_at <= $1)", now)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"msgs", "msg_trash"} {
+			result, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE expires_at <= $1", now)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			purged += n
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to purge expired msgs: ", err.Error())
+		return 0, err
+	}
+
+	return int(purged), nil
+}
+
+// withTx runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise
+// only tx must be used within fn: the sqlite db has a single connection, which the transaction holds
+func (s *sqlMsgDB) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Failed to begin transaction: ", err.Error())
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createSQLMsg inserts msg in tx, returns the msg as it was stored
+func createSQLMsg(ctx context.Context, tx *sql.Tx, msg *Msg) (*Msg, error) {
+	stored := *msg
+	stored.Version = initialVersion
+
+	// an expired msg with the same id is removed first, to free its id
+	_, err := tx.ExecContext(ctx, "DELETE FROM msgs WHERE id = $1 AND expires_at <= $2", msg.Id, time.Now().UnixNano())
+	if err != nil {
+		log.Error("Failed to delete expired msg: ", err.Error())
+		return nil, err
+	}
+
+	// the primary key on id makes the insert a noop when the id is already in use
+	result, err := tx.ExecContext(ctx, "INSERT INTO msgs ("+sqlMsgColumns+") VALUES ("+sqlPlaceholders(1, sqlMsgArgsLen)+
+		") ON CONFLICT (id) DO NOTHING", sqlMsgArgs(msg, stored.Version)...)
+	if err != nil {
+		log.Error("Failed to insert msg: ", err.Error())
+		return nil, err
+	}
+	err = expectOneRow(result, ErrIdUnavailable{})
+	if err != nil {
+		return nil, err
+	}
+
+	// a trashed (or expired) msg with the same id is purged, the new one starts its own revisions
+	for _, query := range []string{"DELETE FROM msg_trash WHERE id = $1", "DELETE FROM msg_revisions WHERE id = $1"} {
+		_, err = tx.ExecContext(ctx, query, msg.Id)
+		if err != nil {
+			log.Error("Failed to purge trashed msg: ", err.Error())
+			return nil, err
+		}
+	}
+	err = insertSQLRevision(ctx, tx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// updateSQLMsg updates the msg with the id of msg in tx, if it has the version provided (unless anyVersion)
+// returns the msg as it was stored
+func updateSQLMsg(ctx context.Context, tx *sql.Tx, msg *Msg, version int64) (*Msg, error) {
+	query := "UPDATE msgs SET content = $1, is_palindrome = $2, is_word_palindrome = $3, palindrome_profile = $4, " +
+		"longest_palindrome = $5, longest_palindrome_offset = $6, longest_palindrome_length = $7, properties = $8, " +
+		"mod_time = $9, version = version + 1 WHERE id = $10 AND " + sqlNotExpired(11)
+	args := []interface{}{msg.Content, msg.IsPalindrome, msg.IsWordPalindrome, string(msg.PalindromeProfile),
+		msg.LongestPalindrome.Text, msg.LongestPalindrome.Offset, msg.LongestPalindrome.Length,
+		encodeMsgProperties(msg.Properties), msg.ModTime.UnixNano(), msg.Id, time.Now().UnixNano()}
+	if version != anyVersion {
+		query += " AND version = $12"
+		args = append(args, version)
+	}
+	query += " RETURNING version, expires_at"
+
+	stored := *msg
+	var expiresAt sql.NullInt64
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&stored.Version, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, missedRowErr(ctx, tx, msg.Id, version)
+		}
+		log.Error("Failed to update msg: ", err.Error())
+		return nil, err
+	}
+	stored.ExpiresAt = sqlTime(expiresAt)
+	err = insertSQLRevision(ctx, tx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// trashSQLMsg moves the msg with the id provided to the trash in tx, if it has the version provided (unless
+// anyVersion), returns the msg as it was trashed
+func trashSQLMsg(ctx context.Context, tx *sql.Tx, id string, version int64) (*Msg, error) {
+	query := "DELETE FROM msgs WHERE id = $1 AND " + sqlNotExpired(2)
+	args := []interface{}{id, time.Now().UnixNano()}
+	if version != anyVersion {
+		query += " AND version = $3"
+		args = append(args, version)
+	}
+	query += " RETURNING " + sqlMsgColumns
+
+	msg, err := scanSQLMsg(tx.QueryRowContext(ctx, query, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, missedRowErr(ctx, tx, id, version)
+		}
+		log.Error("Failed to delete msg: ", err.Error())
+		return nil, err
+	}
+
+	deletedAt := time.Now()
+	_, err = tx.ExecContext(ctx, "INSERT INTO msg_trash ("+sqlTrashColumns+") VALUES ("+
+		sqlPlaceholders(1, sqlMsgArgsLen+1)+")", append(sqlMsgArgs(msg, msg.Version), deletedAt.UnixNano())...)
+	if err != nil {
+		log.Error("Failed to move msg to trash: ", err.Error())
+		return nil, err
+	}
+	msg.DeletedAt = &deletedAt
+	return msg, nil
+}
+
+// insertSQLRevision records the revision of msg in tx
+func insertSQLRevision(ctx context.Context, tx *sql.Tx, msg *Msg) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO msg_revisions (id, version, content, is_palindrome, palindrome_profile, "+
+		"mod_time) VALUES ($1, $2, $3, $4, $5, $6)", msg.Id, msg.Version, msg.Content, msg.IsPalindrome,
+		string(msg.PalindromeProfile), msg.ModTime.UnixNano())
+	if err != nil {
+		log.Error("Failed to insert msg revision: ", err.Error())
+	}
+	return err
+}
+
+// missedRowErr tells why a statement on the msg with the id and version provided didn't affect any row: either the
+// msg doesn't exist (ErrMsgNotFound) or its version is not the one expected (ErrVersionConflict)
+func missedRowErr(ctx context.Context, tx *sql.Tx, id string, version int64) error {
+	if version == anyVersion {
+		return ErrMsgNotFound{}
+	}
+
+	var stored int64
+	err := tx.QueryRowContext(ctx, "SELECT version FROM msgs WHERE id = $1 AND "+sqlNotExpired(2), id,
+		time.Now().UnixNano()).Scan(&stored)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ErrMsgNotFound{}
+		}
+		log.Error("Failed to find msg: ", err.Error())
+		return err
+	}
+	return ErrVersionConflict{}
+}
+
+// sqlScanner is implemented by both *sql.Row and *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLMsg(row sqlScanner) (*Msg, error) {
+	msg := &Msg{}
+	var modTime int64
+	var props string
+	var expiresAt sql.NullInt64
+	err := row.Scan(&msg.Id, &msg.Content, &msg.IsPalindrome, &msg.IsWordPalindrome, &msg.PalindromeProfile,
+		&msg.LongestPalindrome.Text, &msg.LongestPalindrome.Offset, &msg.LongestPalindrome.Length, &props, &modTime,
+		&msg.Version, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties, err = decodeMsgProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	msg.ModTime = time.Unix(0, modTime)
+	msg.ExpiresAt = sqlTime(expiresAt)
+
+	return msg, nil
+}
+
+func scanSQLTrashedMsg(row sqlScanner) (*Msg, error) {
+	msg := &Msg{}
+	var modTime, deletedAt int64
+	var props string
+	var expiresAt sql.NullInt64
+	err := row.Scan(&msg.Id, &msg.Content, &msg.IsPalindrome, &msg.IsWordPalindrome, &msg.PalindromeProfile,
+		&msg.LongestPalindrome.Text, &msg.LongestPalindrome.Offset, &msg.LongestPalindrome.Length, &props, &modTime,
+		&msg.Version, &expiresAt, &deletedAt)
+	if err != nil {
+		return nil, err
+	}
+	msg.Properties, err = decodeMsgProperties(props)
+	if err != nil {
+		return nil, err
+	}
+	msg.ModTime = time.Unix(0, modTime)
+	msg.ExpiresAt = sqlTime(expiresAt)
+	deletedTime := time.Unix(0, deletedAt)
+	msg.DeletedAt = &deletedTime
+
+	return msg, nil
+}
+
+// sqlMsgArgs are the values of the sqlMsgColumns of msg, stored with the version provided
+func sqlMsgArgs(msg *Msg, version int64) []interface{} {
+	return []interface{}{msg.Id, msg.Content, msg.IsPalindrome, msg.IsWordPalindrome, string(msg.PalindromeProfile),
+		msg.LongestPalindrome.Text, msg.LongestPalindrome.Offset, msg.LongestPalindrome.Length,
+		encodeMsgProperties(msg.Properties), msg.ModTime.UnixNano(), version, sqlExpiresAt(msg)}
+}
+
+// sqlPlaceholders returns n comma separated placeholders, numbered from the one provided
+func sqlPlaceholders(from, n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(from+i)
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// sqlNotExpired is the condition on the msgs that haven't expired, given the current time as the nth argument
+func sqlNotExpired(n int) string {
+	return "(expires_at IS NULL OR expires_at > $" + strconv.Itoa(n) + ")"
+}
+
+// sqlExpiresAt is the value of the expires_at column of msg
+func sqlExpiresAt(msg *Msg) interface{} {
+	if msg.ExpiresAt == nil {
+		return nil
+	}
+	return msg.ExpiresAt.UnixNano()
+}
+
+// sqlTime converts a nullable unix nanoseconds column into a time, nil if NULL
+func sqlTime(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := time.Unix(0, value.Int64)
+	return &t
+}
+
+// expectOneRow returns errNoRows if the statement that produced result didn't affect any row
+func expectOneRow(result sql.Result, errNoRows error) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNoRows
+	}
+	return nil
+}
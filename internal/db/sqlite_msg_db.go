@@ -0,0 +1,135 @@
+package db
+
+import (
+	"database/sql"
+	log "github.com/sirupsen/logrus"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the pure go "sqlite" driver
+)
+
+const (
+	DefaultSQLitePath = "palermo.sqlite"
+)
+
+// sqliteMigrations is the versioned schema of the sqlite msg db, new migrations must only be appended
+var sqliteMigrations = []migration{
+	{
+		description: "create msgs table",
+		statements: []string{
+			`CREATE TABLE msgs (
+				id            TEXT    NOT NULL PRIMARY KEY,
+				content       TEXT    NOT NULL,
+				is_palindrome BOOLEAN NOT NULL,
+				mod_time      INTEGER NOT NULL
+			)`,
+		},
+	},
+	{
+		description: "index msgs by mod time",
+		statements: []string{
+			`CREATE INDEX msgs_mod_time_idx ON msgs (mod_time, id)`,
+		},
+	},
+	{
+		description: "add msg versions",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		description: "create msg revisions table",
+		statements: []string{
+			`CREATE TABLE msg_revisions (
+				id            TEXT    NOT NULL,
+				version       INTEGER NOT NULL,
+				content       TEXT    NOT NULL,
+				is_palindrome BOOLEAN NOT NULL,
+				mod_time      INTEGER NOT NULL,
+				PRIMARY KEY (id, version)
+			)`,
+		},
+	},
+	{
+		description: "create msg trash table",
+		statements: []string{
+			`CREATE TABLE msg_trash (
+				id            TEXT    NOT NULL PRIMARY KEY,
+				content       TEXT    NOT NULL,
+				is_palindrome BOOLEAN NOT NULL,
+				mod_time      INTEGER NOT NULL,
+				version       INTEGER NOT NULL,
+				deleted_at    INTEGER NOT NULL
+			)`,
+			`CREATE INDEX msg_trash_deleted_at_idx ON msg_trash (deleted_at)`,
+		},
+	},
+	{
+		description: "add msg expiry",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN expires_at INTEGER`,
+			`ALTER TABLE msg_trash ADD COLUMN expires_at INTEGER`,
+			`CREATE INDEX msgs_expires_at_idx ON msgs (expires_at)`,
+		},
+	},
+	{
+		description: "add msg palindrome profiles",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN palindrome_profile TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE msg_trash ADD COLUMN palindrome_profile TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE msg_revisions ADD COLUMN palindrome_profile TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		description: "add msg longest palindromes",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN longest_palindrome TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE msgs ADD COLUMN longest_palindrome_offset INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE msgs ADD COLUMN longest_palindrome_length INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE msg_trash ADD COLUMN longest_palindrome TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE msg_trash ADD COLUMN longest_palindrome_offset INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE msg_trash ADD COLUMN longest_palindrome_length INTEGER NOT NULL DEFAULT 0`,
+			`CREATE INDEX msgs_longest_palindrome_length_idx ON msgs (longest_palindrome_length, id)`,
+		},
+	},
+	{
+		description: "add msg word palindromes",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN is_word_palindrome BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE msg_trash ADD COLUMN is_word_palindrome BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+	{
+		description: "add msg properties",
+		statements: []string{
+			`ALTER TABLE msgs ADD COLUMN properties TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE msg_trash ADD COLUMN properties TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// SQLiteMsgDB stores the messages in a sqlite file through a pure go driver (no cgo required)
+type SQLiteMsgDB struct {
+	sqlMsgDB
+}
+
+// NewSQLiteMsgDB opens (or creates) the sqlite file at the path provided and migrates its schema
+// opTimeout is the max time a single operation can take, default value to use is DefaultOpTimeout
+func NewSQLiteMsgDB(path string, opTimeout time.Duration) (*SQLiteMsgDB, error) {
+	sqlDb, err := sql.Open("sqlite", path)
+	if err != nil {
+		log.Errorf("Failed to open sqlite db at path: %s; err: %s", path, err.Error())
+		return nil, err
+	}
+	// sqlite allows a single writer at a time, sharing one connection avoids SQLITE_BUSY errors
+	sqlDb.SetMaxOpenConns(1)
+
+	err = migrate(sqlDb, sqliteMigrations)
+	if err != nil {
+		_ = sqlDb.Close()
+		return nil, err
+	}
+	log.Debug("Successfully opened sqlite db at: ", path)
+
+	return &SQLiteMsgDB{sqlMsgDB{db: sqlDb, opTimeout: opTimeout}}, nil
+}
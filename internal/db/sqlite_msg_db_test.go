@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteMsgDB(t *testing.T) *SQLiteMsgDB {
+	db, err := NewSQLiteMsgDB(filepath.Join(t.TempDir(), "test.sqlite"), DefaultOpTimeout)
+	assert.Nil(t, err)
+	return db
+}
+
+func TestNewSQLiteMsgDB(t *testing.T) {
+	db := newTestSQLiteMsgDB(t)
+	defer db.Close()
+	assert.NotNil(t, db.db)
+
+	var version int
+	err := db.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	assert.Nil(t, err)
+	assert.Equal(t, len(sqliteMigrations), version)
+}
+
+func TestSQLiteMsgDB_Persistence(t *testing.T) {
+	// messages must still be there after closing and reopening the file, migrations must not run twice
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "test.sqlite")
+	db, err := NewSQLiteMsgDB(path, DefaultOpTimeout)
+	assert.Nil(t, err)
+
+	msg := NewMsg("elephant", "never forgets")
+	err = db.CreateMsg(ctx, msg)
+	assert.Nil(t, err)
+	db.Close()
+
+	db, err = NewSQLiteMsgDB(path, DefaultOpTimeout)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	retMsg, err := db.GetMsg(ctx, "elephant")
+	assert.Nil(t, err)
+	assert.Equal(t, msg.Content, retMsg.Content)
+	assert.True(t, msg.ModTime.Equal(retMsg.ModTime))
+}
+
+func TestSQLiteMsgDB_OpTimeout(t *testing.T) {
+	// the operations that can't finish within the op timeout are canceled
+	db, err := NewSQLiteMsgDB(filepath.Join(t.TempDir(), "test.sqlite"), time.Nanosecond)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	err = db.CreateMsg(context.Background(), NewMsg("elephant", "never forgets"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = db.GetAllMsgs(context.Background())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	err = db.ForEachMsg(context.Background(), func(msg *Msg) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	DefaultTrashRetention     = 30 * 24 * time.Hour
+	DefaultTrashPurgeInterval = time.Hour
+)
+
+// TrashPurger periodically purges the msgs that have been in the trash of a MsgDB for longer than its retention
+type TrashPurger struct {
+	msgDb     MsgDB
+	retention time.Duration
+	task      *periodicTask // nil when disabled
+}
+
+// NewTrashPurger starts purging the trash of msgDb every interval, the msgs deleted more than retention ago are purged
+// a retention <= 0 keeps trashed msgs until they are restored, and an interval <= 0 disables the purge, in both cases
+// nothing is started
+func NewTrashPurger(msgDb MsgDB, retention, interval time.Duration) *TrashPurger {
+	p := &TrashPurger{
+		msgDb:     msgDb,
+		retention: retention,
+	}
+	if retention > 0 && interval > 0 {
+		p.task = startPeriodicTask(interval, p.purge)
+	}
+
+	return p
+}
+
+// Stop stops purging and waits for an ongoing purge to finish, it must be called before closing the msg db
+func (p *TrashPurger) Stop() {
+	if p.task != nil {
+		p.task.Stop()
+	}
+}
+
+// purge purges the msgs deleted before the retention
+func (p *TrashPurger) purge() {
+	purged, err := p.msgDb.PurgeTrash(context.Background(), time.Now().Add(-p.retention))
+	if err != nil {
+		log.Error("Failed to purge trash: ", err.Error())
+		return
+	}
+	if purged > 0 {
+		log.Debugf("Purged %d messages from the trash", purged)
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTrashPurger(t *testing.T) {
+	ctx := context.Background()
+	db := NewBasicMsgDB()
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	assert.Nil(t, db.DeleteMsg(ctx, "unicorn"))
+
+	purger := NewTrashPurger(db, time.Millisecond, 5*time.Millisecond)
+	defer purger.Stop()
+	assert.Eventually(t, func() bool {
+		trashed, err := db.GetTrashedMsgs(ctx)
+		return err == nil && len(trashed) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestTrashPurger_NoRetention(t *testing.T) {
+	ctx := context.Background()
+	db := NewBasicMsgDB()
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	assert.Nil(t, db.DeleteMsg(ctx, "unicorn"))
+
+	purger := NewTrashPurger(db, 0, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	purger.Stop()
+
+	trashed, err := db.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trashed))
+}
+
+func TestTrashPurger_NoInterval(t *testing.T) {
+	ctx := context.Background()
+	db := NewBasicMsgDB()
+	assert.Nil(t, db.CreateMsg(ctx, NewMsg("unicorn", "kayak")))
+	assert.Nil(t, db.DeleteMsg(ctx, "unicorn"))
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		purger := NewTrashPurger(db, time.Millisecond, interval)
+		time.Sleep(20 * time.Millisecond)
+		purger.Stop()
+	}
+
+	trashed, err := db.GetTrashedMsgs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(trashed))
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBatchOps = 1000
+)
+
+// batchReq is the body of a batch request: the ops to apply in order, either independently or, if atomic, all or none
+type batchReq struct {
+	Atomic bool         `json:"atomic"`
+	Ops    []batchOpReq `json:"ops"`
+}
+
+// batchOpReq is an op of a batch request: create takes the fields of a createMsg request, update an id and content,
+// delete only an id. Update and delete can be made conditional with ifVersion
+type batchOpReq struct {
+	Op string `json:"op"`
+	createMsgReq
+	IfVersion int64 `json:"ifVersion"`
+}
+
+// batchOpResult is the result of an op of a batch request: the status code it would get as a single request, along
+// with the msg created or updated if it succeeded, or the error otherwise
+type batchOpResult struct {
+	Status  int     `json:"status"`
+	Message *db.Msg `json:"message,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// HandleBatch applies the creations, updates and deletions of the request in order, replying with the result of each
+func (rp *Repository) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		handleReqErr(w, "Unsupported content type", http.StatusUnsupportedMediaType, "")
+		return
+	}
+
+	var req batchReq
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		handleReqErr(w, "Failed to decode body into batch object", http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Ops) == 0 || len(req.Ops) > maxBatchOps {
+		handleReqErr(w, "A batch must have between 1 and "+strconv.Itoa(maxBatchOps)+" operations",
+			http.StatusBadRequest, "")
+		return
+	}
+
+	results := make([]batchOpResult, len(req.Ops))
+	var ops []*db.BatchOp
+	var opIndexes []int // index in the request of each of ops
+	for i, opReq := range req.Ops {
+		op, errMsg := rp.newBatchOp(opReq)
+		if op == nil {
+			results[i] = batchOpResult{Status: http.StatusBadRequest, Error: errMsg}
+			continue
+		}
+		ops = append(ops, op)
+		opIndexes = append(opIndexes, i)
+	}
+
+	if req.Atomic && len(ops) < len(req.Ops) {
+		// the invalid ops abort the whole batch, no need to bother the db
+		for i := range results {
+			if results[i].Status == 0 {
+				results[i] = batchOpResult{Status: http.StatusFailedDependency, Error: db.ErrBatchAborted{}.Error()}
+			}
+		}
+		log.Debug("Atomic batch rejected due to invalid operations")
+		writeJsonResp(w, map[string]interface{}{"results": results}, "batch results")
+		return
+	}
+
+	opErrs, err := rp.msgDb.ApplyBatch(r.Context(), ops, req.Atomic)
+	if err != nil {
+		handleReqErr(w, "Unexpected error during application of batch", http.StatusInternalServerError, err.Error())
+		return
+	}
+	for j, op := range ops {
+		results[opIndexes[j]] = newBatchOpResult(op, opErrs[j])
+	}
+
+	log.Debugf("Successfully applied batch of %d operations", len(req.Ops))
+
+	writeJsonResp(w, map[string]interface{}{"results": results}, "batch results")
+}
+
+// newBatchOp returns the db op requested by opReq, or nil and why it's not valid
+func (rp *Repository) newBatchOp(opReq batchOpReq) (*db.BatchOp, string) {
+	id := strings.TrimSpace(opReq.Id)
+	if id == "" {
+		return nil, "Message id must not be empty"
+	}
+	profile, err := rp.msgProfile(opReq.PalindromeProfile)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	switch db.BatchOpType(opReq.Op) {
+	case db.BatchCreate:
+		expiresAt, err := msgExpiry(opReq.ExpiresAt, opReq.TTL)
+		if err != nil {
+			return nil, "Invalid expiry: " + err.Error()
+		}
+		// the NewMsg constructor will add the mod time and determine if it's a palindrome:
+		msg := db.NewMsgWithProfile(id, opReq.Content, profile)
+		msg.ExpiresAt = expiresAt
+		return &db.BatchOp{Type: db.BatchCreate, Msg: msg}, ""
+	case db.BatchUpdate:
+		return &db.BatchOp{Type: db.BatchUpdate, Msg: db.NewMsgWithProfile(id, opReq.Content, profile), IfVersion: opReq.IfVersion}, ""
+	case db.BatchDelete:
+		return &db.BatchOp{Type: db.BatchDelete, Id: id, IfVersion: opReq.IfVersion}, ""
+	default:
+		return nil, "Unknown operation " + strconv.Quote(opReq.Op) + ", must be create, update or delete"
+	}
+}
+
+// newBatchOpResult returns the result of op given the error it got from the db, with the codes the single requests use
+func newBatchOpResult(op *db.BatchOp, err error) batchOpResult {
+	if err == nil {
+		return batchOpResult{Status: http.StatusOK, Message: op.Msg}
+	}
+
+	id := op.Id
+	if op.Msg != nil {
+		id = op.Msg.Id
+	}
+	switch {
+	case db.IsErrIdUnavailable(err):
+		return batchOpResult{Status: http.StatusConflict, Error: id + " is already in use"}
+	case db.IsErrMsgNotFound(err):
+		return batchOpResult{Status: http.StatusNotFound, Error: "Msg with id " + id + " was not found"}
+	case db.IsErrVersionConflict(err):
+		return batchOpResult{Status: http.StatusPreconditionFailed,
+			Error: "Msg with id " + id + " was modified since the version provided"}
+	case db.IsErrInvalidBatchOp(err):
+		return batchOpResult{Status: http.StatusBadRequest, Error: err.Error()}
+	case db.IsErrBatchAborted(err):
+		return batchOpResult{Status: http.StatusFailedDependency, Error: err.Error()}
+	default:
+		log.Error("Batch operation on msg with id "+id+" failed: ", err.Error())
+		return batchOpResult{Status: http.StatusInternalServerError, Error: "Unexpected error during the operation"}
+	}
+}
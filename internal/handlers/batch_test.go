@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveBatch sends the batch request with the body provided, returning the code and the results replied
+func serveBatch(t *testing.T, rp *Repository, body string) (int, []batchOpResult) {
+	req := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+	req.Header.Set("content-type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleBatch).ServeHTTP(rr, req)
+
+	var resp struct {
+		Results []batchOpResult `json:"results"`
+	}
+	if rr.Code == http.StatusOK {
+		assert.Nil(t, json.NewDecoder(rr.Body).Decode(&resp))
+	}
+	return rr.Code, resp.Results
+}
+
+func TestRepository_HandleBatch(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+	rp := NewRepository(basicDb)
+
+	code, results := serveBatch(t, rp, `{"ops": [
+		{"op": "create", "id": "unicorn", "content": "kayak"},
+		{"op": "create", "id": "unicorn", "content": "canoe"},
+		{"op": "update", "id": "unicorn", "content": "racecar", "ifVersion": 1},
+		{"op": "update", "id": "elephant", "content": "trunk"},
+		{"op": "delete", "id": "banana", "ifVersion": 3},
+		{"op": "peel", "id": "banana"},
+		{"op": "delete", "id": " "}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if !assert.Equal(t, 7, len(results)) {
+		return
+	}
+	var statuses []int
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusConflict, http.StatusOK, http.StatusNotFound,
+		http.StatusPreconditionFailed, http.StatusBadRequest, http.StatusBadRequest}, statuses)
+	if assert.NotNil(t, results[2].Message) {
+		assert.Equal(t, int64(2), results[2].Message.Version)
+		assert.True(t, results[2].Message.IsPalindrome)
+	}
+
+	msg, err := basicDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "racecar", msg.Content)
+	_, err = basicDb.GetMsg(ctx, "banana")
+	assert.Nil(t, err)
+}
+
+func TestRepository_HandleBatch_Atomic(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+	rp := NewRepository(basicDb)
+
+	// the deletion fails, so the creation is rolled back
+	code, results := serveBatch(t, rp, `{"atomic": true, "ops": [
+		{"op": "create", "id": "unicorn", "content": "kayak"},
+		{"op": "delete", "id": "banana", "ifVersion": 3}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Equal(t, 2, len(results)) {
+		assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+		assert.Equal(t, http.StatusPreconditionFailed, results[1].Status)
+	}
+	_, err := basicDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	// an invalid op aborts the batch too
+	code, results = serveBatch(t, rp, `{"atomic": true, "ops": [
+		{"op": "create", "id": "unicorn", "content": "kayak"},
+		{"op": "create", "id": "pony", "content": "kayak", "ttl": "soon"}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Equal(t, 2, len(results)) {
+		assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+	}
+	_, err = basicDb.GetMsg(ctx, "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+
+	code, results = serveBatch(t, rp, `{"atomic": true, "ops": [
+		{"op": "create", "id": "unicorn", "content": "kayak"},
+		{"op": "delete", "id": "banana", "ifVersion": 1}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Equal(t, 2, len(results)) {
+		assert.Equal(t, http.StatusOK, results[0].Status)
+		assert.Equal(t, http.StatusOK, results[1].Status)
+	}
+	_, err = basicDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	_, err = basicDb.GetMsg(ctx, "banana")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+func TestRepository_HandleBatch_BadRequest(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	code, _ := serveBatch(t, rp, `{"ops": [`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = serveBatch(t, rp, `{"ops": []}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	ops := make([]string, maxBatchOps+1)
+	for i := range ops {
+		ops[i] = `{"op": "delete", "id": "unicorn"}`
+	}
+	code, _ = serveBatch(t, rp, `{"ops": [`+strings.Join(ops, ",")+`]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestRepository_HandleBatch_UnsupportedMediaType(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	req := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(`{"ops": []}`))
+	req.Header.Set("content-type", "text/plain")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleBatch).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestRepository_HandleBatch_PalindromeProfile(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	code, results := serveBatch(t, rp, `{"ops": [
+		{"op": "create", "id": "panama", "content": "A man, a plan, a canal: Panama", "palindromeProfile": "alphanumeric"},
+		{"op": "create", "id": "unicorn", "content": "Kayak"},
+		{"op": "create", "id": "pony", "content": "kayak", "palindromeProfile": "potato"}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if !assert.Equal(t, 3, len(results)) {
+		return
+	}
+	assert.True(t, results[0].Message.IsPalindrome)
+	assert.Equal(t, db.ProfileAlphanumeric, results[0].Message.PalindromeProfile)
+	assert.Equal(t, db.DefaultPalindromeProfile, results[1].Message.PalindromeProfile)
+	assert.Equal(t, http.StatusBadRequest, results[2].Status)
+}
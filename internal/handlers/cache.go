@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+)
+
+// cacheStatser is a db that counts the reads served by its cache
+type cacheStatser interface {
+	Stats() db.CacheStats
+}
+
+// HandleRetrieveCacheStats replies with the hit and miss counters of the msg cache, 404 if the cache is disabled
+func (rp *Repository) HandleRetrieveCacheStats(w http.ResponseWriter, r *http.Request) {
+	cache, ok := rp.msgDb.(cacheStatser)
+	if !ok {
+		handleReqErr(w, "The msg cache is disabled", http.StatusNotFound, "")
+		return
+	}
+
+	writeJsonResp(w, cache.Stats(), "cache stats")
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRepository_HandleRetrieveCacheStats(t *testing.T) {
+	ctx := context.Background()
+	cachedDb := db.NewCachedMsgDB(db.NewBasicMsgDB(), 10, 0)
+	assert.Nil(t, cachedDb.CreateMsg(ctx, db.NewMsg("pony", "kayak")))
+	_, err := cachedDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	_, err = cachedDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	rp := NewRepository(cachedDb)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveCacheStats", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveCacheStats).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var stats db.CacheStats
+	assert.Nil(t, json.NewDecoder(rr.Body).Decode(&stats))
+	assert.Equal(t, cachedDb.Stats(), stats)
+	assert.Equal(t, uint64(2), stats.Hits+stats.Misses)
+}
+
+func TestRepository_HandleRetrieveCacheStats_Disabled(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	req := httptest.NewRequest("GET", "/v1/retrieveCacheStats", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveCacheStats).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
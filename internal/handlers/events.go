@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxEventsStreamDuration is how long an events stream lasts, so the streams of the clients that are gone don't
+	// pile up; clients reconnect with the id of the last event they got to go on
+	maxEventsStreamDuration = 10 * time.Second
+	// eventsKeepAlive is how often an idle events stream sends a comment, so proxies don't close it
+	eventsKeepAlive = 5 * time.Second
+	// eventsRetry is how long clients wait to reconnect once a stream ends, in milliseconds
+	eventsRetry = 500
+)
+
+// HandleEvents streams the changes of the messages as server-sent events: each has the event id, the change type
+// (created, updated or deleted) as event name, and the event as json data. The stream starts after the event whose
+// id is in the Last-Event-ID header (or the 'lastEventId' query param), with the new changes if there's none
+// replies 410 if the events that followed that id are no longer available, the client must reload the messages
+func (rp *Repository) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleReqErr(w, "Streaming is not supported", http.StatusInternalServerError, "the writer can't flush")
+		return
+	}
+
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("lastEventId")
+	}
+
+	events, err := rp.msgDb.Watch(r.Context(), after)
+	if err != nil {
+		if db.IsErrEventNotFound(err) {
+			handleReqErr(w, err.Error(), http.StatusGone, "")
+			return
+		}
+		handleReqErr(w, "Unexpected error during watch of messages", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+
+	end := time.NewTimer(maxEventsStreamDuration)
+	defer end.Stop()
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// the watch ended, the client reconnects with the last event it got
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error("Failed to marshal event: ", err.Error())
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-end.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent returns the fields of the next event of the stream, skipping the retry and keep-alive frames
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	for {
+		fields := map[string]string{}
+		for {
+			line, err := reader.ReadString('\n')
+			if !assert.Nil(t, err) {
+				return nil
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				break
+			}
+			if i := strings.Index(line, ": "); i > 0 {
+				fields[line[:i]] = line[i+2:]
+			}
+		}
+		if fields["id"] != "" {
+			return fields
+		}
+	}
+}
+
+func TestRepository_HandleEvents(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+	server := httptest.NewServer(http.HandlerFunc(rp.HandleEvents))
+	defer server.Close()
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "retry: 500\n", line)
+
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, basicDb.DeleteMsg(ctx, "unicorn"))
+
+	created := readEvent(t, reader)
+	assert.Equal(t, "created", created["event"])
+	assert.Contains(t, created["data"], `"msgId":"unicorn"`)
+	assert.Contains(t, created["data"], `"isPalindrome":true`)
+	deleted := readEvent(t, reader)
+	assert.Equal(t, "deleted", deleted["event"])
+	assert.Contains(t, deleted["data"], `"deletedAt"`)
+
+	// a stream resumed after the creation starts with the deletion
+	req, _ = http.NewRequestWithContext(reqCtx, "GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", created["id"])
+	resumed, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resumed.Body.Close()
+	assert.Equal(t, deleted, readEvent(t, bufio.NewReader(resumed.Body)))
+}
+
+func TestRepository_HandleEvents_Gone(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	req := httptest.NewRequest("GET", "/v1/events?lastEventId=potato", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleEvents).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusGone, rr.Code)
+}
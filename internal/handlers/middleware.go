@@ -25,3 +25,11 @@ func RecoveryMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// TimeoutMiddleware replies 503 to the requests that aren't handled within timeout, and cancels their ctx
+// the responses are buffered until the handler returns, so it can't be used on the routes that stream them
+func TimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, timeout, "Request timed out")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestLoggingMiddleware(t *testing.T) {
@@ -31,3 +32,16 @@ func TestRecoveryMiddleware(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
 }
+
+func TestTimeoutMiddleware(t *testing.T) {
+	slowFn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := TimeoutMiddleware(10 * time.Millisecond)(slowFn)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/hello", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
@@ -2,23 +2,58 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/uritrejo/palermo/internal/db"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+	ndjsonMediaType  = "application/x-ndjson"
+	// ndjsonFlushEvery is the number of messages written between flushes when streaming them
+	ndjsonFlushEvery = 100
 )
 
 // Repository will implement the handlers for our REST API
 // it will store all messages in msgDb
 type Repository struct {
 	msgDb db.MsgDB
+	// defaultProfile is the palindrome profile of the msgs whose requests don't choose one
+	defaultProfile db.PalindromeProfile
 }
 
 func NewRepository(msgDb db.MsgDB) *Repository {
 	return &Repository{
-		msgDb: msgDb,
+		msgDb:          msgDb,
+		defaultProfile: db.DefaultPalindromeProfile,
+	}
+}
+
+// SetDefaultProfile sets the palindrome profile of the msgs whose requests don't choose one
+func (rp *Repository) SetDefaultProfile(profile db.PalindromeProfile) {
+	rp.defaultProfile = profile
+}
+
+// msgProfile returns the palindrome profile named in a request, the default one if none
+func (rp *Repository) msgProfile(name db.PalindromeProfile) (db.PalindromeProfile, error) {
+	if name == "" {
+		return rp.defaultProfile, nil
 	}
+	return db.ParsePalindromeProfile(string(name))
+}
+
+// createMsgReq is the body of a createMsg request: the msg, which can optionally expire either at an absolute time
+// (its expiresAt) or after a duration (ttl, e.g: "90s", "2h")
+type createMsgReq struct {
+	db.Msg
+	TTL string `json:"ttl"`
 }
 
 func (rp *Repository) HandleCreateMsg(w http.ResponseWriter, r *http.Request) {
@@ -27,7 +62,7 @@ func (rp *Repository) HandleCreateMsg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var msgRcv db.Msg
+	var msgRcv createMsgReq
 	err := json.NewDecoder(r.Body).Decode(&msgRcv)
 	if err != nil {
 		handleReqErr(w, "Failed to decode body into msg object", http.StatusBadRequest, err.Error())
@@ -40,10 +75,23 @@ func (rp *Repository) HandleCreateMsg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expiresAt, err := msgExpiry(msgRcv.ExpiresAt, msgRcv.TTL)
+	if err != nil {
+		handleReqErr(w, "Invalid expiry: "+err.Error(), http.StatusBadRequest, err.Error())
+		return
+	}
+
+	profile, err := rp.msgProfile(msgRcv.PalindromeProfile)
+	if err != nil {
+		handleReqErr(w, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+
 	// the NewMsg constructor will add the mod time and determine if it's a palindrome:
-	msg := db.NewMsg(msgRcv.Id, msgRcv.Content)
+	msg := db.NewMsgWithProfile(msgRcv.Id, msgRcv.Content, profile)
+	msg.ExpiresAt = expiresAt
 
-	err = rp.msgDb.CreateMsg(msg)
+	err = rp.msgDb.CreateMsg(r.Context(), msg)
 	if err != nil {
 		if db.IsErrIdUnavailable(err) {
 			handleReqErr(w, "CreateMsg request failed, "+msg.Id+" is already in use", http.StatusConflict, err.Error())
@@ -53,34 +101,175 @@ func (rp *Repository) HandleCreateMsg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", msgETag(msg.Version))
 	log.Debug("A message was successfully created: ", msg.String())
 }
 
+// listQueryParams are the query parameters that select a page of messages, see parseListOptions
+var listQueryParams = []string{
+	"limit", "cursor", "isPalindrome", "modifiedSince", "modifiedBefore", "idPrefix", "minLength", "maxLength",
+	"minPalindromeLength", "maxPalindromeLength", "sort", "order",
+}
+
+// HandleRetrieveAllMsgs replies with all the messages, or with a page of them if any of the listQueryParams is set,
+// e.g. 'limit' or a filter (the response then includes the 'nextCursor' to request the following page)
+// if the client accepts application/x-ndjson, all the messages are streamed instead, one per line
 func (rp *Repository) HandleRetrieveAllMsgs(w http.ResponseWriter, r *http.Request) {
-	msgs, err := rp.msgDb.GetAllMsgs()
+	if strings.Contains(r.Header.Get("Accept"), ndjsonMediaType) {
+		rp.streamMsgs(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	for _, param := range listQueryParams {
+		if query.Get(param) != "" {
+			rp.retrieveMsgsPage(w, r)
+			return
+		}
+	}
+
+	msgs, err := rp.msgDb.GetAllMsgs(r.Context())
 	if err != nil {
 		handleReqErr(w, "Unexpected error during retrieval of all messages", http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	msgJson, err := json.Marshal(map[string]interface{}{"messages": msgs})
+	writeJsonResp(w, map[string]interface{}{"messages": msgs}, "messages")
+}
+
+func (rp *Repository) retrieveMsgsPage(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r.URL.Query())
 	if err != nil {
-		handleReqErr(w, "Unexpected error during marshalling of messages", http.StatusInternalServerError, err.Error())
+		handleReqErr(w, "Invalid query parameters: "+err.Error(), http.StatusBadRequest, "")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(msgJson)
+	page, err := rp.msgDb.ListMsgs(r.Context(), opts)
 	if err != nil {
-		handleReqErr(w, "Unexpected error during encoding of messages into json", http.StatusInternalServerError, err.Error())
+		if db.IsErrInvalidCursor(err) || db.IsErrInvalidLimit(err) || db.IsErrInvalidSort(err) {
+			handleReqErr(w, err.Error(), http.StatusBadRequest, "")
+			return
+		}
+		handleReqErr(w, "Unexpected error during retrieval of messages", http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	writeJsonResp(w, map[string]interface{}{"messages": page.Msgs, "nextCursor": page.NextCursor}, "messages")
+}
+
+// streamMsgs writes every message as a line of json while iterating over the db, so memory use doesn't depend on the
+// number of messages. Once the first line is written the status can't change anymore, so later errors can only be
+// logged and end the response early
+func (rp *Repository) streamMsgs(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	written := 0
+
+	w.Header().Set("Content-Type", ndjsonMediaType)
+	err := rp.msgDb.ForEachMsg(r.Context(), func(msg *db.Msg) error {
+		err := enc.Encode(msg)
+		if err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if written == 0 {
+			handleReqErr(w, "Unexpected error during retrieval of all messages", http.StatusInternalServerError, err.Error())
+			return
+		}
+		log.Errorf("Failed to stream messages after %d of them: %s", written, err.Error())
+		return
+	}
+
+	if flusher != nil {
+		flusher.Flush()
+	}
+	log.Debugf("Successfully streamed %d messages", written)
+}
+
+// parseListOptions reads the page requested in the query params, limit defaults to defaultPageLimit and is capped
+// at maxPageLimit; the messages are filtered by parseMsgFilter, sorted by 'sort' (modTime, id, contentLength or
+// longestPalindromeLength) in the 'order' asc or desc. The errors returned describe the param that is not valid
+func parseListOptions(query url.Values) (db.ListOptions, error) {
+	opts := db.ListOptions{Limit: defaultPageLimit, Cursor: query.Get("cursor"), SortBy: db.SortField(query.Get("sort"))}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil || opts.Limit <= 0 {
+			return opts, errors.New("limit must be a positive number")
+		}
+		if opts.Limit > maxPageLimit {
+			opts.Limit = maxPageLimit
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+
+	var err error
+	opts.Filter, err = parseMsgFilter(query)
+	return opts, err
+}
+
+// parseMsgFilter reads the filter of the messages listed from the query params: 'isPalindrome' (true or false),
+// 'modifiedSince' and 'modifiedBefore' (RFC 3339 timestamps), 'idPrefix', 'minLength' and 'maxLength' (in characters),
+// 'minPalindromeLength' and 'maxPalindromeLength' (of the longest palindrome, in characters)
+func parseMsgFilter(query url.Values) (db.MsgFilter, error) {
+	filter := db.MsgFilter{IdPrefix: query.Get("idPrefix")}
+
+	if v := query.Get("isPalindrome"); v != "" {
+		isPalindrome, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, errors.New("isPalindrome must be true or false")
+		}
+		filter.IsPalindrome = &isPalindrome
+	}
+
+	for param, dst := range map[string]**time.Time{
+		"modifiedSince":  &filter.ModifiedSince,
+		"modifiedBefore": &filter.ModifiedBefore,
+	} {
+		if v := query.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return filter, errors.New(param + " must be an RFC 3339 timestamp, e.g. 2030-01-01T00:00:00Z")
+			}
+			*dst = &t
+		}
+	}
+
+	for param, dst := range map[string]**int{
+		"minLength":           &filter.MinLength,
+		"maxLength":           &filter.MaxLength,
+		"minPalindromeLength": &filter.MinPalindromeLength,
+		"maxPalindromeLength": &filter.MaxPalindromeLength,
+	} {
+		if v := query.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return filter, errors.New(param + " must be a number that is not negative")
+			}
+			*dst = &n
+		}
+	}
+
+	return filter, nil
 }
 
 func (rp *Repository) HandleRetrieveMsg(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	msg, err := rp.msgDb.GetMsg(id)
+	msg, err := rp.msgDb.GetMsg(r.Context(), id)
 	if err != nil {
 		if db.IsErrMsgNotFound(err) {
 			handleReqErr(w, "Msg with id "+id+" was not found", http.StatusNotFound, err.Error())
@@ -92,18 +281,8 @@ func (rp *Repository) HandleRetrieveMsg(w http.ResponseWriter, r *http.Request)
 
 	log.Debug("Successfully retrieved message: ", msg.String())
 
-	msgJson, err := json.Marshal(msg)
-	if err != nil {
-		handleReqErr(w, "Unexpected error during marshalling of message", http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(msgJson)
-	if err != nil {
-		handleReqErr(w, "Unexpected error during encoding of message into json", http.StatusInternalServerError, err.Error())
-		return
-	}
+	w.Header().Set("ETag", msgETag(msg.Version))
+	writeJsonResp(w, msg, "message")
 }
 
 func (rp *Repository) HandleUpdateMsg(w http.ResponseWriter, r *http.Request) {
@@ -126,31 +305,79 @@ func (rp *Repository) HandleUpdateMsg(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	profile, err := rp.msgProfile(msgRcv.PalindromeProfile)
+	if err != nil {
+		handleReqErr(w, err.Error(), http.StatusBadRequest, "")
+		return
+	}
+
 	// the NewMsg constructor will add the mod time and determine if it's a palindrome:
-	msg := db.NewMsg(msgRcv.Id, msgRcv.Content)
+	msg := db.NewMsgWithProfile(msgRcv.Id, msgRcv.Content, profile)
 
-	err = rp.msgDb.UpdateMsg(msg)
+	if !rp.updateMsg(w, r, msg) {
+		return
+	}
+	log.Debug("A message was successfully updated: ", msg.String())
+}
+
+// updateMsg updates msg in the db, conditionally if the request has an If-Match header, and sets the ETag of the
+// resulting version. Returns false if it failed, in which case the error was already replied
+func (rp *Repository) updateMsg(w http.ResponseWriter, r *http.Request, msg *db.Msg) bool {
+	version, conditional, err := ifMatchVersion(r)
+	if err != nil {
+		handleReqErr(w, "The If-Match header doesn't match any version of msg with id "+msg.Id,
+			http.StatusPreconditionFailed, err.Error())
+		return false
+	}
+
+	if conditional {
+		err = rp.msgDb.UpdateMsgIfVersion(r.Context(), msg, version)
+	} else {
+		err = rp.msgDb.UpdateMsg(r.Context(), msg)
+	}
 	if err != nil {
 		if db.IsErrMsgNotFound(err) {
-			handleReqErr(w, "Msg with id "+id+" was not found", http.StatusNotFound, err.Error())
-			return
+			handleReqErr(w, "Msg with id "+msg.Id+" was not found", http.StatusNotFound, err.Error())
+			return false
 		}
-		handleReqErr(w, "Unexpected error during creation of message", http.StatusInternalServerError, err.Error())
-		return
+		if db.IsErrVersionConflict(err) {
+			handleReqErr(w, "Msg with id "+msg.Id+" was modified since the version provided",
+				http.StatusPreconditionFailed, err.Error())
+			return false
+		}
+		handleReqErr(w, "Unexpected error during update of message", http.StatusInternalServerError, err.Error())
+		return false
 	}
 
-	log.Debug("A message was successfully updated: ", msg.String())
+	w.Header().Set("ETag", msgETag(msg.Version))
+	return true
 }
 
 func (rp *Repository) HandleDeleteMsg(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	err := rp.msgDb.DeleteMsg(id)
+	version, conditional, err := ifMatchVersion(r)
+	if err != nil {
+		handleReqErr(w, "The If-Match header doesn't match any version of msg with id "+id, http.StatusPreconditionFailed,
+			err.Error())
+		return
+	}
+
+	if conditional {
+		err = rp.msgDb.DeleteMsgIfVersion(r.Context(), id, version)
+	} else {
+		err = rp.msgDb.DeleteMsg(r.Context(), id)
+	}
 	if err != nil {
 		if db.IsErrMsgNotFound(err) {
 			handleReqErr(w, "Msg with id "+id+" was not found", http.StatusNotFound, err.Error())
 			return
 		}
+		if db.IsErrVersionConflict(err) {
+			handleReqErr(w, "Msg with id "+id+" was modified since the version provided", http.StatusPreconditionFailed,
+				err.Error())
+			return
+		}
 		handleReqErr(w, "Unexpected error during deletion of message", http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -158,6 +385,68 @@ func (rp *Repository) HandleDeleteMsg(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Successfully deleted message with id: ", id)
 }
 
+// msgETag returns the entity tag of a msg with the version provided
+func msgETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// msgExpiry returns when a msg being created expires, given the expiresAt and ttl of the request, nil if never
+func msgExpiry(expiresAt *time.Time, ttl string) (*time.Time, error) {
+	if expiresAt != nil && ttl != "" {
+		return nil, errors.New("only one of expiresAt and ttl can be set")
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("ttl must be positive")
+		}
+		t := time.Now().Add(d)
+		return &t, nil
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, errors.New("expiresAt must be in the future")
+	}
+	return expiresAt, nil
+}
+
+// ifMatchVersion returns the msg version required by the If-Match header of r, conditional is false if the header
+// doesn't require any (it's missing or "*", which only requires the msg to exist)
+// returns an error if the header isn't the entity tag of a msg, weak tags never match since If-Match compares strongly
+func ifMatchVersion(r *http.Request) (version int64, conditional bool, err error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, false, nil
+	}
+
+	if len(ifMatch) < 2 || !strings.HasPrefix(ifMatch, `"`) || !strings.HasSuffix(ifMatch, `"`) {
+		return 0, true, errors.New("unsupported If-Match header: " + ifMatch)
+	}
+	version, err = strconv.ParseInt(ifMatch[1:len(ifMatch)-1], 10, 64)
+	if err != nil {
+		return 0, true, err
+	}
+	return version, true, nil
+}
+
+// writeJsonResp replies with v encoded in json, what describes v in the error messages
+func writeJsonResp(w http.ResponseWriter, v interface{}, what string) {
+	respJson, err := json.Marshal(v)
+	if err != nil {
+		handleReqErr(w, "Unexpected error during marshalling of "+what, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(respJson)
+	if err != nil {
+		handleReqErr(w, "Unexpected error during encoding of "+what+" into json", http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
 // handleReqErr logs the error and replies to the request
 // baseErrorMsg is the error message that will be sent back,
 // internalErrorMsg will be added to local logs
@@ -2,13 +2,17 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/uritrejo/palermo/internal/db"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewRepository(t *testing.T) {
@@ -81,6 +85,42 @@ func TestRepository_HandleCreateMsg_Conflict(t *testing.T) {
 	assert.Equal(t, http.StatusConflict, rr.Code)
 }
 
+func TestRepository_HandleCreateMsg_Expiry(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+	handler := http.HandlerFunc(rp.HandleCreateMsg)
+
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for body, code := range map[string]int{
+		`{"id": "unicorn", "content": "kayak", "ttl": "10m"}`:                                 http.StatusOK,
+		`{"id": "pony", "content": "kayak", "expiresAt": "` + expiresAt + `"}`:                http.StatusOK,
+		`{"id": "potato", "content": "kayak", "ttl": "-1s"}`:                                  http.StatusBadRequest,
+		`{"id": "potato", "content": "kayak", "ttl": "potato"}`:                               http.StatusBadRequest,
+		`{"id": "potato", "content": "kayak", "expiresAt": "2020-01-01T00:00:00Z"}`:           http.StatusBadRequest,
+		`{"id": "potato", "content": "kayak", "ttl": "1m", "expiresAt": "` + expiresAt + `"}`: http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest("POST", "/v1/createMsg", bytes.NewReader([]byte(body)))
+		req.Header.Set("content-type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, body)
+	}
+
+	msg, err := basicDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	if assert.NotNil(t, msg.ExpiresAt) {
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), *msg.ExpiresAt, time.Second)
+	}
+	msg, err = basicDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	if assert.NotNil(t, msg.ExpiresAt) {
+		assert.Equal(t, expiresAt, msg.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	_, err = basicDb.GetMsg(ctx, "potato")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
 func TestRepository_HandleCreateMsg_UnsupportedMediaType(t *testing.T) {
 	rp := NewRepository(db.NewBasicMsgDB())
 
@@ -95,10 +135,11 @@ func TestRepository_HandleCreateMsg_UnsupportedMediaType(t *testing.T) {
 }
 
 func TestRepository_HandleRetrieveMsg(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("potato", "11/11/11"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("potato", "11/11/11"))
 	assert.Nil(t, err)
 
 	req := httptest.NewRequest("GET", "/v1/retrieveMsg/potato", nil)
@@ -119,6 +160,59 @@ func TestRepository_HandleRetrieveMsg(t *testing.T) {
 	assert.True(t, msg.IsPalindrome)
 }
 
+func TestRepository_HandleRetrieveMsg_WordPalindrome(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	err := basicDb.CreateMsg(ctx, db.NewMsg("leaves", "Fall leaves after leaves fall"))
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveMsg/leaves", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "leaves"})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var msg db.Msg
+	err = json.NewDecoder(rr.Body).Decode(&msg)
+	assert.Nil(t, err)
+
+	assert.False(t, msg.IsPalindrome)
+	assert.True(t, msg.IsWordPalindrome)
+}
+
+func TestRepository_HandleRetrieveMsg_Properties(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	err := basicDb.CreateMsg(ctx, db.NewMsg("kayak", "a kayak"))
+	assert.Nil(t, err)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveMsg/kayak", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "kayak"})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var msg struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	err = json.NewDecoder(rr.Body).Decode(&msg)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		db.PalindromeAnalyzer:     false,
+		db.WordPalindromeAnalyzer: false,
+		db.LongestPalindromeAnalyzer: map[string]interface{}{
+			"text": "kayak", "offset": float64(2), "length": float64(5),
+		},
+	}, msg.Properties)
+}
+
 func TestRepository_HandleRetrieveMsg_NotFound(t *testing.T) {
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
@@ -134,14 +228,15 @@ func TestRepository_HandleRetrieveMsg_NotFound(t *testing.T) {
 }
 
 func TestRepository_HandleRetrieveAllMsgs(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("potato", "le message"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("potato", "le message"))
 	assert.Nil(t, err)
-	err = basicDb.CreateMsg(db.NewMsg("banana", "anana"))
+	err = basicDb.CreateMsg(ctx, db.NewMsg("banana", "anana"))
 	assert.Nil(t, err)
-	err = basicDb.CreateMsg(db.NewMsg("lemon", "i am a fruit"))
+	err = basicDb.CreateMsg(ctx, db.NewMsg("lemon", "i am a fruit"))
 	assert.Nil(t, err)
 
 	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs", nil)
@@ -189,10 +284,11 @@ func TestRepository_HandleRetrieveAllMsgs_Empty(t *testing.T) {
 }
 
 func TestRepository_HandleUpdateMsg(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("pony", "dskahfbgkalfjsd[a"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("pony", "dskahfbgkalfjsd[a"))
 	assert.Nil(t, err)
 
 	msg := `{"id": "pony", "content": "chocolate123"}`
@@ -208,10 +304,11 @@ func TestRepository_HandleUpdateMsg(t *testing.T) {
 }
 
 func TestRepository_HandleUpdateMsg_BadRequest(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("pony", "dskahfbgkalfjsd[a"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("pony", "dskahfbgkalfjsd[a"))
 	assert.Nil(t, err)
 
 	msg := `{"id": "pony", "content": "chocolate123"}`
@@ -245,10 +342,11 @@ func TestRepository_HandleUpdateMsg_NotFound(t *testing.T) {
 }
 
 func TestRepository_HandleUpdateMsg_UnsupportedMediaType(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("pony", "dskahfbgkalfjsd[a"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("pony", "dskahfbgkalfjsd[a"))
 	assert.Nil(t, err)
 
 	msg := `{"id": "pony", "content": "chocolate123"}`
@@ -264,10 +362,11 @@ func TestRepository_HandleUpdateMsg_UnsupportedMediaType(t *testing.T) {
 }
 
 func TestRepository_HandleDeleteMsg(t *testing.T) {
+	ctx := context.Background()
 	basicDb := db.NewBasicMsgDB()
 	rp := NewRepository(basicDb)
 
-	err := basicDb.CreateMsg(db.NewMsg("elephant", "they don't live in the forest"))
+	err := basicDb.CreateMsg(ctx, db.NewMsg("elephant", "they don't live in the forest"))
 	assert.Nil(t, err)
 
 	req := httptest.NewRequest("GET", "/v1/deleteMsg/elephant", nil)
@@ -295,3 +394,400 @@ func TestRepository_HandleDeleteMsg_NotFound(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusNotFound, rr.Code)
 }
+
+func TestRepository_HandleCreateMsg_Canceled(t *testing.T) {
+	// the db work must not happen once the client is gone
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msg := `{"id": "unicorn", "content": "kayak"}`
+	req := httptest.NewRequest("POST", "/v1/createMsg", bytes.NewReader([]byte(msg))).WithContext(ctx)
+	req.Header.Set("content-type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(rp.HandleCreateMsg)
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	_, err := basicDb.GetMsg(context.Background(), "unicorn")
+	assert.IsType(t, db.ErrMsgNotFound{}, err)
+}
+
+func TestRepository_HandleRetrieveAllMsgs_Paginated(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	for _, id := range []string{"potato", "banana", "lemon"} {
+		err := basicDb.CreateMsg(ctx, db.NewMsg(id, "le message"))
+		assert.Nil(t, err)
+	}
+
+	handler := http.HandlerFunc(rp.HandleRetrieveAllMsgs)
+	type pageResp struct {
+		Messages   []db.Msg `json:"messages"`
+		NextCursor string   `json:"nextCursor"`
+	}
+
+	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs?limit=2", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var page pageResp
+	err := json.NewDecoder(rr.Body).Decode(&page)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(page.Messages))
+	assert.NotEmpty(t, page.NextCursor)
+
+	req = httptest.NewRequest("GET", "/v1/retrieveAllMsgs?limit=2&cursor="+page.NextCursor, nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var lastPage pageResp
+	err = json.NewDecoder(rr.Body).Decode(&lastPage)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(lastPage.Messages))
+	assert.Empty(t, lastPage.NextCursor)
+
+	ids := map[string]bool{}
+	for _, msg := range append(page.Messages, lastPage.Messages...) {
+		ids[msg.Id] = true
+	}
+	assert.Equal(t, 3, len(ids))
+}
+
+func TestRepository_HandleRetrieveAllMsgs_BadPage(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+	handler := http.HandlerFunc(rp.HandleRetrieveAllMsgs)
+
+	for _, query := range []string{"limit=0", "limit=-3", "limit=potato", "cursor=potato", "limit=5&cursor=e30"} {
+		req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs?"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestParseListOptions(t *testing.T) {
+	opts, err := parseListOptions(url.Values{"cursor": []string{"abc"}})
+	assert.Nil(t, err)
+	assert.Equal(t, db.ListOptions{Limit: defaultPageLimit, Cursor: "abc"}, opts)
+
+	opts, err = parseListOptions(url.Values{"limit": []string{"1000000"}})
+	assert.Nil(t, err)
+	assert.Equal(t, maxPageLimit, opts.Limit)
+
+	opts, err = parseListOptions(url.Values{
+		"idPrefix":       []string{"uni"},
+		"maxLength":      []string{"10"},
+		"modifiedBefore": []string{"2030-01-01T00:00:00Z"},
+		"sort":           []string{"id"},
+		"order":          []string{"desc"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "uni", opts.Filter.IdPrefix)
+	if assert.NotNil(t, opts.Filter.MaxLength) {
+		assert.Equal(t, 10, *opts.Filter.MaxLength)
+	}
+	if assert.NotNil(t, opts.Filter.ModifiedBefore) {
+		assert.Equal(t, 2030, opts.Filter.ModifiedBefore.Year())
+	}
+	assert.Nil(t, opts.Filter.IsPalindrome)
+	assert.Equal(t, db.SortById, opts.SortBy)
+	assert.True(t, opts.Desc)
+}
+
+func TestRepository_HandleRetrieveAllMsgs_Filtered(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	since := time.Now()
+	for _, msg := range []*db.Msg{
+		db.NewMsg("old", "kayak"),
+		db.NewMsg("racecar", "racecar"),
+		db.NewMsg("level", "level"),
+		db.NewMsg("banana", "banana"),
+	} {
+		if msg.Id == "old" {
+			msg.ModTime = since.Add(-48 * time.Hour)
+		}
+		assert.Nil(t, basicDb.CreateMsg(ctx, msg))
+	}
+
+	query := url.Values{
+		"isPalindrome":  []string{"true"},
+		"modifiedSince": []string{since.Add(-24 * time.Hour).Format(time.RFC3339Nano)},
+		"sort":          []string{"contentLength"},
+		"order":         []string{"desc"},
+	}
+	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveAllMsgs).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Messages []db.Msg `json:"messages"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	var ids []string
+	for _, msg := range resp.Messages {
+		ids = append(ids, msg.Id)
+	}
+	assert.Equal(t, []string{"racecar", "level"}, ids)
+}
+
+func TestRepository_HandleRetrieveAllMsgs_LongestPalindrome(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	for _, msg := range []*db.Msg{
+		db.NewMsg("banana", "banana"),
+		db.NewMsg("abc", "abc"),
+		db.NewMsg("racecar", "a racecar"),
+		db.NewMsg("noon", "noon!"),
+	} {
+		assert.Nil(t, basicDb.CreateMsg(ctx, msg))
+	}
+
+	query := url.Values{
+		"minPalindromeLength": []string{"4"},
+		"sort":                []string{"longestPalindromeLength"},
+		"order":               []string{"desc"},
+	}
+	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveAllMsgs).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Messages []db.Msg `json:"messages"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	var spans []db.PalindromeSpan
+	for _, msg := range resp.Messages {
+		spans = append(spans, msg.LongestPalindrome)
+	}
+	assert.Equal(t, []db.PalindromeSpan{
+		{Text: "racecar", Offset: 2, Length: 7},
+		{Text: "anana", Offset: 1, Length: 5},
+		{Text: "noon", Offset: 0, Length: 4},
+	}, spans)
+}
+
+func TestRepository_HandleRetrieveAllMsgs_BadQuery(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+	handler := http.HandlerFunc(rp.HandleRetrieveAllMsgs)
+
+	for _, query := range []string{"isPalindrome=potato", "modifiedSince=yesterday", "minLength=-1", "maxLength=x",
+		"minPalindromeLength=-2", "maxPalindromeLength=long", "sort=potato", "order=sideways", "sort=id&cursor=e30"} {
+		req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs?"+query, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestRepository_HandleRetrieveAllMsgs_NDJSON(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	ids := []string{"potato", "banana", "lemon"}
+	for _, id := range ids {
+		err := basicDb.CreateMsg(ctx, db.NewMsg(id, "le message"))
+		assert.Nil(t, err)
+	}
+
+	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(rp.HandleRetrieveAllMsgs)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.True(t, rr.Flushed)
+
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	assert.Equal(t, len(ids), len(lines))
+	for _, line := range lines {
+		var msg db.Msg
+		err := json.Unmarshal([]byte(line), &msg)
+		assert.Nil(t, err)
+		assert.Contains(t, ids, msg.Id)
+		assert.Equal(t, "le message", msg.Content)
+	}
+}
+
+func TestRepository_HandleRetrieveAllMsgs_NDJSONEmpty(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	req := httptest.NewRequest("GET", "/v1/retrieveAllMsgs", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(rp.HandleRetrieveAllMsgs)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	assert.Equal(t, 0, rr.Body.Len())
+}
+
+func TestRepository_HandleUpdateMsg_IfMatch(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	err := basicDb.CreateMsg(ctx, db.NewMsg("pony", "dskahfbgkalfjsd[a"))
+	assert.Nil(t, err)
+
+	handler := http.HandlerFunc(rp.HandleUpdateMsg)
+	update := func(content, ifMatch string) *httptest.ResponseRecorder {
+		msg := `{"id": "pony", "content": "` + content + `"}`
+		req := httptest.NewRequest("POST", "/v1/updateMsg/pony", bytes.NewReader([]byte(msg)))
+		req.Header.Set("content-type", "application/json")
+		req.Header.Set("If-Match", ifMatch)
+		req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := update("chocolate123", `"1"`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	// the version 1 is outdated now
+	rr = update("vanilla", `"1"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+	msg, err := basicDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	assert.Equal(t, "chocolate123", msg.Content)
+
+	for _, ifMatch := range []string{`W/"2"`, `2`, `"potato"`} {
+		rr = update("vanilla", ifMatch)
+		assert.Equal(t, http.StatusPreconditionFailed, rr.Code, ifMatch)
+	}
+
+	rr = update("vanilla", "*")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"3"`, rr.Header().Get("ETag"))
+}
+
+func TestRepository_HandleDeleteMsg_IfMatch(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	err := basicDb.CreateMsg(ctx, db.NewMsg("elephant", "they don't live in the forest"))
+	assert.Nil(t, err)
+
+	handler := http.HandlerFunc(rp.HandleDeleteMsg)
+	del := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/deleteMsg/elephant", nil)
+		req.Header.Set("If-Match", ifMatch)
+		req = mux.SetURLVars(req, map[string]string{"id": "elephant"})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusPreconditionFailed, del(`"7"`).Code)
+	_, err = basicDb.GetMsg(ctx, "elephant")
+	assert.Nil(t, err)
+
+	assert.Equal(t, http.StatusOK, del(`"1"`).Code)
+	assert.Equal(t, http.StatusNotFound, del(`"1"`).Code)
+}
+
+func TestRepository_HandleRetrieveMsg_ETag(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+
+	req := httptest.NewRequest("POST", "/v1/createMsg", bytes.NewReader([]byte(`{"id": "pony", "content": "kayak"}`)))
+	req.Header.Set("content-type", "application/json")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleCreateMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+
+	err := basicDb.UpdateMsg(ctx, db.NewMsg("pony", "canoe"))
+	assert.Nil(t, err)
+
+	req = httptest.NewRequest("GET", "/v1/retrieveMsg/pony", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	var msg db.Msg
+	err = json.NewDecoder(rr.Body).Decode(&msg)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), msg.Version)
+}
+
+func TestRepository_PalindromeProfile(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	rp := NewRepository(basicDb)
+	rp.SetDefaultProfile(db.ProfileLettersOnly)
+	create := http.HandlerFunc(rp.HandleCreateMsg)
+
+	// the default profile applies when the request doesn't choose one
+	for id, body := range map[string]string{
+		"panama": `{"id": "panama", "content": "A man, a plan, a canal: Panama"}`,
+		"strict": `{"id": "strict", "content": "A man, a plan, a canal: Panama", "palindromeProfile": "strict"}`,
+	} {
+		req := httptest.NewRequest("POST", "/v1/createMsg", strings.NewReader(body))
+		req.Header.Set("content-type", "application/json")
+		rr := httptest.NewRecorder()
+		create.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, id)
+	}
+	msg, err := basicDb.GetMsg(ctx, "panama")
+	assert.Nil(t, err)
+	assert.True(t, msg.IsPalindrome)
+	assert.Equal(t, db.ProfileLettersOnly, msg.PalindromeProfile)
+	msg, err = basicDb.GetMsg(ctx, "strict")
+	assert.Nil(t, err)
+	assert.False(t, msg.IsPalindrome)
+	assert.Equal(t, db.ProfileStrict, msg.PalindromeProfile)
+
+	req := httptest.NewRequest("POST", "/v1/updateMsg/panama",
+		strings.NewReader(`{"id": "panama", "content": "Kayak", "palindromeProfile": "case-insensitive"}`))
+	req.Header.Set("content-type", "application/json")
+	req = mux.SetURLVars(req, map[string]string{"id": "panama"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleUpdateMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	msg, err = basicDb.GetMsg(ctx, "panama")
+	assert.Nil(t, err)
+	assert.True(t, msg.IsPalindrome)
+	assert.Equal(t, db.ProfileCaseInsensitive, msg.PalindromeProfile)
+
+	// unknown profiles are rejected
+	req = httptest.NewRequest("POST", "/v1/createMsg",
+		strings.NewReader(`{"id": "pony", "content": "kayak", "palindromeProfile": "potato"}`))
+	req.Header.Set("content-type", "application/json")
+	rr = httptest.NewRecorder()
+	create.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	req = httptest.NewRequest("POST", "/v1/updateMsg/panama",
+		strings.NewReader(`{"id": "panama", "content": "kayak", "palindromeProfile": "potato"}`))
+	req.Header.Set("content-type", "application/json")
+	req = mux.SetURLVars(req, map[string]string{"id": "panama"})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleUpdateMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"strconv"
+)
+
+// HandleRetrieveMsgRevisions replies with all the revisions of a message, oldest first
+func (rp *Repository) HandleRetrieveMsgRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	revisions, err := rp.msgDb.GetRevisions(r.Context(), id)
+	if err != nil {
+		if db.IsErrMsgNotFound(err) {
+			handleReqErr(w, "Msg with id "+id+" was not found", http.StatusNotFound, err.Error())
+			return
+		}
+		handleReqErr(w, "Unexpected error during retrieval of revisions", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJsonResp(w, map[string]interface{}{"revisions": revisions}, "revisions")
+}
+
+// HandleRetrieveMsgRevision replies with the revision of a message at the version in the path
+func (rp *Repository) HandleRetrieveMsgRevision(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	version, err := parseVersion(mux.Vars(r)["version"])
+	if err != nil {
+		handleReqErr(w, "Invalid version, it must be a number", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rev, ok := rp.getRevision(w, r, id, version)
+	if !ok {
+		return
+	}
+
+	writeJsonResp(w, rev, "revision")
+}
+
+// HandleDiffMsgRevisions replies with the difference between the contents of the revisions of a message at the
+// versions in the 'from' and 'to' query parameters
+func (rp *Repository) HandleDiffMsgRevisions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	query := r.URL.Query()
+	fromVersion, err := parseVersion(query.Get("from"))
+	if err != nil {
+		handleReqErr(w, "Invalid 'from' version, it must be a number", http.StatusBadRequest, err.Error())
+		return
+	}
+	toVersion, err := parseVersion(query.Get("to"))
+	if err != nil {
+		handleReqErr(w, "Invalid 'to' version, it must be a number", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, ok := rp.getRevision(w, r, id, fromVersion)
+	if !ok {
+		return
+	}
+	to, ok := rp.getRevision(w, r, id, toVersion)
+	if !ok {
+		return
+	}
+
+	writeJsonResp(w, map[string]interface{}{
+		"from": fromVersion,
+		"to":   toVersion,
+		"diff": db.DiffContents(from.Content, to.Content),
+	}, "diff")
+}
+
+// HandleRollbackMsg sets the content of a message back to the one of its revision at the version in the path
+// the rollback is an update like any other: it records a new revision, and honors the If-Match header
+func (rp *Repository) HandleRollbackMsg(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	version, err := parseVersion(mux.Vars(r)["version"])
+	if err != nil {
+		handleReqErr(w, "Invalid version, it must be a number", http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rev, ok := rp.getRevision(w, r, id, version)
+	if !ok {
+		return
+	}
+
+	// the revision is checked again with its own profile, the revisions recorded before profiles get the default one
+	profile := rev.PalindromeProfile
+	if profile == "" {
+		profile = rp.defaultProfile
+	}
+	// the NewMsg constructor will add the mod time and determine if it's a palindrome:
+	msg := db.NewMsgWithProfile(id, rev.Content, profile)
+	if !rp.updateMsg(w, r, msg) {
+		return
+	}
+	log.Debugf("A message was successfully rolled back to version %d: %s", version, msg.String())
+}
+
+// getRevision returns the revision of the msg with the id and version provided
+// returns false if it failed, in which case the error was already replied
+func (rp *Repository) getRevision(w http.ResponseWriter, r *http.Request, id string, version int64) (*db.Revision, bool) {
+	rev, err := rp.msgDb.GetRevision(r.Context(), id, version)
+	if err != nil {
+		if db.IsErrMsgNotFound(err) {
+			handleReqErr(w, "Msg with id "+id+" was not found", http.StatusNotFound, err.Error())
+			return nil, false
+		}
+		if db.IsErrRevisionNotFound(err) {
+			handleReqErr(w, "Msg with id "+id+" has no revision with version "+strconv.FormatInt(version, 10),
+				http.StatusNotFound, err.Error())
+			return nil, false
+		}
+		handleReqErr(w, "Unexpected error during retrieval of revision", http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+
+	return rev, true
+}
+
+func parseVersion(s string) (int64, error) {
+	return strconv.ParseInt(s, 10, 64)
+}
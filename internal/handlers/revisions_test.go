@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestRevisionsRepository returns a repository whose msg 'pony' has the revisions 1: kayak, 2: canoe, 3: racecar
+func newTestRevisionsRepository(t *testing.T) (*Repository, db.MsgDB) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("pony", "kayak")))
+	assert.Nil(t, basicDb.UpdateMsg(ctx, db.NewMsg("pony", "canoe")))
+	assert.Nil(t, basicDb.UpdateMsg(ctx, db.NewMsg("pony", "racecar")))
+	return NewRepository(basicDb), basicDb
+}
+
+func TestRepository_HandleRetrieveMsgRevisions(t *testing.T) {
+	rp, _ := newTestRevisionsRepository(t)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveMsgRevisions/pony", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveMsgRevisions).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Revisions []db.Revision `json:"revisions"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Revisions))
+	assert.Equal(t, "canoe", resp.Revisions[1].Content)
+	assert.Equal(t, int64(2), resp.Revisions[1].Version)
+	assert.False(t, resp.Revisions[1].IsPalindrome)
+}
+
+func TestRepository_HandleRetrieveMsgRevisions_NotFound(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	req := httptest.NewRequest("GET", "/v1/retrieveMsgRevisions/pony", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveMsgRevisions).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestRepository_HandleRetrieveMsgRevision(t *testing.T) {
+	rp, _ := newTestRevisionsRepository(t)
+	handler := http.HandlerFunc(rp.HandleRetrieveMsgRevision)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveMsgRevision/pony/1", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony", "version": "1"})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var rev db.Revision
+	err := json.NewDecoder(rr.Body).Decode(&rev)
+	assert.Nil(t, err)
+	assert.Equal(t, "kayak", rev.Content)
+	assert.True(t, rev.IsPalindrome)
+
+	for version, code := range map[string]int{"7": http.StatusNotFound, "potato": http.StatusBadRequest} {
+		req = httptest.NewRequest("GET", "/v1/retrieveMsgRevision/pony/"+version, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "pony", "version": version})
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, version)
+	}
+}
+
+func TestRepository_HandleDiffMsgRevisions(t *testing.T) {
+	rp, _ := newTestRevisionsRepository(t)
+	handler := http.HandlerFunc(rp.HandleDiffMsgRevisions)
+
+	req := httptest.NewRequest("GET", "/v1/diffMsgRevisions/pony?from=1&to=3", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		From int64       `json:"from"`
+		To   int64       `json:"to"`
+		Diff []db.DiffOp `json:"diff"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), resp.From)
+	assert.Equal(t, int64(3), resp.To)
+	assert.Equal(t, []db.DiffOp{{Op: db.DiffDelete, Text: "kayak"}, {Op: db.DiffInsert, Text: "racecar"}}, resp.Diff)
+
+	for query, code := range map[string]int{"from=1": http.StatusBadRequest, "from=1&to=9": http.StatusNotFound} {
+		req = httptest.NewRequest("GET", "/v1/diffMsgRevisions/pony?"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, query)
+	}
+}
+
+func TestRepository_HandleRollbackMsg(t *testing.T) {
+	ctx := context.Background()
+	rp, msgDb := newTestRevisionsRepository(t)
+	handler := http.HandlerFunc(rp.HandleRollbackMsg)
+
+	req := httptest.NewRequest("POST", "/v1/rollbackMsg/pony/2", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony", "version": "2"})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"4"`, rr.Header().Get("ETag"))
+
+	msg, err := msgDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	assert.Equal(t, "canoe", msg.Content)
+	assert.False(t, msg.IsPalindrome)
+
+	// the rollback is recorded as a new revision
+	revisions, err := msgDb.GetRevisions(ctx, "pony")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(revisions))
+
+	// an outdated If-Match must not roll back
+	req = httptest.NewRequest("POST", "/v1/rollbackMsg/pony/1", nil)
+	req.Header.Set("If-Match", `"3"`)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony", "version": "1"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+
+	req = httptest.NewRequest("POST", "/v1/rollbackMsg/pony/9", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony", "version": "9"})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestRepository_HandleRollbackMsg_PalindromeProfile(t *testing.T) {
+	// the content rolled back to is checked with the profile of its revision
+	ctx := context.Background()
+	msgDb := db.NewBasicMsgDB()
+	rp := NewRepository(msgDb)
+	assert.Nil(t, msgDb.CreateMsg(ctx, db.NewMsgWithProfile("unicorn", "Kayak", db.ProfileStrict)))
+	assert.Nil(t, msgDb.UpdateMsg(ctx, db.NewMsg("unicorn", "canoe")))
+
+	req := httptest.NewRequest("POST", "/v1/rollbackMsg/unicorn/1", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "unicorn", "version": "1"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRollbackMsg).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	msg, err := msgDb.GetMsg(ctx, "unicorn")
+	assert.Nil(t, err)
+	assert.Equal(t, "Kayak", msg.Content)
+	assert.False(t, msg.IsPalindrome)
+	assert.Equal(t, db.ProfileStrict, msg.PalindromeProfile)
+}
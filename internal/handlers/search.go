@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultSearchLimit = 20
+)
+
+// HandleSearchMsgs replies with the messages whose content has every word and phrase of the 'q' query param, most
+// relevant first, along with a snippet of their content highlighting the matches; 'limit' caps how many are returned,
+// defaulting to defaultSearchLimit and capped at maxPageLimit
+func (rp *Repository) HandleSearchMsgs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			handleReqErr(w, "Invalid limit, it must be a positive number", http.StatusBadRequest, "")
+			return
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	results, err := rp.msgDb.SearchMsgs(r.Context(), query.Get("q"), limit)
+	if err != nil {
+		if db.IsErrInvalidSearchQuery(err) {
+			handleReqErr(w, err.Error(), http.StatusBadRequest, "")
+			return
+		}
+		handleReqErr(w, "Unexpected error during search of messages", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Debugf("Search found %d messages", len(results))
+
+	writeJsonResp(w, map[string]interface{}{"results": results}, "search results")
+}
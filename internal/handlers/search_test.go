@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRepository_HandleSearchMsgs(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("kayak", "I paddle a red kayak")))
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("canoe", "A red canoe")))
+	rp := NewRepository(basicDb)
+
+	req := httptest.NewRequest("GET", "/v1/searchMsgs?"+url.Values{"q": []string{`"red kayak"`}}.Encode(), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleSearchMsgs).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Results []db.SearchResult `json:"results"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(resp.Results)) {
+		assert.Equal(t, "kayak", resp.Results[0].Msg.Id)
+		assert.Equal(t, "I paddle a <mark>red kayak</mark>", resp.Results[0].Snippet)
+	}
+
+	req = httptest.NewRequest("GET", "/v1/searchMsgs?q=red&limit=1", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleSearchMsgs).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	err = json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Results))
+}
+
+func TestRepository_HandleSearchMsgs_BadRequest(t *testing.T) {
+	rp := NewRepository(db.NewBasicMsgDB())
+
+	for _, query := range []string{"", "q=", "q=%3F%21", "q=kayak&limit=0", "q=kayak&limit=potato"} {
+		req := httptest.NewRequest("GET", "/v1/searchMsgs?"+query, nil)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(rp.HandleSearchMsgs).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
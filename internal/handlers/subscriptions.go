@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSubscriptions is the number of subscriptions a connection can hold at once
+	maxSubscriptions = 100
+	// maxSubscriptionIds is the number of ids a single subscription can follow
+	maxSubscriptionIds = 1000
+	// maxSubscriptionReqSize is the max size in bytes of the requests a client sends
+	maxSubscriptionReqSize = 64 * 1024
+	// subscriptionSendBuffer is the number of notifications a client can fall behind by before it's disconnected
+	subscriptionSendBuffer = 256
+	// subscriptionWriteTimeout bounds the write of a single notification
+	subscriptionWriteTimeout = 10 * time.Second
+	// subscriptionPongWait is how long a client can stay silent, it must answer the pings sent every
+	// subscriptionPingPeriod
+	subscriptionPongWait   = 60 * time.Second
+	subscriptionPingPeriod = subscriptionPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// subscriptionReq is a request sent by a client: "subscribe" starts (or replaces) the subscription with the id
+// provided, "unsubscribe" ends it
+type subscriptionReq struct {
+	Action       string              `json:"action"`
+	Subscription string              `json:"subscription"`
+	Ids          []string            `json:"ids"`
+	Filter       *subscriptionFilter `json:"filter"`
+}
+
+// subscriptionFilter are the conditions on the msgs a subscription follows, the same as those of retrieveAllMsgs
+type subscriptionFilter struct {
+	IsPalindrome *bool  `json:"isPalindrome"`
+	IdPrefix     string `json:"idPrefix"`
+	MinLength    *int   `json:"minLength"`
+	MaxLength    *int   `json:"maxLength"`
+}
+
+// subscriptionResp is a message sent to a client: the reply to one of its requests ("subscribed", "unsubscribed" or
+// "error"), or a change of the msgs ("event") along with the subscriptions it matches
+type subscriptionResp struct {
+	Type          string       `json:"type"`
+	Subscription  string       `json:"subscription,omitempty"`
+	Subscriptions []string     `json:"subscriptions,omitempty"`
+	Event         *db.MsgEvent `json:"event,omitempty"`
+	Error         string       `json:"error,omitempty"`
+}
+
+// subscription follows the msgs with the ids provided, if any, that meet the filter
+type subscription struct {
+	ids    map[string]bool
+	filter db.MsgFilter
+}
+
+// newSubscription validates req and returns the subscription it asks for
+func newSubscription(req *subscriptionReq) (*subscription, error) {
+	if req.Subscription == "" {
+		return nil, errors.New("subscription must not be empty")
+	}
+	if len(req.Ids) > maxSubscriptionIds {
+		return nil, errors.New("a subscription can't follow more than 1000 ids")
+	}
+
+	sub := &subscription{}
+	if len(req.Ids) > 0 {
+		sub.ids = make(map[string]bool, len(req.Ids))
+		for _, id := range req.Ids {
+			sub.ids[id] = true
+		}
+	}
+	if f := req.Filter; f != nil {
+		if (f.MinLength != nil && *f.MinLength < 0) || (f.MaxLength != nil && *f.MaxLength < 0) {
+			return nil, errors.New("minLength and maxLength must be numbers that are not negative")
+		}
+		sub.filter = db.MsgFilter{
+			IsPalindrome: f.IsPalindrome,
+			IdPrefix:     f.IdPrefix,
+			MinLength:    f.MinLength,
+			MaxLength:    f.MaxLength,
+		}
+	}
+	return sub, nil
+}
+
+// matches returns true if the subscription follows the msg of event, deleted msgs are checked as they were trashed
+func (s *subscription) matches(event *db.MsgEvent) bool {
+	if s.ids != nil && !s.ids[event.MsgId] {
+		return false
+	}
+	return event.Msg != nil && s.filter.Matches(event.Msg)
+}
+
+// subscriber is the connection of a client along with its subscriptions
+// the replies and notifications are queued for a single writer, a client that lets the queue fill up is disconnected
+// instead of holding up the others
+type subscriber struct {
+	conn   *websocket.Conn
+	send   chan *subscriptionResp
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+// push queues resp for the client, returns false if the queue is full
+func (s *subscriber) push(resp *subscriptionResp) bool {
+	select {
+	case s.send <- resp:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushOrDrop queues resp for the client, disconnecting it if it's too slow to keep up
+func (s *subscriber) pushOrDrop(resp *subscriptionResp) {
+	if s.push(resp) {
+		return
+	}
+	log.Info("Disconnecting a subscriber too slow to keep up")
+	s.close(websocket.CloseTryAgainLater, "Too slow to keep up with the updates")
+}
+
+// close sends a close frame with the code and reason provided, then ends the connection
+func (s *subscriber) close(code int, reason string) {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(subscriptionWriteTimeout))
+	s.cancel()
+}
+
+// handle applies the request of the client and replies to it
+func (s *subscriber) handle(req *subscriptionReq) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.Action {
+	case "subscribe":
+		sub, err := newSubscription(req)
+		if err != nil {
+			s.pushOrDrop(&subscriptionResp{Type: "error", Subscription: req.Subscription, Error: err.Error()})
+			return
+		}
+		if _, ok := s.subs[req.Subscription]; !ok && len(s.subs) == maxSubscriptions {
+			s.pushOrDrop(&subscriptionResp{Type: "error", Subscription: req.Subscription,
+				Error: "a connection can't hold more than 100 subscriptions"})
+			return
+		}
+		s.subs[req.Subscription] = sub
+		s.pushOrDrop(&subscriptionResp{Type: "subscribed", Subscription: req.Subscription})
+	case "unsubscribe":
+		delete(s.subs, req.Subscription)
+		s.pushOrDrop(&subscriptionResp{Type: "unsubscribed", Subscription: req.Subscription})
+	default:
+		s.pushOrDrop(&subscriptionResp{Type: "error", Subscription: req.Subscription,
+			Error: "action must be subscribe or unsubscribe"})
+	}
+}
+
+// notify sends event to the client if it matches any of its subscriptions
+func (s *subscriber) notify(event *db.MsgEvent) {
+	s.mu.Lock()
+	var matched []string
+	for id, sub := range s.subs {
+		if sub.matches(event) {
+			matched = append(matched, id)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(matched) > 0 {
+		sort.Strings(matched)
+		s.pushOrDrop(&subscriptionResp{Type: "event", Subscriptions: matched, Event: event})
+	}
+}
+
+// readLoop handles the requests of the client until it disconnects
+func (s *subscriber) readLoop() {
+	defer s.cancel()
+
+	s.conn.SetReadLimit(maxSubscriptionReqSize)
+	_ = s.conn.SetReadDeadline(time.Now().Add(subscriptionPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(subscriptionPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req := &subscriptionReq{}
+		err = json.Unmarshal(data, req)
+		if err != nil {
+			// the connection can still be used
+			s.pushOrDrop(&subscriptionResp{Type: "error", Error: "Failed to decode the request: " + err.Error()})
+			continue
+		}
+		s.handle(req)
+	}
+}
+
+// writeLoop writes the queued replies and notifications, and pings the client, until ctx is done
+func (s *subscriber) writeLoop(ctx context.Context) {
+	defer s.cancel()
+
+	ping := time.NewTicker(subscriptionPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case resp := <-s.send:
+			_ = s.conn.SetWriteDeadline(time.Now().Add(subscriptionWriteTimeout))
+			err := s.conn.WriteJSON(resp)
+			if err != nil {
+				log.Error("Failed to write to subscriber: ", err.Error())
+				return
+			}
+		case <-ping.C:
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(subscriptionWriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// HandleSubscribe upgrades the connection to a WebSocket on which the client subscribes to the changes of the
+// messages with the ids it provides and/or that meet a filter, e.g:
+// {"action": "subscribe", "subscription": "palindromes", "filter": {"isPalindrome": true}}
+// {"action": "unsubscribe", "subscription": "palindromes"}
+// each change matching any subscription is pushed as {"type": "event", "subscriptions": [...], "event": {...}}
+// clients that fall behind are disconnected with code 1013 (try again later)
+func (rp *Repository) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := rp.msgDb.Watch(ctx, "")
+	if err != nil {
+		handleReqErr(w, "Unexpected error during watch of messages", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the upgrader replies to the requests that aren't valid WebSocket handshakes
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("Failed to upgrade to websocket: ", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	s := &subscriber{
+		conn:   conn,
+		send:   make(chan *subscriptionResp, subscriptionSendBuffer),
+		cancel: cancel,
+		subs:   map[string]*subscription{},
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.readLoop()
+	}()
+	go func() {
+		defer wg.Done()
+		s.writeLoop(ctx)
+	}()
+
+	lastEventId := ""
+	for ctx.Err() == nil {
+		select {
+		case event, ok := <-events:
+			if ok {
+				lastEventId = event.Id
+				s.notify(event)
+				continue
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			// the watch fell behind, it resumes where it stopped unless the events missed are gone
+			events, err = rp.msgDb.Watch(ctx, lastEventId)
+			if err != nil {
+				log.Error("Failed to resume watch of messages: ", err.Error())
+				s.close(websocket.CloseTryAgainLater, "Updates were missed")
+			}
+		case <-ctx.Done():
+		}
+	}
+
+	// unblocks the reader
+	conn.Close()
+	wg.Wait()
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialSubscribe connects to the subscriptions of the server provided
+func dialSubscribe(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	return conn
+}
+
+// readResp returns the next message sent by the server
+func readResp(t *testing.T, conn *websocket.Conn) *subscriptionResp {
+	resp := &subscriptionResp{}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !assert.Nil(t, conn.ReadJSON(resp)) {
+		t.FailNow()
+	}
+	return resp
+}
+
+func TestRepository_HandleSubscribe(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	server := httptest.NewServer(http.HandlerFunc(NewRepository(basicDb).HandleSubscribe))
+	defer server.Close()
+	conn := dialSubscribe(t, server)
+	defer conn.Close()
+
+	assert.Nil(t, conn.WriteJSON(map[string]interface{}{
+		"action": "subscribe", "subscription": "unicorns", "ids": []string{"unicorn"},
+	}))
+	assert.Equal(t, &subscriptionResp{Type: "subscribed", Subscription: "unicorns"}, readResp(t, conn))
+	assert.Nil(t, conn.WriteJSON(map[string]interface{}{
+		"action": "subscribe", "subscription": "palindromes", "filter": map[string]interface{}{"isPalindrome": true},
+	}))
+	assert.Equal(t, &subscriptionResp{Type: "subscribed", Subscription: "palindromes"}, readResp(t, conn))
+
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("unicorn", "kayak")))
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("pony", "horse")))
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("banana", "anana")))
+	assert.Nil(t, basicDb.UpdateMsg(ctx, db.NewMsg("unicorn", "canoe")))
+
+	resp := readResp(t, conn)
+	assert.Equal(t, "event", resp.Type)
+	assert.Equal(t, []string{"palindromes", "unicorns"}, resp.Subscriptions)
+	assert.Equal(t, db.MsgCreated, resp.Event.Type)
+	assert.Equal(t, "unicorn", resp.Event.MsgId)
+	// the pony isn't a palindrome
+	resp = readResp(t, conn)
+	assert.Equal(t, []string{"palindromes"}, resp.Subscriptions)
+	assert.Equal(t, "banana", resp.Event.MsgId)
+	resp = readResp(t, conn)
+	assert.Equal(t, []string{"unicorns"}, resp.Subscriptions)
+	assert.Equal(t, db.MsgUpdated, resp.Event.Type)
+	assert.Equal(t, "canoe", resp.Event.Msg.Content)
+
+	assert.Nil(t, conn.WriteJSON(map[string]interface{}{"action": "unsubscribe", "subscription": "unicorns"}))
+	assert.Equal(t, &subscriptionResp{Type: "unsubscribed", Subscription: "unicorns"}, readResp(t, conn))
+	assert.Nil(t, basicDb.UpdateMsg(ctx, db.NewMsg("unicorn", "racecar")))
+	resp = readResp(t, conn)
+	assert.Equal(t, []string{"palindromes"}, resp.Subscriptions)
+	assert.Equal(t, "racecar", resp.Event.Msg.Content)
+
+	// only the deletions of the palindromes are pushed
+	assert.Nil(t, basicDb.DeleteMsg(ctx, "pony"))
+	assert.Nil(t, basicDb.DeleteMsg(ctx, "banana"))
+	resp = readResp(t, conn)
+	assert.Equal(t, []string{"palindromes"}, resp.Subscriptions)
+	assert.Equal(t, db.MsgDeleted, resp.Event.Type)
+	assert.Equal(t, "banana", resp.Event.MsgId)
+}
+
+func TestRepository_HandleSubscribe_BadRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(NewRepository(db.NewBasicMsgDB()).HandleSubscribe))
+	defer server.Close()
+	conn := dialSubscribe(t, server)
+	defer conn.Close()
+
+	for _, req := range []string{
+		`{"action": "peel", "subscription": "bananas"}`,
+		`{"action": "subscribe"}`,
+		`{"action": "subscribe", "subscription": "short", "filter": {"maxLength": -1}}`,
+		`{"action": `,
+	} {
+		assert.Nil(t, conn.WriteMessage(websocket.TextMessage, []byte(req)))
+		resp := readResp(t, conn)
+		assert.Equal(t, "error", resp.Type, req)
+		assert.NotEmpty(t, resp.Error, req)
+	}
+
+	// the connection is still usable
+	assert.Nil(t, conn.WriteJSON(map[string]interface{}{"action": "subscribe", "subscription": "all"}))
+	assert.Equal(t, &subscriptionResp{Type: "subscribed", Subscription: "all"}, readResp(t, conn))
+
+	// a plain http request is rejected
+	rr, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	rr.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rr.StatusCode)
+}
+
+func TestSubscription_Matches(t *testing.T) {
+	yes := true
+	sub, err := newSubscription(&subscriptionReq{
+		Subscription: "palindromes",
+		Ids:          []string{"race-1", "race-2", "kayak"},
+		Filter:       &subscriptionFilter{IsPalindrome: &yes, IdPrefix: "race-"},
+	})
+	assert.Nil(t, err)
+
+	assert.True(t, sub.matches(&db.MsgEvent{MsgId: "race-1", Msg: db.NewMsg("race-1", "racecar")}))
+	assert.False(t, sub.matches(&db.MsgEvent{MsgId: "race-2", Msg: db.NewMsg("race-2", "canoe")}))
+	assert.False(t, sub.matches(&db.MsgEvent{MsgId: "kayak", Msg: db.NewMsg("kayak", "kayak")}))
+	assert.False(t, sub.matches(&db.MsgEvent{MsgId: "race-3", Msg: db.NewMsg("race-3", "level")}))
+	// deletions match by the msg as it was trashed
+	assert.True(t, sub.matches(&db.MsgEvent{Type: db.MsgDeleted, MsgId: "race-1", Msg: db.NewMsg("race-1", "racecar")}))
+	assert.False(t, sub.matches(&db.MsgEvent{Type: db.MsgDeleted, MsgId: "race-2", Msg: db.NewMsg("race-2", "canoe")}))
+	assert.False(t, sub.matches(&db.MsgEvent{Type: db.MsgDeleted, MsgId: "kayak", Msg: db.NewMsg("kayak", "kayak")}))
+
+	_, err = newSubscription(&subscriptionReq{Subscription: "many", Ids: make([]string, maxSubscriptionIds+1)})
+	assert.NotNil(t, err)
+}
+
+func TestSubscriber_Push(t *testing.T) {
+	// a full queue is not waited on
+	s := &subscriber{send: make(chan *subscriptionResp, 1)}
+	assert.True(t, s.push(&subscriptionResp{Type: "event"}))
+	assert.False(t, s.push(&subscriptionResp{Type: "event"}))
+}
+
+func TestSubscriber_PushOrDrop(t *testing.T) {
+	// a client whose queue is full is disconnected with try again later
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		s := &subscriber{conn: conn, send: make(chan *subscriptionResp), cancel: cancel}
+		s.pushOrDrop(&subscriptionResp{Type: "event"})
+		<-ctx.Done()
+	}))
+	defer server.Close()
+	conn := dialSubscribe(t, server)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater), err)
+}
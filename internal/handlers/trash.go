@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+)
+
+// HandleRetrieveTrashedMsgs replies with all the messages in the trash, along with when they were deleted
+func (rp *Repository) HandleRetrieveTrashedMsgs(w http.ResponseWriter, r *http.Request) {
+	msgs, err := rp.msgDb.GetTrashedMsgs(r.Context())
+	if err != nil {
+		handleReqErr(w, "Unexpected error during retrieval of trashed messages", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Debugf("Successfully retrieved %d trashed messages", len(msgs))
+
+	writeJsonResp(w, map[string]interface{}{"messages": msgs}, "trashed messages")
+}
+
+// HandleRestoreMsg moves the message with the id in the path out of the trash, as it was when deleted
+func (rp *Repository) HandleRestoreMsg(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	err := rp.msgDb.RestoreMsg(r.Context(), id)
+	if err != nil {
+		if db.IsErrMsgNotFound(err) {
+			handleReqErr(w, "Msg with id "+id+" was not found in the trash", http.StatusNotFound, err.Error())
+			return
+		}
+		if db.IsErrIdUnavailable(err) {
+			handleReqErr(w, "RestoreMsg request failed, "+id+" is already in use", http.StatusConflict, err.Error())
+			return
+		}
+		handleReqErr(w, "Unexpected error during restoration of message", http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Debug("Successfully restored message with id: ", id)
+}
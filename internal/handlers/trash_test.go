@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/uritrejo/palermo/internal/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRepository_HandleRetrieveTrashedMsgs(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("pony", "kayak")))
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("unicorn", "canoe")))
+	assert.Nil(t, basicDb.DeleteMsg(ctx, "pony"))
+	rp := NewRepository(basicDb)
+
+	req := httptest.NewRequest("GET", "/v1/retrieveTrashedMsgs", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rp.HandleRetrieveTrashedMsgs).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var resp struct {
+		Messages []db.Msg `json:"messages"`
+	}
+	err := json.NewDecoder(rr.Body).Decode(&resp)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Messages))
+	assert.Equal(t, "pony", resp.Messages[0].Id)
+	assert.NotNil(t, resp.Messages[0].DeletedAt)
+}
+
+func TestRepository_HandleRestoreMsg(t *testing.T) {
+	ctx := context.Background()
+	basicDb := db.NewBasicMsgDB()
+	assert.Nil(t, basicDb.CreateMsg(ctx, db.NewMsg("pony", "kayak")))
+	assert.Nil(t, basicDb.DeleteMsg(ctx, "pony"))
+	rp := NewRepository(basicDb)
+	handler := http.HandlerFunc(rp.HandleRestoreMsg)
+
+	req := httptest.NewRequest("POST", "/v1/restoreMsg/pony", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "pony"})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	msg, err := basicDb.GetMsg(ctx, "pony")
+	assert.Nil(t, err)
+	assert.Equal(t, "kayak", msg.Content)
+
+	// it's no longer in the trash
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}